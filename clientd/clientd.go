@@ -1,8 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/obud-dev/tunnel/pkg/metrics"
+	"github.com/obud-dev/tunnel/pkg/tracing"
 	"github.com/obud-dev/tunnel/pkg/transport"
 	"github.com/obud-dev/tunnel/pkg/utils"
 	"github.com/rs/zerolog/log"
@@ -11,6 +20,13 @@ import (
 func main() {
 	utils.InitLogger()
 	token := flag.String("token", "", "token to connect to the server")
+	maxRetries := flag.Int("max-retries", 0, "max consecutive reconnect attempts, 0 means retry forever")
+	backoffMin := flag.Duration("backoff-min", 0, "initial reconnect delay (default 1s)")
+	backoffMax := flag.Duration("backoff-max", 0, "maximum reconnect delay (default 1m)")
+	allowUnix := flag.String("allow-unix", "", "comma separated unix socket paths (globs allowed) that routes may target")
+	allowDir := flag.String("allow-dir", "", "comma separated directories that file:// routes may serve")
+	metricsAddr := flag.String("metrics", "", "address to serve Prometheus metrics on /metrics, e.g. 127.0.0.1:9100")
+	traceEndpoint := flag.String("trace-endpoint", "", "OTLP/HTTP collector to export traces to, e.g. http://127.0.0.1:4318")
 	flag.Parse()
 
 	if *token == "" {
@@ -18,8 +34,23 @@ func main() {
 		return
 	}
 
-	// 打印内存使用情况
-	// go utils.PrintMemoryUsage()
+	shutdownTracing, err := tracing.Init("tunnel-clientd", *traceEndpoint)
+	// 追踪配置有误时与服务端一样只记录错误, 不影响隧道
+	if err != nil {
+		log.Error().Err(err).Msg("failed to set up tracing")
+	} else {
+		defer shutdownTracing(context.Background())
+	}
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.ClientHandler())
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				log.Error().Err(err).Msg("metrics listener stopped")
+			}
+		}()
+	}
 
 	// 连接到公网服务器
 	client, err := transport.NewTcpClient(*token)
@@ -27,5 +58,23 @@ func main() {
 		log.Error().Err(err).Msg("failed to create client")
 		return
 	}
-	client.Connect()
+	client.MaxRetries = *maxRetries
+	if *backoffMin > 0 {
+		client.Backoff.Min = *backoffMin
+	}
+	if *backoffMax > 0 {
+		client.Backoff.Max = *backoffMax
+	}
+	if *allowUnix != "" {
+		client.AllowedSockets = strings.Split(*allowUnix, ",")
+	}
+	if *allowDir != "" {
+		client.AllowedDirs = strings.Split(*allowDir, ",")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := client.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		log.Error().Err(err).Msg("client stopped")
+	}
 }
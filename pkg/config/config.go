@@ -3,6 +3,7 @@ package config
 import (
 	"encoding/base64"
 	"encoding/json"
+	"time"
 )
 
 type ClientConfig struct {
@@ -12,12 +13,36 @@ type ClientConfig struct {
 }
 
 type ServerConfig struct {
-	Host     string `json:"host"`      // 服务器地址
-	ListenOn string `json:"listen_on"` // 监听地址 (默认 :5429)
-	Api      string `json:"api"`       // API地址 (默认 :8000)
-	Domain   string `json:"domain"`    // 域名 生成client token时使用
-	User     string `json:"user"`      // api 用户名
-	Password string `json:"password"`  // api 密码
+	Host      string `json:"host"`       // 服务器地址
+	ListenOn  string `json:"listen_on"`  // 监听地址 (默认 :5429)
+	Api       string `json:"api"`        // API地址 (默认 :8000)
+	ListenTls string `json:"listen_tls"` // 公网 HTTPS 监听地址, 为空时不启用 (如 :443)
+	Domain    string `json:"domain"`     // 域名 生成client token时使用
+	User      string `json:"user"`       // 首个管理员的用户名 (默认 admin), 仅在没有用户时使用
+	Password  string `json:"password"`   // 首个管理员的密码, 仅在没有用户时使用
+
+	ListenControl  string   `json:"listen_control"`  // 仅接受内网客户端连接的监听地址, 为空时不启用
+	ListenHttp     string   `json:"listen_http"`     // 仅接受 HTTP 访客的监听地址, 为空时不启用 (如 :80)
+	TrustedProxies []string `json:"trusted_proxies"` // 允许发送 PROXY protocol 头部的地址 (IP 或 CIDR)
+	SessionSecret  string   `json:"session_secret"`  // 签名路由登录 cookie 的密钥, 为空时每次启动随机生成
+	PublicMetrics  bool     `json:"public_metrics"`  // API 端口的 /metrics 不需要认证
+
+	AllowDefaultCredentials bool   `json:"allow_default_credentials"` // 允许 admin 使用默认密码 123456, 仅用于本地测试
+	TraceEndpoint           string `json:"trace_endpoint"`            // OTLP/HTTP 链路追踪导出地址 (如 http://127.0.0.1:4318), 为空时不导出
+
+	AccessLog           string `json:"access_log"`             // 访问日志输出: stdout 或文件路径, 为空时不记录
+	AccessLogFormat     string `json:"access_log_format"`      // 访问日志格式: json (默认) 或 combined
+	AccessLogMaxSize    int    `json:"access_log_max_size"`    // 访问日志文件轮转大小 (MB, 默认 100)
+	AccessLogMaxBackups int    `json:"access_log_max_backups"` // 保留的访问日志轮转文件数 (默认 5)
+
+	ReconnectGrace  time.Duration `json:"reconnect_grace"`  // 隧道断线后保留访客请求的时间 (默认 10s)
+	ReconnectQueue  int           `json:"reconnect_queue"`  // 隧道断线期间每个隧道最多保留的访客请求数 (默认 64)
+	ResponseTimeout time.Duration `json:"response_timeout"` // 等待内网目标服务响应的时间 (默认 60s)
+	MaxStreams      int           `json:"max_streams"`      // 每个隧道同时打开的流数量上限 (默认 1024)
+
+	AcmeEmail     string `json:"acme_email"`     // ACME 账号邮箱
+	AcmeDirectory string `json:"acme_directory"` // ACME 服务目录地址 (默认 Let's Encrypt)
+	AcmeCA        string `json:"acme_ca"`        // 信任 ACME 服务 HTTPS 证书的 CA 文件, 用于 Pebble 等测试服务
 }
 
 func ParseFromEncoded(encoded string) (*ClientConfig, error) {
@@ -18,6 +18,17 @@ const (
 	MessageTypeConnect
 	MessageTypeDisconnect
 	MessageTypeHeartbeat
+	MessageTypeError
+)
+
+// ErrorCode classifies why the client could not serve a request, carried by MessageTypeError
+type ErrorCode string
+
+const (
+	ErrorDialRefused  ErrorCode = "dial_refused"  // 目标服务拒绝连接或不可达
+	ErrorTimeout      ErrorCode = "timeout"       // 连接或等待目标服务响应超时
+	ErrorTls          ErrorCode = "tls_failure"   // 与目标服务 TLS 握手失败
+	ErrorPolicyDenied ErrorCode = "policy_denied" // 客户端策略禁止访问该目标
 )
 
 type Message struct {
@@ -26,6 +37,11 @@ type Message struct {
 	Id       string         `json:"id"`
 	Protocol model.Protocol `json:"protocol"`
 	Target   string         `json:"target"`
+	Code     ErrorCode      `json:"code,omitempty"`    // 错误类型, 仅 MessageTypeError 使用
+	Options  []byte         `json:"options,omitempty"` // 连接目标的选项 (model.TargetOptions JSON)
+	Rtt      int64          `json:"rtt,omitempty"`     // 客户端测得的上次心跳往返时间 (微秒), 仅 MessageTypeHeartbeat 使用
+	Trace    []byte         `json:"trace,omitempty"`   // 访客请求的链路追踪上下文 (W3C traceparent/tracestate JSON), 仅流的第一条消息携带
+	Timeout  int64          `json:"timeout,omitempty"` // 服务端等待响应的时间 (毫秒), 仅 HTTP 流的第一条消息携带
 }
 
 func (m *Message) Marshal() ([]byte, error) {
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// 客户端指标, 由 ClientHandler 输出
+
+var clientRegistry = prometheus.NewRegistry()
+
+var (
+	ClientConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tunnel_client_connected",
+		Help: "1 when the client is connected to the server.",
+	})
+	ClientReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tunnel_client_reconnects_total",
+		Help: "Number of reconnect attempts.",
+	})
+	ClientStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tunnel_client_active_streams",
+		Help: "Number of open streams to targets.",
+	})
+	ClientBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnel_client_bytes_total",
+		Help: "Bytes relayed between the server and targets, direction is in (server to target) or out.",
+	}, []string{"direction"})
+	ClientTargetErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnel_client_target_errors_total",
+		Help: "Failures to reach a target by error code.",
+	}, []string{"code"})
+	ClientHeartbeatRtt = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tunnel_client_heartbeat_rtt_seconds",
+		Help:    "Heartbeat round trip time to the server.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	})
+)
+
+func init() {
+	clientRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ClientConnected,
+		ClientReconnects,
+		ClientStreams,
+		ClientBytes,
+		ClientTargetErrors,
+		ClientHeartbeatRtt,
+	)
+}
+
+// ClientHandler serves the client metrics in the Prometheus text format
+func ClientHandler() http.Handler {
+	return promhttp.HandlerFor(clientRegistry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, handler http.Handler) string {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	body, _ := io.ReadAll(w.Body)
+	return string(body)
+}
+
+func TestHandlers(t *testing.T) {
+	Bytes.WithLabelValues("r1", "in").Add(10)
+	HeartbeatRtt.WithLabelValues("t1").Set(0.02)
+	ClientBytes.WithLabelValues("out").Add(7)
+	ClientTargetErrors.WithLabelValues("dial_refused").Inc()
+
+	server := scrape(t, ServerHandler())
+	for _, want := range []string{
+		`tunnel_server_bytes_total{direction="in",route="r1"} 10`,
+		`tunnel_server_heartbeat_rtt_seconds{tunnel="t1"} 0.02`,
+		"tunnel_server_active_tunnels ",
+		"go_goroutines ",
+	} {
+		if !strings.Contains(server, want) {
+			t.Errorf("server metrics missing %s", want)
+		}
+	}
+	client := scrape(t, ClientHandler())
+	for _, want := range []string{
+		`tunnel_client_bytes_total{direction="out"} 7`,
+		`tunnel_client_target_errors_total{code="dial_refused"} 1`,
+		"tunnel_client_connected ",
+	} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client metrics missing %s", want)
+		}
+	}
+
+	// 服务端和客户端的指标分开输出
+	if strings.Contains(server, "tunnel_client_") || strings.Contains(client, "tunnel_server_") {
+		t.Error("server and client metrics are mixed")
+	}
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// 服务端指标, 由 ServerHandler 输出
+
+var serverRegistry = prometheus.NewRegistry()
+
+var (
+	ActiveTunnels = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tunnel_server_active_tunnels",
+		Help: "Number of connected tunnel clients.",
+	})
+	ActiveStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tunnel_server_active_streams",
+		Help: "Number of open visitor streams.",
+	})
+	Bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnel_server_bytes_total",
+		Help: "Bytes relayed between visitors and targets, direction is in (visitor to target) or out.",
+	}, []string{"route", "direction"})
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tunnel_server_http_request_duration_seconds",
+		Help:    "Time from receiving an HTTP request until its response is complete.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "code"})
+	HandshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnel_server_handshake_failures_total",
+		Help: "Failed handshakes, kind is tls for visitor TLS handshakes or tunnel for client connects.",
+	}, []string{"kind"})
+	HeartbeatRtt = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tunnel_server_heartbeat_rtt_seconds",
+		Help: "Last heartbeat round trip time reported by each tunnel client.",
+	}, []string{"tunnel"})
+)
+
+func init() {
+	serverRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ActiveTunnels,
+		ActiveStreams,
+		Bytes,
+		RequestDuration,
+		HandshakeFailures,
+		HeartbeatRtt,
+	)
+}
+
+// ServerHandler serves the server metrics in the Prometheus text format
+func ServerHandler() http.Handler {
+	return promhttp.HandlerFor(serverRegistry, promhttp.HandlerOpts{})
+}
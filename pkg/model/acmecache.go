@@ -0,0 +1,46 @@
+package model
+
+import "gorm.io/gorm"
+
+// AcmeCache stores ACME account keys and the certificates obtained for route hostnames
+
+type AcmeCache struct {
+	Key       string `json:"key" gorm:"primaryKey"` // autocert 缓存键, 通常为域名
+	Data      []byte `json:"-" gorm:"not null"`     // 证书及私钥 (PEM)
+	UpdatedAt int64  `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+func (c *AcmeCache) TableName() string {
+	return "acme_cache"
+}
+
+type defaultAcmeCacheModel struct {
+	db *gorm.DB
+}
+
+type AcmeCacheModel interface {
+	Get(key string) (*AcmeCache, error)
+	Put(item *AcmeCache) error
+	Delete(key string) error
+}
+
+func NewAcmeCacheModel(db *gorm.DB) *defaultAcmeCacheModel {
+	return &defaultAcmeCacheModel{db: db}
+}
+
+func (m *defaultAcmeCacheModel) Get(key string) (*AcmeCache, error) {
+	var item AcmeCache
+	err := m.db.First(&item, "key = ?", key).Error
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (m *defaultAcmeCacheModel) Put(item *AcmeCache) error {
+	return m.db.Save(item).Error
+}
+
+func (m *defaultAcmeCacheModel) Delete(key string) error {
+	return m.db.Delete(&AcmeCache{}, "key = ?", key).Error
+}
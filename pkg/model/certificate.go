@@ -0,0 +1,66 @@
+package model
+
+import "gorm.io/gorm"
+
+// 手动上传的证书，HTTPS 监听按 SNI 优先使用，未匹配时再通过 ACME 申请
+
+type Certificate struct {
+	ID        string   `json:"id" gorm:"primaryKey"`
+	Cert      string   `json:"cert" gorm:"not null"`             // 证书链 (PEM)
+	Key       string   `json:"key,omitempty" gorm:"not null"`    // 私钥 (PEM), 不通过 API 返回
+	Domains   []string `json:"domains" gorm:"serializer:json"`   // 证书包含的域名, 可包含通配符
+	Hostnames []string `json:"hostnames" gorm:"serializer:json"` // 关联的路由域名, 优先于按证书域名匹配
+	NotBefore int64    `json:"not_before"`                       // 生效时间
+	NotAfter  int64    `json:"not_after"`                        // 过期时间
+	UpdatedAt int64    `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+func (c *Certificate) TableName() string {
+	return "certificates"
+}
+
+type defaultCertificateModel struct {
+	db *gorm.DB
+}
+
+type CertificateModel interface {
+	GetCertificates() ([]Certificate, error)
+	GetCertificateByID(id string) (*Certificate, error)
+	Insert(cert *Certificate) error
+	Update(cert *Certificate) error
+	Delete(cert *Certificate) error
+}
+
+func NewCertificateModel(db *gorm.DB) *defaultCertificateModel {
+	return &defaultCertificateModel{db: db}
+}
+
+func (m *defaultCertificateModel) GetCertificates() ([]Certificate, error) {
+	var certs []Certificate
+	err := m.db.Find(&certs).Error
+	if err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+func (m *defaultCertificateModel) GetCertificateByID(id string) (*Certificate, error) {
+	var cert Certificate
+	err := m.db.First(&cert, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (m *defaultCertificateModel) Insert(cert *Certificate) error {
+	return m.db.Create(cert).Error
+}
+
+func (m *defaultCertificateModel) Update(cert *Certificate) error {
+	return m.db.Save(cert).Error
+}
+
+func (m *defaultCertificateModel) Delete(cert *Certificate) error {
+	return m.db.Delete(cert).Error
+}
@@ -0,0 +1,85 @@
+package model
+
+import "gorm.io/gorm"
+
+// 访客请求无法转发时返回的自定义错误页面
+
+type ErrorPageFormat string
+
+const (
+	FormatHtml ErrorPageFormat = "html"
+	FormatJson ErrorPageFormat = "json"
+)
+
+type ErrorPage struct {
+	ID       string          `json:"id" gorm:"primaryKey"`
+	RouteID  string          `json:"route_id" gorm:"index"`    // 所属路由, 为空时作用于整个服务
+	Status   int             `json:"status" gorm:"not null"`   // HTTP 状态码
+	Format   ErrorPageFormat `json:"format" gorm:"not null"`   // 页面格式 html/json
+	Template string          `json:"template" gorm:"not null"` // 页面模板, html 使用 html/template 自动转义, json 使用 text/template
+}
+
+func (p *ErrorPage) TableName() string {
+	return "error_pages"
+}
+
+type defaultErrorPageModel struct {
+	db *gorm.DB
+}
+
+type ErrorPageModel interface {
+	GetErrorPages() ([]ErrorPage, error)
+	GetErrorPageByID(id string) (*ErrorPage, error)
+	GetErrorPagesByRouteID(routeID string) ([]ErrorPage, error)
+	Insert(page *ErrorPage) error
+	Update(page *ErrorPage) error
+	Delete(page *ErrorPage) error
+	DeleteByRouteID(routeID string) error
+}
+
+func NewErrorPageModel(db *gorm.DB) *defaultErrorPageModel {
+	return &defaultErrorPageModel{db: db}
+}
+
+func (m *defaultErrorPageModel) GetErrorPages() ([]ErrorPage, error) {
+	var pages []ErrorPage
+	err := m.db.Find(&pages).Error
+	if err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+func (m *defaultErrorPageModel) GetErrorPageByID(id string) (*ErrorPage, error) {
+	var page ErrorPage
+	err := m.db.First(&page, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (m *defaultErrorPageModel) GetErrorPagesByRouteID(routeID string) ([]ErrorPage, error) {
+	var pages []ErrorPage
+	err := m.db.Where("route_id = ?", routeID).Find(&pages).Error
+	if err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+func (m *defaultErrorPageModel) Insert(page *ErrorPage) error {
+	return m.db.Create(page).Error
+}
+
+func (m *defaultErrorPageModel) Update(page *ErrorPage) error {
+	return m.db.Save(page).Error
+}
+
+func (m *defaultErrorPageModel) Delete(page *ErrorPage) error {
+	return m.db.Delete(page).Error
+}
+
+func (m *defaultErrorPageModel) DeleteByRouteID(routeID string) error {
+	return m.db.Where("route_id = ?", routeID).Delete(&ErrorPage{}).Error
+}
@@ -1,6 +1,10 @@
 package model
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 // 在服务端创建，用于将公网请求转发到内网服务。并内网使用转发
 
@@ -12,15 +16,87 @@ const (
 	TypeUdp  Protocol = "udp"
 	TypeSsh  Protocol = "ssh"
 	TypeRdp  Protocol = "rdp"
+
+	TypeTlsPassthrough Protocol = "tls-passthrough" // 按 SNI 转发未解密的 TLS 流量
 )
 
+// IsStream reports whether visitor connections of the protocol are forwarded as raw byte streams
+func (p Protocol) IsStream() bool {
+	return p == TypeTlsPassthrough || p == TypeSsh
+}
+
+// TlsOptions configures the TLS connection clientd makes to an https:// target,
+// file paths refer to the host clientd runs on
+type TlsOptions struct {
+	ServerName         string `json:"server_name,omitempty"`          // SNI 及证书校验使用的域名, 默认为目标主机名
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"` // 跳过目标证书校验
+	CaFile             string `json:"ca_file,omitempty"`              // 校验目标证书的 CA 证书文件
+	CertFile           string `json:"cert_file,omitempty"`            // 客户端证书文件
+	KeyFile            string `json:"key_file,omitempty"`             // 客户端证书私钥文件
+}
+
+// FileOptions configures how clientd serves the directory of a file:// target
+type FileOptions struct {
+	Listing   bool     `json:"listing,omitempty"`    // 没有首页文件时列出目录内容
+	Index     []string `json:"index,omitempty"`      // 目录首页文件, 默认 index.html
+	BasicAuth []string `json:"basic_auth,omitempty"` // 访问账号 user:password, 保存时密码转换为 bcrypt 哈希
+}
+
+// TargetOptions are applied by clientd when connecting to the route target
+type TargetOptions struct {
+	Tls   *TlsOptions  `json:"tls,omitempty"`
+	File  *FileOptions `json:"file,omitempty"`
+	Http2 bool         `json:"http2,omitempty"` // 使用 HTTP/2 连接目标 (http:// 目标为 h2c), gRPC 服务需要开启
+}
+
+// AccessPolicy restricts who may use a route, the server enforces it before forwarding anything
+// into the tunnel. Credentials only apply to HTTP routes, address rules apply to all routes
+type AccessPolicy struct {
+	BasicAuth []string `json:"basic_auth,omitempty"` // 访问账号 user:password, 保存时密码转换为 bcrypt 哈希
+	Tokens    []string `json:"tokens,omitempty"`     // Bearer 令牌或 X-Api-Key, 保存时转换为 sha256 哈希
+	Allow     []string `json:"allow,omitempty"`      // 允许访问的 IP 或 CIDR, 为空时不限制
+	Deny      []string `json:"deny,omitempty"`       // 禁止访问的 IP 或 CIDR, 优先于 Allow
+
+	Oidc *OidcPolicy `json:"oidc,omitempty"` // 通过 OpenID Connect 登录后才能访问
+}
+
+// OidcPolicy puts an OpenID Connect login in front of an HTTP route. The server runs the
+// authorization code flow and passes the identity to the target in X-Auth-Request-* headers
+type OidcPolicy struct {
+	Issuer         string   `json:"issuer"`                    // 身份提供方地址, 用于获取 /.well-known/openid-configuration
+	ClientID       string   `json:"client_id"`                 // 客户端 ID
+	ClientSecret   string   `json:"client_secret"`             // 客户端密钥, 查询路由时不返回
+	Scopes         []string `json:"scopes,omitempty"`          // 额外申请的 scope, 默认 openid email profile
+	AllowedEmails  []string `json:"allowed_emails,omitempty"`  // 允许登录的邮箱
+	AllowedDomains []string `json:"allowed_domains,omitempty"` // 允许登录的邮箱域名
+	AllowedGroups  []string `json:"allowed_groups,omitempty"`  // 允许登录的用户组 (groups claim)
+}
+
+// RouteLimits protects a route and its tunnel from visitors sending too much traffic,
+// zero values mean no limit
+type RouteLimits struct {
+	Rate       float64 `json:"rate,omitempty"`         // 路由每秒允许的请求数 (TCP 类路由为新连接数)
+	Burst      int     `json:"burst,omitempty"`        // 路由允许的突发请求数, 默认为 Rate
+	RatePerIP  float64 `json:"rate_per_ip,omitempty"`  // 每个访客 IP 每秒允许的请求数
+	BurstPerIP int     `json:"burst_per_ip,omitempty"` // 每个访客 IP 允许的突发请求数, 默认为 RatePerIP
+	MaxConns   int     `json:"max_conns,omitempty"`    // 同时处理的请求数 (TCP 类路由为连接数)
+}
+
 type Route struct {
-	ID       string   `json:"id" gorm:"primaryKey"`
-	TunnelID string   `json:"tunnel_id" gorm:"not null"` // 路由所属的隧道
-	Hostname string   `json:"hostname" gorm:"not null"`  // 域名
-	Prefix   string   `json:"prefix"`                    // 路由前缀
-	Target   string   `json:"target" gorm:"not null"`    // 目标地址
-	Protocol Protocol `json:"protocol" gorm:"not null"`  // 协议
+	ID       string        `json:"id" gorm:"primaryKey"`
+	TunnelID string        `json:"tunnel_id" gorm:"not null"`      // 路由所属的隧道
+	Hostname string        `json:"hostname" gorm:"not null"`       // 域名
+	Prefix   string        `json:"prefix"`                         // 路由前缀
+	Target   string        `json:"target" gorm:"not null"`         // 目标地址, 如 127.0.0.1:8080、https://10.0.0.2:8443 、unix:///var/run/app.sock 或 file:///srv/www
+	Protocol Protocol      `json:"protocol" gorm:"not null"`       // 协议
+	Options  TargetOptions `json:"options" gorm:"serializer:json"` // 客户端连接目标的选项
+	Access   AccessPolicy  `json:"access" gorm:"serializer:json"`  // 访问控制
+	Limits   RouteLimits   `json:"limits" gorm:"serializer:json"`  // 速率及并发限制
+	Inspect  bool          `json:"inspect"`                        // 记录最近的 HTTP 请求及响应或 TCP 类路由连接的数据, 可通过 API 查看、重放及导出
+
+	Failures    int64  `json:"failures"`      // 转发失败次数
+	LastError   string `json:"last_error"`    // 最近一次转发失败原因
+	LastErrorAt int64  `json:"last_error_at"` // 最近一次转发失败时间
 }
 
 func (r *Route) TableName() string {
@@ -38,6 +114,7 @@ type RouteModel interface {
 	Insert(route *Route) error
 	Update(route *Route) error
 	Delete(route *Route) error
+	RecordFailure(id string, reason string) error
 }
 
 func NewRouteModel(db *gorm.DB) *defaultRouteModel {
@@ -75,10 +152,19 @@ func (m *defaultRouteModel) Insert(route *Route) error {
 	return m.db.Create(route).Error
 }
 
+// Update saves the route settings, the failure counters maintained by the server are kept
 func (m *defaultRouteModel) Update(route *Route) error {
-	return m.db.Save(route).Error
+	return m.db.Omit("failures", "last_error", "last_error_at").Save(route).Error
 }
 
 func (m *defaultRouteModel) Delete(route *Route) error {
 	return m.db.Delete(route).Error
 }
+
+func (m *defaultRouteModel) RecordFailure(id string, reason string) error {
+	return m.db.Model(&Route{}).Where("id = ?", id).Updates(map[string]any{
+		"failures":      gorm.Expr("failures + ?", 1),
+		"last_error":    reason,
+		"last_error_at": time.Now().Unix(),
+	}).Error
+}
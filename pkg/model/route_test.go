@@ -0,0 +1,46 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func openTestDB(t *testing.T, models ...any) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestRouteUpdateKeepsFailures(t *testing.T) {
+	m := NewRouteModel(openTestDB(t, &Route{}))
+	route := &Route{ID: "r1", TunnelID: "t1", Hostname: "a.example.com", Target: "127.0.0.1:80"}
+	if err := m.Insert(route); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RecordFailure("r1", "dial refused"); err != nil {
+		t.Fatal(err)
+	}
+
+	// API 传入的路由不带失败计数
+	update := &Route{ID: "r1", TunnelID: "t1", Hostname: "b.example.com", Target: "127.0.0.1:81"}
+	if err := m.Update(update); err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.GetRouteByID("r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Hostname != "b.example.com" || got.Target != "127.0.0.1:81" {
+		t.Errorf("route not updated: %+v", got)
+	}
+	if got.Failures != 1 || got.LastError != "dial refused" || got.LastErrorAt == 0 {
+		t.Errorf("failures reset: %d %q %d", got.Failures, got.LastError, got.LastErrorAt)
+	}
+}
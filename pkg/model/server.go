@@ -3,12 +3,15 @@ package model
 import "gorm.io/gorm"
 
 type Server struct {
-	Host      string `json:"host" gorm:"primaryKey"` // 主机 IP地址
-	ListenOn  string `json:"listen_on"`              // 监听端口(默认 :5429)
-	Api       string `json:"api"`                    // WEB_UI/API端口(默认 :8000)
-	Domain    string `json:"domain"`                 // 域名 (可选) 如果没有设置则为 Host:ListenOn
-	ApiDomain string `json:"api_domain"`             // WEB_UI/API域名 (可选) 如果没有设置则为 Host:Api
-	Version   string `json:"version"`                // 版本
+	Host          string `json:"host" gorm:"primaryKey"` // 主机 IP地址
+	ListenOn      string `json:"listen_on"`              // 监听端口(默认 :5429)
+	Api           string `json:"api"`                    // WEB_UI/API端口(默认 :8000)
+	ListenTls     string `json:"listen_tls"`             // 公网 HTTPS 端口 (可选)
+	ListenControl string `json:"listen_control"`         // 内网客户端专用端口 (可选)
+	ListenHttp    string `json:"listen_http"`            // 公网 HTTP 专用端口 (可选)
+	Domain        string `json:"domain"`                 // 域名 (可选) 如果没有设置则为 Host:ListenOn
+	ApiDomain     string `json:"api_domain"`             // WEB_UI/API域名 (可选) 如果没有设置则为 Host:Api
+	Version       string `json:"version"`                // 版本
 }
 
 func (s *Server) TableName() string {
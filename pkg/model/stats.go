@@ -0,0 +1,79 @@
+package model
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 按时间段统计的路由流量，每个隧道、路由及时间段一行
+
+type TrafficStat struct {
+	ID          uint   `json:"-" gorm:"primaryKey"`
+	TunnelID    string `json:"tunnel_id" gorm:"not null;uniqueIndex:idx_traffic_stat"`
+	RouteID     string `json:"route_id" gorm:"not null;uniqueIndex:idx_traffic_stat"`
+	Bucket      int64  `json:"time" gorm:"not null;uniqueIndex:idx_traffic_stat"` // 时间段开始时间
+	BytesIn     int64  `json:"bytes_in"`                                          // 访客发往目标的字节数
+	BytesOut    int64  `json:"bytes_out"`                                         // 目标发往访客的字节数
+	Requests    int64  `json:"requests"`                                          // HTTP 请求数
+	Connections int64  `json:"connections"`                                       // TCP 类路由的连接数
+	Errors      int64  `json:"errors"`                                            // 转发失败次数
+}
+
+func (s *TrafficStat) TableName() string {
+	return "traffic_stats"
+}
+
+// Add adds the counters of o to s
+func (s *TrafficStat) Add(o *TrafficStat) {
+	s.BytesIn += o.BytesIn
+	s.BytesOut += o.BytesOut
+	s.Requests += o.Requests
+	s.Connections += o.Connections
+	s.Errors += o.Errors
+}
+
+type defaultTrafficStatModel struct {
+	db *gorm.DB
+}
+
+type TrafficStatModel interface {
+	Add(stats []TrafficStat) error
+	GetStats(tunnelID string, from, to int64) ([]TrafficStat, error)
+	DeleteBefore(bucket int64) error
+}
+
+func NewTrafficStatModel(db *gorm.DB) *defaultTrafficStatModel {
+	return &defaultTrafficStatModel{db: db}
+}
+
+// Add adds the counters to the rows of their time buckets, creating missing rows
+func (m *defaultTrafficStatModel) Add(stats []TrafficStat) error {
+	if len(stats) == 0 {
+		return nil
+	}
+	return m.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "tunnel_id"}, {Name: "route_id"}, {Name: "bucket"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "bytes_in"}, Value: gorm.Expr("bytes_in + excluded.bytes_in")},
+			{Column: clause.Column{Name: "bytes_out"}, Value: gorm.Expr("bytes_out + excluded.bytes_out")},
+			{Column: clause.Column{Name: "requests"}, Value: gorm.Expr("requests + excluded.requests")},
+			{Column: clause.Column{Name: "connections"}, Value: gorm.Expr("connections + excluded.connections")},
+			{Column: clause.Column{Name: "errors"}, Value: gorm.Expr("errors + excluded.errors")},
+		},
+	}).Create(&stats).Error
+}
+
+// GetStats returns the rows of the tunnel with buckets in [from, to)
+func (m *defaultTrafficStatModel) GetStats(tunnelID string, from, to int64) ([]TrafficStat, error) {
+	var stats []TrafficStat
+	err := m.db.Where("tunnel_id = ? AND bucket >= ? AND bucket < ?", tunnelID, from, to).
+		Order("bucket").Find(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (m *defaultTrafficStatModel) DeleteBefore(bucket int64) error {
+	return m.db.Where("bucket < ?", bucket).Delete(&TrafficStat{}).Error
+}
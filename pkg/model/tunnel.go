@@ -1,6 +1,16 @@
 package model
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 流量配额的重置周期
+const (
+	QuotaDaily   = "daily"   // 每天 0 点重置
+	QuotaMonthly = "monthly" // 每月 1 日 0 点重置
+)
 
 type Tunnel struct {
 	ID     string `json:"id" gorm:"primaryKey"`
@@ -8,6 +18,15 @@ type Tunnel struct {
 	Status string `json:"status" gorm:"default:'offline'"`
 	Uptime int64  `json:"uptime"`
 	Token  string `json:"token" gorm:"not null"` // 内网进程用来连接公网服务tunnel的token
+
+	MaxStreams int `json:"max_streams"` // 同时打开的流数量上限, 0 时使用服务端配置
+
+	UploadRate   int64  `json:"upload_rate"`    // 目标发往访客的每秒字节数, 0 表示不限制
+	DownloadRate int64  `json:"download_rate"`  // 访客发往目标的每秒字节数, 0 表示不限制
+	QuotaBytes   int64  `json:"quota_bytes"`    // 每个周期允许的双向流量字节数, 0 表示不限制
+	QuotaPeriod  string `json:"quota_period"`   // 配额重置周期 daily 或 monthly, 为空时不重置
+	QuotaUsed    int64  `json:"quota_used"`     // 当前周期已使用的字节数
+	QuotaResetAt int64  `json:"quota_reset_at"` // 下次重置配额的时间
 }
 
 func (t *Tunnel) TableName() string {
@@ -24,6 +43,8 @@ type TunnelModel interface {
 	Insert(tunnel *Tunnel) error
 	Update(tunnel *Tunnel) error
 	Delete(tunnel *Tunnel) error
+	AddQuotaUsed(id string, n int64) error
+	ResetQuota(id string, used int64, resetAt int64) error
 }
 
 func NewTunnelModel(db *gorm.DB) *defaultTunnelModel {
@@ -52,10 +73,36 @@ func (m *defaultTunnelModel) Insert(tunnel *Tunnel) error {
 	return m.db.Create(tunnel).Error
 }
 
+// Update saves the tunnel settings, the quota usage is only written by AddQuotaUsed and
+// ResetQuota so that a stale copy of the tunnel can not overwrite it
 func (m *defaultTunnelModel) Update(tunnel *Tunnel) error {
-	return m.db.Save(tunnel).Error
+	return m.db.Omit("quota_used", "quota_reset_at").Save(tunnel).Error
 }
 
 func (m *defaultTunnelModel) Delete(tunnel *Tunnel) error {
 	return m.db.Delete(tunnel).Error
 }
+
+func (m *defaultTunnelModel) AddQuotaUsed(id string, n int64) error {
+	return m.db.Model(&Tunnel{}).Where("id = ?", id).
+		Update("quota_used", gorm.Expr("quota_used + ?", n)).Error
+}
+
+func (m *defaultTunnelModel) ResetQuota(id string, used int64, resetAt int64) error {
+	return m.db.Model(&Tunnel{}).Where("id = ?", id).Updates(map[string]any{
+		"quota_used":     used,
+		"quota_reset_at": resetAt,
+	}).Error
+}
+
+// NextQuotaReset returns the start of the quota period following now, in the local time zone
+func NextQuotaReset(period string, now time.Time) int64 {
+	year, month, day := now.Date()
+	switch period {
+	case QuotaDaily:
+		return time.Date(year, month, day+1, 0, 0, 0, 0, now.Location()).Unix()
+	case QuotaMonthly:
+		return time.Date(year, month+1, 1, 0, 0, 0, 0, now.Location()).Unix()
+	}
+	return 0
+}
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTunnelUpdateKeepsQuotaUsage(t *testing.T) {
+	m := NewTunnelModel(openTestDB(t, &Tunnel{}))
+	if err := m.Insert(&Tunnel{ID: "t1", Name: "t1", Token: "token", QuotaBytes: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := m.GetTunnelByID("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ResetQuota("t1", 100, 12345); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddQuotaUsed("t1", 50); err != nil {
+		t.Fatal(err)
+	}
+
+	// 连接上线时用读取的旧记录更新状态
+	stale.Status = "online"
+	if err := m.Update(stale); err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.GetTunnelByID("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "online" {
+		t.Errorf("status = %q, want online", got.Status)
+	}
+	if got.QuotaUsed != 150 || got.QuotaResetAt != 12345 {
+		t.Errorf("quota usage overwritten: used %d reset at %d", got.QuotaUsed, got.QuotaResetAt)
+	}
+}
+
+func TestNextQuotaReset(t *testing.T) {
+	now := time.Date(2024, 1, 31, 15, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		period string
+		want   time.Time
+	}{
+		{QuotaDaily, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{QuotaMonthly, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"", time.Unix(0, 0)},
+	} {
+		if got := NextQuotaReset(tc.period, now); got != tc.want.Unix() {
+			t.Errorf("NextQuotaReset(%q) = %v, want %v", tc.period, time.Unix(got, 0).UTC(), tc.want)
+		}
+	}
+	dec := time.Date(2024, 12, 15, 0, 0, 0, 0, time.UTC)
+	if got := NextQuotaReset(QuotaMonthly, dec); got != time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Unix() {
+		t.Errorf("monthly reset after december = %v", time.Unix(got, 0).UTC())
+	}
+}
@@ -0,0 +1,88 @@
+package model
+
+import "gorm.io/gorm"
+
+// 管理 API 的账号, 通过 basic auth 认证
+
+type User struct {
+	ID        string `json:"id" gorm:"primaryKey"`
+	Username  string `json:"username" gorm:"unique;not null"`
+	Password  string `json:"password,omitempty" gorm:"not null"` // bcrypt 哈希, 不通过 API 返回
+	Admin     bool   `json:"admin"`                              // 可以管理其他账号
+	CreatedAt int64  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt int64  `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+func (u *User) TableName() string {
+	return "users"
+}
+
+type defaultUserModel struct {
+	db *gorm.DB
+}
+
+type UserModel interface {
+	GetUsers() ([]User, error)
+	GetUserByID(id string) (*User, error)
+	GetUserByUsername(username string) (*User, error)
+	Count() (int64, error)
+	CountAdmins() (int64, error)
+	Insert(user *User) error
+	Update(user *User) error
+	Delete(user *User) error
+}
+
+func NewUserModel(db *gorm.DB) *defaultUserModel {
+	return &defaultUserModel{db: db}
+}
+
+func (m *defaultUserModel) GetUsers() ([]User, error) {
+	var users []User
+	err := m.db.Order("created_at, username").Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (m *defaultUserModel) GetUserByID(id string) (*User, error) {
+	var user User
+	err := m.db.First(&user, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (m *defaultUserModel) GetUserByUsername(username string) (*User, error) {
+	var user User
+	err := m.db.First(&user, "username = ?", username).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (m *defaultUserModel) Count() (int64, error) {
+	var count int64
+	err := m.db.Model(&User{}).Count(&count).Error
+	return count, err
+}
+
+func (m *defaultUserModel) CountAdmins() (int64, error) {
+	var count int64
+	err := m.db.Model(&User{}).Where("admin = ?", true).Count(&count).Error
+	return count, err
+}
+
+func (m *defaultUserModel) Insert(user *User) error {
+	return m.db.Create(user).Error
+}
+
+func (m *defaultUserModel) Update(user *User) error {
+	return m.db.Save(user).Error
+}
+
+func (m *defaultUserModel) Delete(user *User) error {
+	return m.db.Delete(user).Error
+}
@@ -0,0 +1,147 @@
+package model
+
+import "gorm.io/gorm"
+
+// 订阅服务端事件的 Webhook, 事件以签名的 JSON 请求发送到 Url
+
+type Webhook struct {
+	ID        string   `json:"id" gorm:"primaryKey"`
+	Name      string   `json:"name"`
+	Url       string   `json:"url" gorm:"not null"`              // 接收事件的 http(s) 地址
+	Secret    string   `json:"secret,omitempty" gorm:"not null"` // HMAC-SHA256 签名密钥, 只在创建时通过 API 返回
+	Events    []string `json:"events" gorm:"serializer:json"`    // 订阅的事件类型前缀, 如 tunnel.offline 或 route, 为空时订阅全部事件
+	Disabled  bool     `json:"disabled"`                         // 停用后不再发送事件
+	UpdatedAt int64    `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+func (w *Webhook) TableName() string {
+	return "webhooks"
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	DeliveryPending WebhookDeliveryStatus = "pending" // 等待发送或重试
+	DeliverySuccess WebhookDeliveryStatus = "success"
+	DeliveryFailed  WebhookDeliveryStatus = "failed" // 重试次数用完
+)
+
+// WebhookDelivery is a sent event and the result of its last attempt
+type WebhookDelivery struct {
+	ID         string                `json:"id" gorm:"primaryKey"`
+	WebhookID  string                `json:"webhook_id" gorm:"not null;index"`
+	EventType  string                `json:"event_type" gorm:"not null"`
+	Payload    string                `json:"payload"` // 请求体
+	Status     WebhookDeliveryStatus `json:"status"`
+	Attempts   int                   `json:"attempts"`          // 已发送的次数
+	StatusCode int                   `json:"status_code"`       // 最后一次发送的响应状态码
+	Error      string                `json:"error,omitempty"`   // 最后一次发送失败的原因
+	Duration   float64               `json:"duration"`          // 最后一次发送的耗时 (毫秒)
+	NextAt     int64                 `json:"next_at,omitempty"` // 下次重试的时间
+	CreatedAt  int64                 `json:"created_at" gorm:"autoCreateTime;index"`
+	UpdatedAt  int64                 `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+func (d *WebhookDelivery) TableName() string {
+	return "webhook_deliveries"
+}
+
+type defaultWebhookModel struct {
+	db *gorm.DB
+}
+
+type WebhookModel interface {
+	GetWebhooks() ([]Webhook, error)
+	GetWebhookByID(id string) (*Webhook, error)
+	Insert(webhook *Webhook) error
+	Update(webhook *Webhook) error
+	Delete(webhook *Webhook) error
+
+	GetDeliveries(webhookID string, limit int) ([]WebhookDelivery, error)
+	GetDeliveryByID(webhookID, id string) (*WebhookDelivery, error)
+	GetPendingDeliveries() ([]WebhookDelivery, error)
+	InsertDelivery(delivery *WebhookDelivery) error
+	UpdateDelivery(delivery *WebhookDelivery) error
+	DeleteDeliveriesBefore(createdAt int64) error
+}
+
+func NewWebhookModel(db *gorm.DB) *defaultWebhookModel {
+	return &defaultWebhookModel{db: db}
+}
+
+func (m *defaultWebhookModel) GetWebhooks() ([]Webhook, error) {
+	var webhooks []Webhook
+	err := m.db.Find(&webhooks).Error
+	if err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (m *defaultWebhookModel) GetWebhookByID(id string) (*Webhook, error) {
+	var webhook Webhook
+	err := m.db.First(&webhook, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func (m *defaultWebhookModel) Insert(webhook *Webhook) error {
+	return m.db.Create(webhook).Error
+}
+
+func (m *defaultWebhookModel) Update(webhook *Webhook) error {
+	return m.db.Save(webhook).Error
+}
+
+// Delete removes the webhook and its delivery log
+func (m *defaultWebhookModel) Delete(webhook *Webhook) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", webhook.ID).Delete(&WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(webhook).Error
+	})
+}
+
+// GetDeliveries returns the latest deliveries of the webhook, newest first
+func (m *defaultWebhookModel) GetDeliveries(webhookID string, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := m.db.Where("webhook_id = ?", webhookID).Order("created_at desc, rowid desc").Limit(limit).Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (m *defaultWebhookModel) GetDeliveryByID(webhookID, id string) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	err := m.db.First(&delivery, "webhook_id = ? AND id = ?", webhookID, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// GetPendingDeliveries returns the deliveries that still have attempts left
+func (m *defaultWebhookModel) GetPendingDeliveries() ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := m.db.Where("status = ?", DeliveryPending).Order("created_at, rowid").Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (m *defaultWebhookModel) InsertDelivery(delivery *WebhookDelivery) error {
+	return m.db.Create(delivery).Error
+}
+
+func (m *defaultWebhookModel) UpdateDelivery(delivery *WebhookDelivery) error {
+	return m.db.Save(delivery).Error
+}
+
+func (m *defaultWebhookModel) DeleteDeliveriesBefore(createdAt int64) error {
+	return m.db.Where("created_at < ? AND status <> ?", createdAt, DeliveryPending).Delete(&WebhookDelivery{}).Error
+}
@@ -0,0 +1,207 @@
+package svc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	AccessLogJson     = "json"     // 每行一个 JSON 对象
+	AccessLogCombined = "combined" // Apache/Nginx Combined Log Format
+
+	defaultAccessLogMaxSize    = 100 // 访问日志文件轮转大小 (MB)
+	defaultAccessLogMaxBackups = 5   // 保留的轮转文件数
+)
+
+// AccessEntry is one line of the access log, describing an HTTP request or a connection
+// to a TCP-like route
+type AccessEntry struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`                 // http 或路由协议 (tcp, ssh 等)
+	Host      string    `json:"host"`                 // 访客请求的主机名
+	RouteID   string    `json:"route_id,omitempty"`   // 匹配的路由, 未匹配时为空
+	TunnelID  string    `json:"tunnel_id,omitempty"`  // 路由所属隧道
+	ClientIP  string    `json:"client_ip"`            // 访客 IP
+	User      string    `json:"user,omitempty"`       // Basic Auth 用户名或 OIDC 登录用户
+	Method    string    `json:"method,omitempty"`     // 仅 HTTP
+	Path      string    `json:"path,omitempty"`       // 请求 URI, 仅 HTTP
+	Proto     string    `json:"proto,omitempty"`      // HTTP 版本, 仅 HTTP
+	Status    int       `json:"status,omitempty"`     // 响应状态码, 仅 HTTP
+	Error     string    `json:"error,omitempty"`      // 连接未能转发的原因, 仅 TCP 类路由
+	BytesIn   int64     `json:"bytes_in"`             // 访客发送的字节数 (HTTP 为请求体)
+	BytesOut  int64     `json:"bytes_out"`            // 发给访客的字节数 (HTTP 为响应体)
+	Duration  float64   `json:"duration_ms"`          // 处理时长 (毫秒)
+	Referer   string    `json:"referer,omitempty"`    // 仅 HTTP
+	UserAgent string    `json:"user_agent,omitempty"` // 仅 HTTP
+}
+
+// AccessLog writes one line per visitor request or connection, it discards the entries when
+// no output is configured
+type AccessLog struct {
+	format string
+	out    io.Writer
+	mutex  sync.Mutex
+}
+
+// NewAccessLog writes the access log in format to output, which is stdout, a file path or
+// empty to disable the log. Files are rotated once they reach maxSize MB, keeping maxBackups
+// old files
+func NewAccessLog(output, format string, maxSize, maxBackups int) (*AccessLog, error) {
+	l := &AccessLog{format: format}
+	if l.format == "" {
+		l.format = AccessLogJson
+	}
+	if l.format != AccessLogJson && l.format != AccessLogCombined {
+		return nil, fmt.Errorf("unsupported access log format: %s", format)
+	}
+	switch output {
+	case "":
+	case "stdout":
+		l.out = os.Stdout
+	default:
+		if maxSize <= 0 {
+			maxSize = defaultAccessLogMaxSize
+		}
+		if maxBackups <= 0 {
+			maxBackups = defaultAccessLogMaxBackups
+		}
+		file, err := openRotatingFile(output, int64(maxSize)<<20, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.out = file
+	}
+	return l, nil
+}
+
+// Enabled reports whether entries are written
+func (l *AccessLog) Enabled() bool {
+	return l.out != nil
+}
+
+// Log writes the entry
+func (l *AccessLog) Log(entry *AccessEntry) {
+	if l.out == nil {
+		return
+	}
+	var line []byte
+	if l.format == AccessLogCombined {
+		line = []byte(entry.combined())
+	} else {
+		line, _ = json.Marshal(entry)
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.out.Write(line); err != nil {
+		log.Error().Err(err).Msg("Failed to write access log")
+	}
+}
+
+// combined formats the entry in the Combined Log Format, connections to TCP-like routes use
+// the protocol and host as the request line and - as the status
+func (e *AccessEntry) combined() string {
+	request := fmt.Sprintf("%s %s %s", e.Method, e.Path, e.Proto)
+	status := "-"
+	if e.Type == "http" {
+		status = fmt.Sprint(e.Status)
+	} else {
+		request = fmt.Sprintf("%s %s", strings.ToUpper(e.Type), e.Host)
+		if e.Error != "" {
+			request += " " + e.Error
+		}
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %s %d %q %q",
+		e.ClientIP, clfUser(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		request, status, e.BytesOut, clfField(e.Referer), clfField(e.UserAgent))
+}
+
+func clfField(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// clfUser escapes the unquoted user field, visitor supplied names with spaces, quotes or
+// control characters would otherwise break the line apart
+func clfUser(user string) string {
+	if user == "" {
+		return "-"
+	}
+	quoted := strconv.Quote(user)
+	return strings.ReplaceAll(quoted[1:len(quoted)-1], " ", `\x20`)
+}
+
+// rotatingFile appends to path and renames it to path.1 once it exceeds maxSize bytes,
+// shifting older files up to path.<maxBackups>
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write is called with the access log mutex held
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		f.rotate()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file to the first backup and opens a new one. The old handle is only
+// closed once the new file is open, when rotation fails it keeps writing to the old handle and
+// waits for another maxSize before retrying
+func (f *rotatingFile) rotate() {
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		log.Error().Err(err).Msg("Failed to rotate access log")
+		f.size = 0
+		return
+	}
+	old := f.file
+	if err := f.open(); err != nil {
+		log.Error().Err(err).Msg("Failed to reopen access log")
+		f.size = 0
+		return
+	}
+	old.Close()
+}
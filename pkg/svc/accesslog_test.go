@@ -0,0 +1,97 @@
+package svc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessEntryCombined(t *testing.T) {
+	at := time.Date(2024, 3, 5, 14, 2, 3, 0, time.FixedZone("", 8*3600))
+	for _, tc := range []struct {
+		entry AccessEntry
+		want  string
+	}{
+		{
+			AccessEntry{Time: at, Type: "http", ClientIP: "10.0.0.1", Method: "GET", Path: "/a", Proto: "HTTP/1.1", Status: 200, BytesOut: 12},
+			`10.0.0.1 - - [05/Mar/2024:14:02:03 +0800] "GET /a HTTP/1.1" 200 12 "-" "-"`,
+		},
+		{
+			AccessEntry{Time: at, Type: "http", ClientIP: "10.0.0.1", User: "alice", Method: "POST", Path: `/"x"`, Proto: "HTTP/2.0", Status: 401, Referer: "https://r/", UserAgent: "curl/8"},
+			`10.0.0.1 - alice [05/Mar/2024:14:02:03 +0800] "POST /\"x\" HTTP/2.0" 401 0 "https://r/" "curl/8"`,
+		},
+		{
+			// 访客提供的用户名不能拆开或伪造日志行
+			AccessEntry{Time: at, Type: "http", ClientIP: "10.0.0.1", User: "bob \"x\"\n10.0.0.2", Method: "GET", Path: "/", Proto: "HTTP/1.1", Status: 200},
+			`10.0.0.1 - bob\x20\"x\"\n10.0.0.2 [05/Mar/2024:14:02:03 +0800] "GET / HTTP/1.1" 200 0 "-" "-"`,
+		},
+		{
+			AccessEntry{Time: at, Type: "ssh", ClientIP: "10.0.0.1", Host: "git.example.com", Error: "conn_limited", BytesOut: 5},
+			`10.0.0.1 - - [05/Mar/2024:14:02:03 +0800] "SSH git.example.com conn_limited" - 5 "-" "-"`,
+		},
+	} {
+		if got := tc.entry.combined(); got != tc.want {
+			t.Errorf("combined() =\n%s\nwant\n%s", got, tc.want)
+		}
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &AccessLog{format: AccessLogCombined, out: f}
+	for i := 0; i < 5; i++ {
+		l.Log(&AccessEntry{Time: time.Now(), Type: "http", ClientIP: fmt.Sprintf("10.0.0.%d", i), Method: "GET", Path: "/", Proto: "HTTP/1.1", Status: 200})
+	}
+	f.file.Close()
+
+	// 每个文件只放得下一行, 只保留两个轮转文件
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(data), "\n"); lines != 1 {
+			t.Errorf("%s has %d lines, want 1", name, lines)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists, want at most 2 backups", path)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.HasPrefix(string(data), "10.0.0.4 ") {
+		t.Errorf("current file starts with %q, want the latest entry", data)
+	}
+}
+
+func TestAccessLogRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// 备份位置被非空目录占用, 轮转无法完成
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openRotatingFile(path, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &AccessLog{format: AccessLogCombined, out: f}
+	for i := 0; i < 3; i++ {
+		l.Log(&AccessEntry{Time: time.Now(), Type: "http", ClientIP: fmt.Sprintf("10.0.0.%d", i), Method: "GET", Path: "/", Proto: "HTTP/1.1", Status: 200})
+	}
+	f.file.Close()
+
+	// 轮转失败后继续写入原文件
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("%s has %d lines, want 3", path, lines)
+	}
+}
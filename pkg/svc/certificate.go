@@ -0,0 +1,140 @@
+package svc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+const CertificateExpiryWarning = 30 * 24 * time.Hour // 证书到期前多久开始提示
+
+// LoadedCertificate is a manual certificate parsed for the HTTPS listener
+type LoadedCertificate struct {
+	model.Certificate
+	Tls *tls.Certificate
+}
+
+// CertificateWarning reports a manual certificate that expires soon or has expired
+type CertificateWarning struct {
+	ID       string   `json:"id"`
+	Domains  []string `json:"domains"`
+	NotAfter int64    `json:"not_after"`
+	Expired  bool     `json:"expired"`
+}
+
+// ParseCertificate checks the certificate and key match, fills in the domains and validity
+// from the leaf certificate and verifies the associated hostnames are covered by it
+func ParseCertificate(cert *model.Certificate) (*tls.Certificate, error) {
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.Key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate or key: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	pair.Leaf = leaf
+
+	cert.Domains = leaf.DNSNames
+	if len(cert.Domains) == 0 && leaf.Subject.CommonName != "" {
+		cert.Domains = []string{leaf.Subject.CommonName}
+	}
+	cert.NotBefore = leaf.NotBefore.Unix()
+	cert.NotAfter = leaf.NotAfter.Unix()
+	for _, hostname := range cert.Hostnames {
+		if err := leaf.VerifyHostname(hostname); err != nil {
+			return nil, fmt.Errorf("certificate does not cover %s", hostname)
+		}
+	}
+	return &pair, nil
+}
+
+// UpdateCertificates reloads the manual certificates from the database. Certificates that no
+// longer parse are logged and skipped so that one bad row does not disable the others
+func (ctx *ServerCtx) UpdateCertificates() error {
+	certs, err := ctx.CertificateModel.GetCertificates()
+	if err != nil {
+		return err
+	}
+	loaded := make([]LoadedCertificate, 0, len(certs))
+	for _, cert := range certs {
+		pair, err := ParseCertificate(&cert)
+		if err != nil {
+			log.Error().Err(err).Msgf("Skipping certificate %s", cert.ID)
+			continue
+		}
+		loaded = append(loaded, LoadedCertificate{Certificate: cert, Tls: pair})
+	}
+	ctx.certificates.Store(&loaded)
+	return nil
+}
+
+// loadedCertificates returns the current manual certificates, the slice must not be modified
+func (ctx *ServerCtx) loadedCertificates() []LoadedCertificate {
+	if certs := ctx.certificates.Load(); certs != nil {
+		return *certs
+	}
+	return nil
+}
+
+// MatchCertificate selects the manual certificate for the SNI name. Certificates associated
+// with the hostname win over exact domain matches, which win over wildcard matches;
+// among equal matches the one expiring last is used
+func (ctx *ServerCtx) MatchCertificate(name string) *tls.Certificate {
+	var best *LoadedCertificate
+	bestRank := 0
+	certs := ctx.loadedCertificates()
+	for i := range certs {
+		cert := &certs[i]
+		rank := 0
+		for _, hostname := range cert.Hostnames {
+			if hostname == name {
+				rank = 3
+			}
+		}
+		if rank == 0 {
+			for _, domain := range cert.Domains {
+				if domain == name {
+					rank = 2
+				}
+			}
+		}
+		if rank == 0 && cert.Tls.Leaf.VerifyHostname(name) == nil {
+			rank = 1
+		}
+		if rank == 0 {
+			continue
+		}
+		if rank > bestRank || (rank == bestRank && cert.NotAfter > best.NotAfter) {
+			best, bestRank = cert, rank
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.Tls
+}
+
+// CertificateWarnings lists manual certificates expiring within CertificateExpiryWarning
+func (ctx *ServerCtx) CertificateWarnings() []CertificateWarning {
+	warnings := []CertificateWarning{}
+	now := time.Now()
+	for _, cert := range ctx.loadedCertificates() {
+		notAfter := time.Unix(cert.NotAfter, 0)
+		if notAfter.Sub(now) > CertificateExpiryWarning {
+			continue
+		}
+		warnings = append(warnings, CertificateWarning{
+			ID:       cert.ID,
+			Domains:  cert.Domains,
+			NotAfter: cert.NotAfter,
+			Expired:  now.After(notAfter),
+		})
+	}
+	return warnings
+}
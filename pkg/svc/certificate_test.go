@@ -0,0 +1,143 @@
+package svc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+func openTestDB(t *testing.T, models ...any) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testCertificate returns a self-signed certificate for the domains expiring after validFor
+func testCertificate(t *testing.T, id string, validFor time.Duration, domains ...string) model.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return model.Certificate{
+		ID:   id,
+		Cert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})),
+	}
+}
+
+func TestUpdateCertificates(t *testing.T) {
+	certModel := model.NewCertificateModel(openTestDB(t, &model.Certificate{}))
+	ctx := &ServerCtx{CertificateModel: certModel}
+
+	wildcard := testCertificate(t, "wildcard", 90*24*time.Hour, "*.example.com")
+	exact := testCertificate(t, "exact", 10*24*time.Hour, "app.example.com")
+	pinned := testCertificate(t, "pinned", 60*24*time.Hour, "*.example.com")
+	pinned.Hostnames = []string{"api.example.com"}
+	broken := model.Certificate{ID: "broken", Cert: "not a certificate", Key: "not a key"}
+	for _, cert := range []model.Certificate{wildcard, exact, pinned, broken} {
+		if err := certModel.Insert(&cert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 无法解析的证书被跳过, 不影响其他证书
+	if err := ctx.UpdateCertificates(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(ctx.loadedCertificates()); n != 3 {
+		t.Fatalf("loaded %d certificates, want 3", n)
+	}
+
+	// 关联域名优先于证书域名, 精确匹配优先于通配符, 同等匹配时使用过期最晚的证书
+	for name, want := range map[string]string{
+		"app.example.com": "exact",
+		"api.example.com": "pinned",
+		"www.example.com": "wildcard",
+		"example.org":     "",
+	} {
+		got := ""
+		if match := ctx.MatchCertificate(name); match != nil {
+			for _, cert := range ctx.loadedCertificates() {
+				if cert.Tls == match {
+					got = cert.ID
+				}
+			}
+		}
+		if got != want {
+			t.Errorf("%s matched %q, want %q", name, got, want)
+		}
+	}
+
+	warnings := ctx.CertificateWarnings()
+	if len(warnings) != 1 || warnings[0].ID != "exact" || warnings[0].Expired {
+		t.Errorf("warnings = %+v, want exact expiring soon", warnings)
+	}
+}
+
+func TestMatchCertificateDuringUpdate(t *testing.T) {
+	certModel := model.NewCertificateModel(openTestDB(t, &model.Certificate{}))
+	ctx := &ServerCtx{CertificateModel: certModel}
+	cert := testCertificate(t, "c1", 90*24*time.Hour, "app.example.com")
+	if err := certModel.Insert(&cert); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.MatchCertificate("app.example.com") != nil {
+		t.Fatal("matched a certificate before loading")
+	}
+	if err := ctx.UpdateCertificates(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 用 -race 运行时检查握手与更新之间没有数据竞争
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if ctx.MatchCertificate("app.example.com") == nil {
+					t.Error("certificate missing during update")
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := ctx.UpdateCertificates(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,67 @@
+package svc
+
+import (
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"text/template"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+var errorPageFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// ErrorTemplate is an error page template of either format
+type ErrorTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+// LoadedErrorPage is a custom error page with its template parsed for rendering
+type LoadedErrorPage struct {
+	model.ErrorPage
+	Tmpl ErrorTemplate
+}
+
+// ParseErrorTemplate parses html pages with html/template so that visitor supplied values
+// such as Host and Path are escaped, json pages encode values with the json function
+func ParseErrorTemplate(format model.ErrorPageFormat, text string) (ErrorTemplate, error) {
+	if format == model.FormatHtml {
+		return htmltemplate.New("").Funcs(htmltemplate.FuncMap(errorPageFuncs)).Parse(text)
+	}
+	return template.New("").Funcs(errorPageFuncs).Parse(text)
+}
+
+// UpdateErrorPages reloads the custom error pages from the database and parses their templates
+// once, pages that no longer parse are logged and skipped so the default page is used instead
+func (ctx *ServerCtx) UpdateErrorPages() error {
+	pages, err := ctx.ErrorPageModel.GetErrorPages()
+	if err != nil {
+		return err
+	}
+	loaded := make([]LoadedErrorPage, 0, len(pages))
+	for _, page := range pages {
+		tmpl, err := ParseErrorTemplate(page.Format, page.Template)
+		if err != nil {
+			log.Error().Err(err).Msgf("Skipping error page %s", page.ID)
+			continue
+		}
+		loaded = append(loaded, LoadedErrorPage{ErrorPage: page, Tmpl: tmpl})
+	}
+	ctx.errorPages.Store(&loaded)
+	return nil
+}
+
+// ErrorPages returns the current custom error pages, the slice must not be modified
+func (ctx *ServerCtx) ErrorPages() []LoadedErrorPage {
+	if pages := ctx.errorPages.Load(); pages != nil {
+		return *pages
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package svc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+func TestUpdateErrorPages(t *testing.T) {
+	ctx := &ServerCtx{ErrorPageModel: model.NewErrorPageModel(openTestDB(t, &model.ErrorPage{}))}
+	if pages := ctx.ErrorPages(); pages != nil {
+		t.Fatalf("pages before load = %v", pages)
+	}
+	for _, page := range []model.ErrorPage{
+		{ID: "good", Status: 404, Format: model.FormatHtml, Template: "<p>{{.Host}}</p>"},
+		{ID: "bad", Status: 502, Format: model.FormatHtml, Template: "{{"},
+	} {
+		if err := ctx.ErrorPageModel.Insert(&page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ctx.UpdateErrorPages(); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := ctx.ErrorPages()
+	if len(pages) != 1 || pages[0].ID != "good" {
+		t.Fatalf("pages = %+v", pages)
+	}
+	var body bytes.Buffer
+	if err := pages[0].Tmpl.Execute(&body, map[string]string{"Host": "<b>"}); err != nil {
+		t.Fatal(err)
+	}
+	if body.String() != "<p>&lt;b&gt;</p>" {
+		t.Errorf("body = %q", body.String())
+	}
+}
@@ -0,0 +1,110 @@
+package svc
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// 服务端事件, 由 API 的 /api/events 以 Server-Sent Events 推送给控制台
+
+const (
+	EventTunnelCreated     = "tunnel.created"
+	EventTunnelUpdated     = "tunnel.updated"
+	EventTunnelDeleted     = "tunnel.deleted"
+	EventTunnelOnline      = "tunnel.online"  // 隧道客户端连接上线
+	EventTunnelOffline     = "tunnel.offline" // 客户端断开且重连宽限期已过
+	EventSessionConnect    = "session.connect"
+	EventSessionDisconnect = "session.disconnect" // 客户端连接断开, 隧道在宽限期内等待重连
+	EventRouteCreated      = "route.created"
+	EventRouteUpdated      = "route.updated"
+	EventRouteDeleted      = "route.deleted"
+	EventTokenRefreshed    = "token.refreshed"
+	EventQuotaExceeded     = "quota.exceeded" // 隧道用完了流量配额
+
+	eventBacklog     = 256 // 保留的最近事件数, 用于断线重连后补发
+	eventSubscribers = 64  // 每个订阅者缓冲的事件数, 处理不及时的订阅者会被断开
+)
+
+// Event is a change of the server state
+type Event struct {
+	ID       int64     `json:"id"` // 递增的事件序号
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	TunnelID string    `json:"tunnel_id,omitempty"`
+	RouteID  string    `json:"route_id,omitempty"`
+	Data     any       `json:"data,omitempty"`
+}
+
+// EventBus delivers the events published by the server subsystems to the subscribers
+type EventBus struct {
+	nextID      int64
+	backlog     []Event
+	subscribers map[chan Event]struct{}
+	mutex       sync.Mutex
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: map[chan Event]struct{}{}}
+}
+
+// Publish assigns the event an ID and time and sends it to all subscribers without blocking
+func (b *EventBus) Publish(event Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.nextID++
+	event.ID = b.nextID
+	event.Time = time.Now()
+	b.backlog = append(b.backlog, event)
+	if len(b.backlog) > eventBacklog {
+		b.backlog = b.backlog[len(b.backlog)-eventBacklog:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// 订阅者可以带上最后收到的事件 ID 重新订阅
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events published after the event with ID after,
+// 0 only receives new events. The channel is closed when the subscriber falls behind or
+// cancel is called
+func (b *EventBus) Subscribe(after int64) (<-chan Event, func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ch := make(chan Event, eventSubscribers+eventBacklog)
+	if after > 0 {
+		for _, event := range b.backlog {
+			if event.ID > after {
+				ch <- event
+			}
+		}
+	}
+	b.subscribers[ch] = struct{}{}
+	return ch, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// MatchEventType reports whether the event type equals or is under one of the prefixes,
+// an empty list matches all types
+func MatchEventType(eventType string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if eventType == prefix || strings.HasPrefix(eventType, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package svc
+
+import "testing"
+
+func TestEventBusSubscribe(t *testing.T) {
+	bus := NewEventBus()
+	bus.Publish(Event{Type: EventTunnelCreated, TunnelID: "t1"})
+	bus.Publish(Event{Type: EventTunnelOnline, TunnelID: "t1"})
+
+	// 从 0 订阅只接收新事件
+	events, cancel := bus.Subscribe(0)
+	bus.Publish(Event{Type: EventRouteCreated, RouteID: "r1"})
+	if event := <-events; event.ID != 3 || event.Type != EventRouteCreated || event.Time.IsZero() {
+		t.Fatalf("event = %+v", event)
+	}
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("channel open after cancel")
+	}
+	cancel()
+
+	// 带上最后收到的事件 ID 时先补发之后的事件
+	events, cancel = bus.Subscribe(1)
+	defer cancel()
+	for _, want := range []int64{2, 3} {
+		if event := <-events; event.ID != want {
+			t.Fatalf("replayed event %d, want %d", event.ID, want)
+		}
+	}
+}
+
+func TestEventBusBacklog(t *testing.T) {
+	bus := NewEventBus()
+	for i := 0; i < eventBacklog+10; i++ {
+		bus.Publish(Event{Type: EventTunnelUpdated})
+	}
+	// 超出保留数量的事件无法补发, 订阅者通过序号的间隔发现
+	events, cancel := bus.Subscribe(1)
+	defer cancel()
+	if event := <-events; event.ID != 11 {
+		t.Fatalf("first replayed event %d, want 11", event.ID)
+	}
+	if n := len(events); n != eventBacklog-1 {
+		t.Fatalf("%d events replayed after the first, want %d", n, eventBacklog-1)
+	}
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	bus := NewEventBus()
+	slow, cancel := bus.Subscribe(0)
+	defer cancel()
+	fast, cancelFast := bus.Subscribe(0)
+	defer cancelFast()
+
+	// 缓冲满后不阻塞发布, 而是断开处理不及时的订阅者
+	for i := 0; i < eventSubscribers+eventBacklog; i++ {
+		bus.Publish(Event{Type: EventTunnelUpdated})
+	}
+	for i := 0; i < eventSubscribers+eventBacklog; i++ {
+		<-fast
+	}
+	bus.Publish(Event{Type: EventTunnelUpdated})
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != eventSubscribers+eventBacklog {
+		t.Fatalf("slow subscriber received %d events before closing, want %d", n, eventSubscribers+eventBacklog)
+	}
+	if event, ok := <-fast; !ok || event.ID != eventSubscribers+eventBacklog+1 {
+		t.Fatalf("subscriber keeping up received %+v, %v", event, ok)
+	}
+}
+
+func TestMatchEventType(t *testing.T) {
+	for _, tc := range []struct {
+		eventType string
+		prefixes  []string
+		want      bool
+	}{
+		{EventTunnelOffline, nil, true},
+		{EventTunnelOffline, []string{"tunnel"}, true},
+		{EventTunnelOffline, []string{"tunnel.offline"}, true},
+		{EventTunnelOffline, []string{"tunnel.on"}, false},
+		{EventTunnelOffline, []string{"tun"}, false},
+		{EventRouteCreated, []string{"tunnel", "route"}, true},
+	} {
+		if got := MatchEventType(tc.eventType, tc.prefixes); got != tc.want {
+			t.Errorf("MatchEventType(%s, %v) = %v", tc.eventType, tc.prefixes, got)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package svc
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	InspectCapacity    = 50       // 每个路由保留的最近请求或连接数
+	InspectBodyLimit   = 64 << 10 // 每个请求或响应体最多记录的字节数
+	InspectStreamLimit = 1 << 20  // 每个 TCP 类路由连接最多记录的字节数
+)
+
+// CapturedRequest is a request to an HTTP route with inspection enabled and the response
+// the visitor received
+type CapturedRequest struct {
+	ID       string    `json:"id"`
+	RouteID  string    `json:"route_id"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_ms"`         // 处理时长 (毫秒)
+	ClientIP string    `json:"client_ip"`           // 访客 IP, 重放时为空
+	ReplayOf string    `json:"replay_of,omitempty"` // 重放的原请求 ID
+
+	Method           string      `json:"method"`
+	Scheme           string      `json:"scheme"` // 访客使用的 http 或 https
+	Host             string      `json:"host"`
+	Path             string      `json:"path"` // 请求 URI
+	Proto            string      `json:"proto"`
+	RequestHeaders   http.Header `json:"request_headers"`
+	RequestBody      []byte      `json:"request_body"`
+	RequestTruncated bool        `json:"request_truncated"` // 请求体超过 InspectBodyLimit, 只记录了开头部分
+
+	Status            int         `json:"status"`
+	ResponseHeaders   http.Header `json:"response_headers"`
+	ResponseBody      []byte      `json:"response_body"`
+	ResponseTruncated bool        `json:"response_truncated"` // 响应体超过 InspectBodyLimit, 只记录了开头部分
+}
+
+// StreamChunk is the data relayed at once in one direction of a captured stream
+type StreamChunk struct {
+	Time time.Time `json:"time"`
+	Out  bool      `json:"out"` // true 为目标发往访客, false 为访客发往目标
+	Data []byte    `json:"data"`
+}
+
+// CapturedStream is a visitor connection to a TCP-like route with inspection enabled, data
+// is recorded while the connection is open
+type CapturedStream struct {
+	ID         string
+	RouteID    string
+	Protocol   string
+	Time       time.Time
+	ClientAddr string // 访客地址 ip:port
+	Target     string
+
+	chunks    []StreamChunk
+	size      int
+	truncated bool      // 超过 InspectStreamLimit 后不再记录
+	closedAt  time.Time // 连接关闭时间, 未关闭时为零值
+	mutex     sync.Mutex
+}
+
+// StreamSummary describes a captured stream without its data
+type StreamSummary struct {
+	ID         string    `json:"id"`
+	RouteID    string    `json:"route_id"`
+	Protocol   string    `json:"protocol"`
+	Time       time.Time `json:"time"`
+	ClosedAt   time.Time `json:"closed_at"` // 未关闭时为零值
+	ClientAddr string    `json:"client_addr"`
+	BytesIn    int64     `json:"bytes_in"`  // 记录的访客发往目标的字节数
+	BytesOut   int64     `json:"bytes_out"` // 记录的目标发往访客的字节数
+	Truncated  bool      `json:"truncated"`
+}
+
+// Record appends data relayed in one direction, out is true for data sent to the visitor
+func (c *CapturedStream) Record(out bool, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.truncated {
+		return
+	}
+	if room := InspectStreamLimit - c.size; len(data) > room {
+		data = data[:room]
+		c.truncated = true
+	}
+	if len(data) == 0 {
+		return
+	}
+	c.chunks = append(c.chunks, StreamChunk{Time: time.Now(), Out: out, Data: append([]byte(nil), data...)})
+	c.size += len(data)
+}
+
+// Close marks the connection closed
+func (c *CapturedStream) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closedAt = time.Now()
+}
+
+// Chunks returns the data recorded so far and when the connection closed
+func (c *CapturedStream) Chunks() ([]StreamChunk, time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.chunks[:len(c.chunks):len(c.chunks)], c.closedAt, c.truncated
+}
+
+// Summary describes the stream without its data
+func (c *CapturedStream) Summary() StreamSummary {
+	chunks, closedAt, truncated := c.Chunks()
+	summary := StreamSummary{
+		ID:         c.ID,
+		RouteID:    c.RouteID,
+		Protocol:   c.Protocol,
+		Time:       c.Time,
+		ClosedAt:   closedAt,
+		ClientAddr: c.ClientAddr,
+		Truncated:  truncated,
+	}
+	for _, chunk := range chunks {
+		if chunk.Out {
+			summary.BytesOut += int64(len(chunk.Data))
+		} else {
+			summary.BytesIn += int64(len(chunk.Data))
+		}
+	}
+	return summary
+}
+
+// ring holds the latest InspectCapacity items, replacing the oldest once it is full
+type ring[T any] struct {
+	items []T
+	next  int
+}
+
+func (r *ring[T]) add(item T) {
+	if len(r.items) < InspectCapacity {
+		r.items = append(r.items, item)
+		return
+	}
+	r.items[r.next] = item
+	r.next = (r.next + 1) % InspectCapacity
+}
+
+// list returns the items newest first
+func (r *ring[T]) list() []T {
+	items := []T{}
+	if r == nil {
+		return items
+	}
+	n := len(r.items)
+	for k := 1; k <= n; k++ {
+		items = append(items, r.items[(r.next-k+n)%n])
+	}
+	return items
+}
+
+// Inspector keeps the latest requests and connections of each route with inspection
+// enabled in memory
+type Inspector struct {
+	requests map[string]*ring[*CapturedRequest] // 路由ID -> 最近的请求
+	streams  map[string]*ring[*CapturedStream]  // 路由ID -> 最近的连接
+	mutex    sync.Mutex
+}
+
+func NewInspector() *Inspector {
+	return &Inspector{
+		requests: map[string]*ring[*CapturedRequest]{},
+		streams:  map[string]*ring[*CapturedStream]{},
+	}
+}
+
+// Add stores the capture, replacing the oldest one of the route when the buffer is full
+func (i *Inspector) Add(capture *CapturedRequest) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	r, ok := i.requests[capture.RouteID]
+	if !ok {
+		r = &ring[*CapturedRequest]{}
+		i.requests[capture.RouteID] = r
+	}
+	r.add(capture)
+}
+
+// AddStream stores the stream when the connection opens so it can be inspected while open
+func (i *Inspector) AddStream(capture *CapturedStream) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	r, ok := i.streams[capture.RouteID]
+	if !ok {
+		r = &ring[*CapturedStream]{}
+		i.streams[capture.RouteID] = r
+	}
+	r.add(capture)
+}
+
+// List returns the captured requests of the route, newest first
+func (i *Inspector) List(routeID string) []*CapturedRequest {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.requests[routeID].list()
+}
+
+// Streams returns the captured connections of the route, newest first
+func (i *Inspector) Streams(routeID string) []*CapturedStream {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.streams[routeID].list()
+}
+
+// Get returns the captured request with id of the route
+func (i *Inspector) Get(routeID, id string) (*CapturedRequest, bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if r, ok := i.requests[routeID]; ok {
+		for _, capture := range r.items {
+			if capture.ID == id {
+				return capture, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Clear forgets the captures of the route
+func (i *Inspector) Clear(routeID string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	delete(i.requests, routeID)
+	delete(i.streams, routeID)
+}
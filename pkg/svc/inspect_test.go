@@ -0,0 +1,58 @@
+package svc
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func TestInspectorRing(t *testing.T) {
+	inspector := NewInspector()
+	if list := inspector.List("r1"); list == nil || len(list) != 0 {
+		t.Fatalf("empty route listed %v", list)
+	}
+	for n := 0; n < InspectCapacity+5; n++ {
+		inspector.Add(&CapturedRequest{ID: strconv.Itoa(n), RouteID: "r1"})
+	}
+	inspector.Add(&CapturedRequest{ID: "other", RouteID: "r2"})
+
+	// 只保留最近的请求, 最新的在前
+	list := inspector.List("r1")
+	if len(list) != InspectCapacity || list[0].ID != strconv.Itoa(InspectCapacity+4) || list[len(list)-1].ID != "5" {
+		t.Fatalf("listed %d requests from %s to %s", len(list), list[0].ID, list[len(list)-1].ID)
+	}
+	if _, ok := inspector.Get("r1", "4"); ok {
+		t.Error("replaced request still found")
+	}
+	if capture, ok := inspector.Get("r1", "5"); !ok || capture.ID != "5" {
+		t.Error("request not found")
+	}
+	if _, ok := inspector.Get("r1", "other"); ok {
+		t.Error("request of another route found")
+	}
+
+	inspector.AddStream(&CapturedStream{ID: "s1", RouteID: "r1"})
+	inspector.Clear("r1")
+	if len(inspector.List("r1")) != 0 || len(inspector.Streams("r1")) != 0 || len(inspector.List("r2")) != 1 {
+		t.Error("Clear did not forget only the captures of the route")
+	}
+}
+
+func TestCapturedStreamLimit(t *testing.T) {
+	stream := &CapturedStream{ID: "s1", RouteID: "r1"}
+	stream.Record(false, []byte("hello"))
+	stream.Record(true, bytes.Repeat([]byte("x"), InspectStreamLimit))
+	stream.Record(false, []byte("dropped"))
+
+	summary := stream.Summary()
+	if summary.BytesIn != 5 || summary.BytesOut != InspectStreamLimit-5 || !summary.Truncated {
+		t.Fatalf("summary = %+v", summary)
+	}
+	if !summary.ClosedAt.IsZero() {
+		t.Fatal("open stream has a close time")
+	}
+	stream.Close()
+	if stream.Summary().ClosedAt.IsZero() {
+		t.Fatal("closed stream has no close time")
+	}
+}
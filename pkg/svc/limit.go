@@ -0,0 +1,201 @@
+package svc
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+const limiterIdleTTL = 10 * time.Minute // 访客 IP 的令牌桶闲置超过该时间后清理
+
+// tokenBucket refills rate tokens per second up to burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes one token, it reports false when the bucket is empty
+func (b *tokenBucket) take(rate float64, burst int, now time.Time) bool {
+	capacity := float64(burst)
+	if capacity < 1 {
+		capacity = math.Max(1, math.Ceil(rate))
+	}
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RouteCounters are the limit counters of a route since the server started
+type RouteCounters struct {
+	Conns       int   `json:"conns"`        // 正在处理的请求或连接数
+	RateLimited int64 `json:"rate_limited"` // 超过请求速率被拒绝的次数
+	ConnLimited int64 `json:"conn_limited"` // 超过并发数被拒绝的次数
+}
+
+// TunnelCounters are the limit counters of a tunnel since the server started
+type TunnelCounters struct {
+	Streams       int   `json:"streams"`        // 正在使用的流数量
+	StreamLimited int64 `json:"stream_limited"` // 超过流数量被拒绝的次数
+}
+
+type routeLimiter struct {
+	global   tokenBucket
+	perIP    map[string]*tokenBucket
+	counters RouteCounters
+}
+
+// Limiter enforces the request rate and concurrency limits of routes and the stream limit
+// of tunnels
+type Limiter struct {
+	routes  map[string]*routeLimiter   // 路由ID -> 限制状态
+	tunnels map[string]*TunnelCounters // 隧道ID -> 流数量
+	swept   time.Time
+	mutex   sync.Mutex
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		routes:  map[string]*routeLimiter{},
+		tunnels: map[string]*TunnelCounters{},
+		swept:   time.Now(),
+	}
+}
+
+func (l *Limiter) route(id string) *routeLimiter {
+	r, ok := l.routes[id]
+	if !ok {
+		r = &routeLimiter{perIP: map[string]*tokenBucket{}}
+		l.routes[id] = r
+	}
+	return r
+}
+
+func (l *Limiter) tunnel(id string) *TunnelCounters {
+	t, ok := l.tunnels[id]
+	if !ok {
+		t = &TunnelCounters{}
+		l.tunnels[id] = t
+	}
+	return t
+}
+
+// Allow takes a token from the route bucket and the bucket of the visitor IP, it reports
+// false when either rate is exceeded
+func (l *Limiter) Allow(route *model.Route, ip string) bool {
+	limits := route.Limits
+	if limits.Rate <= 0 && limits.RatePerIP <= 0 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	r := l.route(route.ID)
+	if limits.RatePerIP > 0 {
+		bucket, ok := r.perIP[ip]
+		if !ok {
+			bucket = &tokenBucket{}
+			r.perIP[ip] = bucket
+		}
+		if !bucket.take(limits.RatePerIP, limits.BurstPerIP, now) {
+			r.counters.RateLimited++
+			return false
+		}
+	}
+	if limits.Rate > 0 && !r.global.take(limits.Rate, limits.Burst, now) {
+		r.counters.RateLimited++
+		return false
+	}
+	return true
+}
+
+// sweep drops the visitor buckets that have been idle long enough to be full again
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < limiterIdleTTL {
+		return
+	}
+	l.swept = now
+	for _, r := range l.routes {
+		for ip, bucket := range r.perIP {
+			if now.Sub(bucket.last) > limiterIdleTTL {
+				delete(r.perIP, ip)
+			}
+		}
+	}
+}
+
+// Acquire reserves a connection of the route and a stream of its tunnel, maxStreams of 0
+// means no stream limit. The returned release must be called once the stream is closed
+func (l *Limiter) Acquire(route *model.Route, maxStreams int) (release func(), ok bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	r := l.route(route.ID)
+	t := l.tunnel(route.TunnelID)
+	if route.Limits.MaxConns > 0 && r.counters.Conns >= route.Limits.MaxConns {
+		r.counters.ConnLimited++
+		return nil, false
+	}
+	if maxStreams > 0 && t.Streams >= maxStreams {
+		t.StreamLimited++
+		return nil, false
+	}
+	r.counters.Conns++
+	t.Streams++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			r.counters.Conns--
+			t.Streams--
+			l.mutex.Unlock()
+		})
+	}, true
+}
+
+// RemoveRoute drops the limit state of a deleted route, connections still open release
+// into the dropped state
+func (l *Limiter) RemoveRoute(id string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.routes, id)
+}
+
+// RemoveTunnel drops the stream counters of a deleted tunnel
+func (l *Limiter) RemoveTunnel(id string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.tunnels, id)
+}
+
+// RouteCounters returns the counters of the route
+func (l *Limiter) RouteCounters(id string) RouteCounters {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if r, ok := l.routes[id]; ok {
+		return r.counters
+	}
+	return RouteCounters{}
+}
+
+// TunnelCounters returns the counters of the tunnel
+func (l *Limiter) TunnelCounters(id string) TunnelCounters {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if t, ok := l.tunnels[id]; ok {
+		return *t
+	}
+	return TunnelCounters{}
+}
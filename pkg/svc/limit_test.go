@@ -0,0 +1,129 @@
+package svc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	now := time.Now()
+	var b tokenBucket
+	// 新的桶是满的
+	for i := 0; i < 3; i++ {
+		if !b.take(1, 3, now) {
+			t.Fatalf("token %d of the burst rejected", i)
+		}
+	}
+	if b.take(1, 3, now) {
+		t.Fatal("empty bucket allowed a request")
+	}
+	// 每秒补充 rate 个令牌
+	if b.take(1, 3, now.Add(500*time.Millisecond)) {
+		t.Fatal("half a token allowed a request")
+	}
+	if !b.take(1, 3, now.Add(time.Second)) {
+		t.Fatal("refilled token rejected")
+	}
+	// 补充的令牌不超过 burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !b.take(1, 3, later) {
+			t.Fatalf("token %d after idling rejected", i)
+		}
+	}
+	if b.take(1, 3, later) {
+		t.Fatal("bucket refilled past its burst")
+	}
+
+	// 未设置 burst 时容量为 rate 向上取整, 至少为 1
+	for _, tc := range []struct {
+		rate float64
+		want int
+	}{{2.5, 3}, {0.2, 1}} {
+		var b tokenBucket
+		n := 0
+		for b.take(tc.rate, 0, now) {
+			n++
+		}
+		if n != tc.want {
+			t.Errorf("rate %v allowed a burst of %d, want %d", tc.rate, n, tc.want)
+		}
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	l := NewLimiter()
+	route := &model.Route{ID: "r1", Limits: model.RouteLimits{RatePerIP: 1, BurstPerIP: 1, Rate: 100, Burst: 2}}
+	if !l.Allow(route, "10.0.0.1") || l.Allow(route, "10.0.0.1") {
+		t.Fatal("per-IP rate not enforced")
+	}
+	if !l.Allow(route, "10.0.0.2") {
+		t.Fatal("another visitor limited by the first")
+	}
+	// 路由总速率用完后所有访客都被拒绝
+	if l.Allow(route, "10.0.0.3") {
+		t.Fatal("route rate not enforced")
+	}
+	if n := l.RouteCounters(route.ID).RateLimited; n != 2 {
+		t.Fatalf("rate limited %d, want 2", n)
+	}
+	if !l.Allow(&model.Route{ID: "r2"}, "10.0.0.1") {
+		t.Fatal("route without limits rejected")
+	}
+}
+
+func TestLimiterAcquire(t *testing.T) {
+	l := NewLimiter()
+	route := &model.Route{ID: "r1", TunnelID: "t1", Limits: model.RouteLimits{MaxConns: 2}}
+	other := &model.Route{ID: "r2", TunnelID: "t1"}
+
+	release1, ok := l.Acquire(route, 3)
+	if !ok {
+		t.Fatal("first connection rejected")
+	}
+	release2, ok := l.Acquire(route, 3)
+	if !ok {
+		t.Fatal("second connection rejected")
+	}
+	if _, ok := l.Acquire(route, 3); ok {
+		t.Fatal("route connection limit not enforced")
+	}
+	// 同一隧道的其他路由共享流数量限制
+	release3, ok := l.Acquire(other, 3)
+	if !ok {
+		t.Fatal("stream of another route rejected")
+	}
+	if _, ok := l.Acquire(other, 3); ok {
+		t.Fatal("tunnel stream limit not enforced")
+	}
+	if c := l.RouteCounters(route.ID); c.Conns != 2 || c.ConnLimited != 1 {
+		t.Fatalf("route counters = %+v", c)
+	}
+	if c := l.TunnelCounters("t1"); c.Streams != 3 || c.StreamLimited != 1 {
+		t.Fatalf("tunnel counters = %+v", c)
+	}
+
+	// 重复调用 release 只释放一次
+	release1()
+	release1()
+	if c := l.TunnelCounters("t1"); c.Streams != 2 {
+		t.Fatalf("streams after release = %d, want 2", c.Streams)
+	}
+	if _, ok := l.Acquire(route, 3); !ok {
+		t.Fatal("released connection not reusable")
+	}
+
+	// 删除后的计数重新开始, 之前的 release 不影响新的计数
+	l.RemoveRoute(route.ID)
+	l.RemoveTunnel("t1")
+	release2()
+	release3()
+	if c := l.RouteCounters(route.ID); c != (RouteCounters{}) {
+		t.Fatalf("route counters after remove = %+v", c)
+	}
+	if c := l.TunnelCounters("t1"); c != (TunnelCounters{}) {
+		t.Fatalf("tunnel counters after remove = %+v", c)
+	}
+}
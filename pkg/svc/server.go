@@ -1,13 +1,20 @@
 package svc
 
 import (
+	"errors"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/glebarez/sqlite"
 	"github.com/obud-dev/tunnel/pkg/config"
 	"github.com/obud-dev/tunnel/pkg/message"
+	"github.com/obud-dev/tunnel/pkg/metrics"
 	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/utils"
+	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 )
 
@@ -15,28 +22,161 @@ const (
 	DefaultHost     = "0.0.0.0"
 	DefaultListenOn = ":5429"
 	DefaultApi      = ":8000"
+
+	DefaultReconnectGrace  = 10 * time.Second // 隧道断线后保留访客请求的时间
+	DefaultReconnectQueue  = 64               // 隧道断线期间每个隧道最多保留的访客请求数
+	DefaultResponseTimeout = 60 * time.Second // 等待内网目标服务响应的时间
+	DefaultMaxStreams      = 1024             // 每个隧道同时打开的流数量上限
+
+	streamQueue = 64 // 每个连接等待写出的消息数, 访客读取太慢时超出后关闭流
+)
+
+var (
+	ErrTunnelOffline      = errors.New("tunnel is offline")
+	ErrTunnelReconnecting = errors.New("tunnel is reconnecting")
+	ErrStreamOverflow     = errors.New("stream queue overflow")
 )
 
 type Server interface {
 	Listen() error
+	ListenTls() error
+	ListenControl() error
+	ListenHttp() error
 	HandleConnect(m message.Message, conn net.Conn)
+	Replay(route *model.Route, req *http.Request, replayOf string) (*CapturedRequest, error)
 }
 
 type ActiveTunnel struct {
 	Conn    net.Conn
 	Token   string
 	Channel chan []byte
+	Done    chan struct{} // 连接关闭信号
+	once    sync.Once
+
+	Route      *model.Route    // 访客连接匹配的路由
+	MaxStreams int             // 隧道同时打开的流数量上限
+	Trace      []byte          // 访客请求的链路追踪上下文, 随流的第一条消息发给客户端
+	BytesIn    atomic.Int64    // 访客发往目标的字节数
+	BytesOut   atomic.Int64    // 目标发往访客的字节数
+	Capture    *CapturedStream // 路由开启 inspect 时记录流的数据
+	timer      *time.Timer     // 等待响应超时计时器
+	err        error           // 流失败的原因
+	mutex      sync.Mutex
+}
+
+func NewActiveTunnel(conn net.Conn, token string) *ActiveTunnel {
+	return &ActiveTunnel{
+		Conn:    conn,
+		Token:   token,
+		Channel: make(chan []byte, streamQueue),
+		Done:    make(chan struct{}),
+	}
+}
+
+// Send hands data to the connection writer, returning false once the connection is closed
+func (t *ActiveTunnel) Send(data []byte) bool {
+	select {
+	case t.Channel <- data:
+		return true
+	case <-t.Done:
+		return false
+	}
+}
+
+// Queue hands data to the connection writer without blocking, a connection whose queue is
+// full is failed with ErrStreamOverflow so that it can not stall the tunnel
+func (t *ActiveTunnel) Queue(data []byte) bool {
+	select {
+	case t.Channel <- data:
+		return true
+	case <-t.Done:
+		return false
+	default:
+		t.Fail(ErrStreamOverflow)
+		return false
+	}
+}
+
+// Close closes the connection and stops its writer, it is safe to call more than once
+func (t *ActiveTunnel) Close() {
+	t.once.Do(func() {
+		close(t.Done)
+		t.Conn.Close()
+		t.Responded()
+	})
+}
+
+// Fail records why the stream failed and closes it, only the first error is kept
+func (t *ActiveTunnel) Fail(err error) {
+	t.mutex.Lock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.mutex.Unlock()
+	t.Close()
+}
+
+// Err returns the error recorded by Fail
+func (t *ActiveTunnel) Err() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.err
+}
+
+// Await arms the response timeout, f is called if no response arrives within d
+func (t *ActiveTunnel) Await(d time.Duration, f func()) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(d, f)
+}
+
+// Responded stops the response timeout
+func (t *ActiveTunnel) Responded() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+// offlineTunnel records a tunnel whose client disconnected and is expected to reconnect
+type offlineTunnel struct {
+	since   time.Time
+	waiting int // 正在等待隧道恢复的访客请求数
 }
 
 type ServerCtx struct {
-	Config      config.ServerConfig
-	TunnelModel model.TunnelModel
-	RouteModel  model.RouteModel
-	ServerModel model.ServerModel
-	Routes      []model.Route            // 路由
-	Tunnels     map[string]*ActiveTunnel // 隧道ID -> 隧道连接
-	Messages    map[string]*ActiveTunnel // 消息ID -> 外部连接
-	Mutex       sync.Mutex
+	Config           config.ServerConfig
+	TunnelModel      model.TunnelModel
+	RouteModel       model.RouteModel
+	ServerModel      model.ServerModel
+	ErrorPageModel   model.ErrorPageModel
+	AcmeCacheModel   model.AcmeCacheModel
+	CertificateModel model.CertificateModel
+	TrafficStatModel model.TrafficStatModel
+	WebhookModel     model.WebhookModel
+	UserModel        model.UserModel
+	Routes           []model.Route            // 路由
+	Tunnels          map[string]*ActiveTunnel // 隧道ID -> 隧道连接
+	Messages         map[string]*ActiveTunnel // 消息ID -> 外部连接
+	Limiter          *Limiter                 // 路由及隧道的限制状态
+	Traffic          *Traffic                 // 隧道带宽及流量配额
+	Stats            *Stats                   // 路由流量统计
+	AccessLog        *AccessLog               // 访客请求及连接的访问日志
+	Inspector        *Inspector               // 路由最近的请求及响应
+	Events           *EventBus                // 隧道, 连接及路由的变化事件
+	Webhooks         *Webhooks                // 将事件发送到订阅的 Webhook
+	Mutex            sync.Mutex
+
+	offline       map[string]*offlineTunnel           // 隧道ID -> 断线信息
+	authenticated sync.Map                            // 用户ID -> 已验证的密码及哈希的摘要
+	certificates  atomic.Pointer[[]LoadedCertificate] // 手动上传的证书, 整体替换以便握手时无锁读取
+	errorPages    atomic.Pointer[[]LoadedErrorPage]   // 自定义错误页面及解析后的模板, 整体替换以便无锁读取
+	ready         chan struct{}                       // 有隧道上线时关闭并重建，用于唤醒等待的请求
 }
 
 func NewServerCtx(config config.ServerConfig) *ServerCtx {
@@ -50,13 +190,17 @@ func NewServerCtx(config config.ServerConfig) *ServerCtx {
 	if config.Api == "" {
 		config.Api = DefaultApi
 	}
-	if config.User == "" {
-		config.User = "admin"
+	if config.ReconnectGrace == 0 {
+		config.ReconnectGrace = DefaultReconnectGrace
 	}
-
-	if config.Password == "" {
-		// panic("password is required")
-		config.Password = "123456"
+	if config.ReconnectQueue == 0 {
+		config.ReconnectQueue = DefaultReconnectQueue
+	}
+	if config.ResponseTimeout == 0 {
+		config.ResponseTimeout = DefaultResponseTimeout
+	}
+	if config.MaxStreams == 0 {
+		config.MaxStreams = DefaultMaxStreams
 	}
 
 	db, err := gorm.Open(sqlite.Open("tunnel.db"), &gorm.Config{})
@@ -66,15 +210,33 @@ func NewServerCtx(config config.ServerConfig) *ServerCtx {
 	db.AutoMigrate(&model.Tunnel{})
 	db.AutoMigrate(&model.Route{})
 	db.AutoMigrate(&model.Server{})
+	db.AutoMigrate(&model.ErrorPage{})
+	db.AutoMigrate(&model.AcmeCache{})
+	db.AutoMigrate(&model.Certificate{})
+	db.AutoMigrate(&model.TrafficStat{})
+	db.AutoMigrate(&model.Webhook{})
+	db.AutoMigrate(&model.WebhookDelivery{})
+	db.AutoMigrate(&model.User{})
 	tunnelModel := model.NewTunnelModel(db)
 	routeModel := model.NewRouteModel(db)
 	serverModel := model.NewServerModel(db)
+	errorPageModel := model.NewErrorPageModel(db)
+	trafficStatModel := model.NewTrafficStatModel(db)
+	webhookModel := model.NewWebhookModel(db)
+	userModel := model.NewUserModel(db)
+	if err := bootstrapAdmin(config, userModel); err != nil {
+		panic(err)
+	}
 
 	serverModel.Update(&model.Server{
-		Host:     config.Host,
-		ListenOn: config.ListenOn,
-		Api:      config.Api,
-		Version:  "v1.0.0",
+		Host:      config.Host,
+		ListenOn:  config.ListenOn,
+		Api:       config.Api,
+		ListenTls: config.ListenTls,
+		Version:   "v1.0.0",
+
+		ListenControl: config.ListenControl,
+		ListenHttp:    config.ListenHttp,
 	})
 
 	routes, err := routeModel.GetRoutes()
@@ -82,15 +244,61 @@ func NewServerCtx(config config.ServerConfig) *ServerCtx {
 		panic(err)
 	}
 
-	return &ServerCtx{
-		Config:      config,
-		TunnelModel: tunnelModel,
-		RouteModel:  routeModel,
-		ServerModel: serverModel,
-		Routes:      routes,
-		Tunnels:     map[string]*ActiveTunnel{},
-		Messages:    map[string]*ActiveTunnel{},
+	accessLog, err := NewAccessLog(config.AccessLog, config.AccessLogFormat, config.AccessLogMaxSize, config.AccessLogMaxBackups)
+	if err != nil {
+		panic(err)
+	}
+
+	events := NewEventBus()
+
+	// 服务重启前在线的隧道视为正在重连
+	offline := map[string]*offlineTunnel{}
+	tunnels, err := tunnelModel.GetTunnels()
+	if err != nil {
+		panic(err)
+	}
+	for _, tunnel := range tunnels {
+		if tunnel.Status == "online" {
+			offline[tunnel.ID] = &offlineTunnel{since: time.Now()}
+			tunnel.Status = "offline"
+			tunnelModel.Update(&tunnel)
+		}
+	}
+
+	ctx := &ServerCtx{
+		Config:           config,
+		TunnelModel:      tunnelModel,
+		RouteModel:       routeModel,
+		ServerModel:      serverModel,
+		ErrorPageModel:   errorPageModel,
+		AcmeCacheModel:   model.NewAcmeCacheModel(db),
+		CertificateModel: model.NewCertificateModel(db),
+		TrafficStatModel: trafficStatModel,
+		WebhookModel:     webhookModel,
+		UserModel:        userModel,
+		Routes:           routes,
+		Tunnels:          map[string]*ActiveTunnel{},
+		Messages:         map[string]*ActiveTunnel{},
+		Limiter:          NewLimiter(),
+		Traffic:          NewTraffic(tunnelModel, events),
+		Stats:            NewStats(trafficStatModel),
+		AccessLog:        accessLog,
+		Inspector:        NewInspector(),
+		Events:           events,
+		Webhooks:         NewWebhooks(webhookModel, tunnelModel, events),
+		offline:          offline,
+		ready:            make(chan struct{}),
+	}
+	if err := ctx.UpdateCertificates(); err != nil {
+		log.Error().Err(err).Msg("Failed to load certificates")
+	}
+	if err := ctx.UpdateErrorPages(); err != nil {
+		panic(err)
+	}
+	for tid, t := range offline {
+		ctx.expireOffline(tid, t)
 	}
+	return ctx
 }
 
 func (ctx *ServerCtx) UpdateRoutes() error {
@@ -98,17 +306,184 @@ func (ctx *ServerCtx) UpdateRoutes() error {
 	if err != nil {
 		return err
 	}
+	ctx.Mutex.Lock()
 	ctx.Routes = routes
+	ctx.Mutex.Unlock()
 	return nil
 }
 
-func (ctx *ServerCtx) DelTunnel(tid string) error {
+// MatchRoute returns the route for the hostname, the port of host is ignored
+func (ctx *ServerCtx) MatchRoute(host string) *model.Route {
+	host = utils.StripPort(host)
+	for _, route := range ctx.Routes {
+		if route.Hostname == host {
+			return &route
+		}
+	}
+	return nil
+}
+
+// AddTunnel registers a connected tunnel and wakes up requests waiting for it
+func (ctx *ServerCtx) AddTunnel(tid string, tunnel *ActiveTunnel) {
+	ctx.Mutex.Lock()
+	old := ctx.Tunnels[tid]
+	ctx.Tunnels[tid] = tunnel
+	// 宽限期内重连的隧道没有发布过下线事件
+	offline, reconnecting := ctx.offline[tid]
+	online := old == nil && (!reconnecting || time.Since(offline.since) >= ctx.Config.ReconnectGrace)
+	delete(ctx.offline, tid)
+	metrics.ActiveTunnels.Set(float64(len(ctx.Tunnels)))
+	close(ctx.ready)
+	ctx.ready = make(chan struct{})
+	ctx.Mutex.Unlock()
+
+	if old != nil {
+		old.Close()
+		ctx.Events.Publish(Event{Type: EventSessionDisconnect, TunnelID: tid, Data: map[string]any{
+			"addr":   old.Conn.RemoteAddr().String(),
+			"reason": "replaced",
+		}})
+	}
+	ctx.Events.Publish(Event{Type: EventSessionConnect, TunnelID: tid, Data: map[string]any{
+		"addr": tunnel.Conn.RemoteAddr().String(),
+	}})
+	if online {
+		ctx.Events.Publish(Event{Type: EventTunnelOnline, TunnelID: tid})
+	}
+}
+
+// GetTunnel returns the active tunnel by ID
+func (ctx *ServerCtx) GetTunnel(tid string) (*ActiveTunnel, bool) {
+	ctx.Mutex.Lock()
+	defer ctx.Mutex.Unlock()
+	tunnel, ok := ctx.Tunnels[tid]
+	return tunnel, ok
+}
+
+// ReleaseTunnel unregisters the tunnel served by conn after the client disconnected,
+// keeping it in the reconnecting state for the grace period
+func (ctx *ServerCtx) ReleaseTunnel(conn net.Conn) {
+	ctx.Mutex.Lock()
+	tid := ctx.tunnelID(conn)
+	if tid == "" {
+		ctx.Mutex.Unlock()
+		return
+	}
 	tunnel := ctx.Tunnels[tid]
-	tunnel.Conn.Close()
-	close(tunnel.Channel)
+	delete(ctx.Tunnels, tid)
+	offline := &offlineTunnel{since: time.Now()}
+	ctx.offline[tid] = offline
+	metrics.ActiveTunnels.Set(float64(len(ctx.Tunnels)))
+	ctx.Mutex.Unlock()
+	metrics.HeartbeatRtt.DeleteLabelValues(tid)
+
+	tunnel.Close()
+	if t, err := ctx.TunnelModel.GetTunnelByID(tid); err == nil {
+		t.Status = "offline"
+		ctx.TunnelModel.Update(t)
+	}
+	ctx.Events.Publish(Event{Type: EventSessionDisconnect, TunnelID: tid, Data: map[string]any{
+		"addr":   tunnel.Conn.RemoteAddr().String(),
+		"reason": "disconnected",
+	}})
+	ctx.expireOffline(tid, offline)
+}
+
+// expireOffline publishes the tunnel offline event once the grace period of the
+// disconnect is over, unless the tunnel has reconnected or been deleted meanwhile
+func (ctx *ServerCtx) expireOffline(tid string, offline *offlineTunnel) {
+	time.AfterFunc(time.Until(offline.since.Add(ctx.Config.ReconnectGrace)), func() {
+		ctx.Mutex.Lock()
+		expired := ctx.offline[tid] == offline
+		ctx.Mutex.Unlock()
+		if expired {
+			ctx.Events.Publish(Event{Type: EventTunnelOffline, TunnelID: tid})
+		}
+	})
+}
+
+// TunnelID returns the ID of the tunnel served by conn, empty when conn is not a tunnel
+func (ctx *ServerCtx) TunnelID(conn net.Conn) string {
+	ctx.Mutex.Lock()
+	defer ctx.Mutex.Unlock()
+	return ctx.tunnelID(conn)
+}
+
+func (ctx *ServerCtx) tunnelID(conn net.Conn) string {
+	for id, tunnel := range ctx.Tunnels {
+		if tunnel.Conn == conn {
+			return id
+		}
+	}
+	return ""
+}
+
+// WaitTunnel returns the active tunnel by ID. If the tunnel is reconnecting the call
+// blocks until it is back or the grace period is over, then returns ErrTunnelOffline
+// or ErrTunnelReconnecting
+func (ctx *ServerCtx) WaitTunnel(tid string) (*ActiveTunnel, error) {
+	ctx.Mutex.Lock()
+	defer ctx.Mutex.Unlock()
+
+	if tunnel, ok := ctx.Tunnels[tid]; ok {
+		return tunnel, nil
+	}
+	offline, ok := ctx.offline[tid]
+	if !ok || time.Since(offline.since) >= ctx.Config.ReconnectGrace {
+		return nil, ErrTunnelOffline
+	}
+	if offline.waiting >= ctx.Config.ReconnectQueue {
+		return nil, ErrTunnelReconnecting
+	}
+	offline.waiting++
+	defer func() { offline.waiting-- }()
+
+	deadline := offline.since.Add(ctx.Config.ReconnectGrace)
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, ErrTunnelReconnecting
+		}
+		ready := ctx.ready
+		ctx.Mutex.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-ready:
+			timer.Stop()
+		case <-timer.C:
+		}
+		ctx.Mutex.Lock()
+
+		if tunnel, ok := ctx.Tunnels[tid]; ok {
+			return tunnel, nil
+		}
+		if _, ok := ctx.offline[tid]; !ok {
+			return nil, ErrTunnelOffline
+		}
+	}
+}
+
+func (ctx *ServerCtx) DelTunnel(tid string) error {
 	ctx.Mutex.Lock()
+	tunnel, ok := ctx.Tunnels[tid]
+	// 宽限期已过的隧道已经发布过下线事件
+	offline, reconnecting := ctx.offline[tid]
+	reconnecting = reconnecting && time.Since(offline.since) < ctx.Config.ReconnectGrace
 	delete(ctx.Tunnels, tid)
+	delete(ctx.offline, tid)
+	metrics.ActiveTunnels.Set(float64(len(ctx.Tunnels)))
 	ctx.Mutex.Unlock()
+	metrics.HeartbeatRtt.DeleteLabelValues(tid)
+	if ok {
+		tunnel.Close()
+		ctx.Events.Publish(Event{Type: EventSessionDisconnect, TunnelID: tid, Data: map[string]any{
+			"addr":   tunnel.Conn.RemoteAddr().String(),
+			"reason": "closed by server",
+		}})
+	}
+	if ok || reconnecting {
+		ctx.Events.Publish(Event{Type: EventTunnelOffline, TunnelID: tid})
+	}
 
 	return nil
 }
@@ -0,0 +1,136 @@
+package svc
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/obud-dev/tunnel/pkg/config"
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+func TestActiveTunnelQueueOverflow(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	visitor := NewActiveTunnel(remote, "token")
+
+	// 没有写出协程时队列填满后流被关闭, 不会阻塞调用方
+	for i := 0; i < streamQueue; i++ {
+		if !visitor.Queue([]byte("x")) {
+			t.Fatalf("Queue failed after %d messages", i)
+		}
+	}
+	if visitor.Queue([]byte("x")) {
+		t.Fatal("Queue succeeded on a full queue")
+	}
+	if !errors.Is(visitor.Err(), ErrStreamOverflow) {
+		t.Fatalf("Err() = %v, want ErrStreamOverflow", visitor.Err())
+	}
+	select {
+	case <-visitor.Done:
+	default:
+		t.Fatal("stream not closed on overflow")
+	}
+	if visitor.Queue([]byte("x")) || visitor.Send([]byte("x")) {
+		t.Fatal("closed stream accepted data")
+	}
+}
+
+// newReconnectCtx returns a server context with tunnel t1 connected through a pipe
+func newReconnectCtx(t *testing.T, grace time.Duration, queue int) (*ServerCtx, net.Conn) {
+	tunnelModel := model.NewTunnelModel(openTestDB(t, &model.Tunnel{}))
+	if err := tunnelModel.Insert(&model.Tunnel{ID: "t1", Name: "t1", Token: "token"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &ServerCtx{
+		Config:      config.ServerConfig{ReconnectGrace: grace, ReconnectQueue: queue},
+		TunnelModel: tunnelModel,
+		Events:      NewEventBus(),
+		Tunnels:     map[string]*ActiveTunnel{},
+		offline:     map[string]*offlineTunnel{},
+		ready:       make(chan struct{}),
+	}
+	conn, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	ctx.AddTunnel("t1", NewActiveTunnel(conn, "token"))
+	return ctx, conn
+}
+
+func TestWaitTunnelReconnect(t *testing.T) {
+	ctx, conn := newReconnectCtx(t, 5*time.Second, 1)
+	if _, err := ctx.WaitTunnel("missing"); !errors.Is(err, ErrTunnelOffline) {
+		t.Fatalf("unknown tunnel: %v", err)
+	}
+	ctx.ReleaseTunnel(conn)
+
+	type result struct {
+		tunnel *ActiveTunnel
+		err    error
+	}
+	waiting := make(chan result)
+	go func() {
+		tunnel, err := ctx.WaitTunnel("t1")
+		waiting <- result{tunnel, err}
+	}()
+	// 等第一个请求进入队列后, 超出队列长度的请求直接失败
+	for deadline := time.Now().Add(time.Second); ; {
+		ctx.Mutex.Lock()
+		n := ctx.offline["t1"].waiting
+		ctx.Mutex.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := ctx.WaitTunnel("t1"); !errors.Is(err, ErrTunnelReconnecting) {
+		t.Fatalf("request over the queue limit: %v", err)
+	}
+
+	// 重连后排队的请求使用新的连接
+	conn2, remote2 := net.Pipe()
+	defer remote2.Close()
+	reconnected := NewActiveTunnel(conn2, "token")
+	ctx.AddTunnel("t1", reconnected)
+	select {
+	case r := <-waiting:
+		if r.err != nil || r.tunnel != reconnected {
+			t.Fatalf("queued request got %v, %v", r.tunnel, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued request not woken up by the reconnect")
+	}
+}
+
+func TestWaitTunnelGraceExpired(t *testing.T) {
+	ctx, conn := newReconnectCtx(t, 100*time.Millisecond, 8)
+	events, cancel := ctx.Events.Subscribe(0)
+	defer cancel()
+	ctx.ReleaseTunnel(conn)
+
+	start := time.Now()
+	if _, err := ctx.WaitTunnel("t1"); !errors.Is(err, ErrTunnelReconnecting) {
+		t.Fatalf("request during the grace period: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("request failed after %v, before the grace period was over", elapsed)
+	}
+	if _, err := ctx.WaitTunnel("t1"); !errors.Is(err, ErrTunnelOffline) {
+		t.Fatalf("request after the grace period: %v", err)
+	}
+
+	// 宽限期结束后才发布下线事件
+	for _, want := range []string{EventSessionDisconnect, EventTunnelOffline} {
+		select {
+		case event := <-events:
+			if event.Type != want {
+				t.Fatalf("event %s, want %s", event.Type, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %s not published", want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package svc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/obud-dev/tunnel/pkg/metrics"
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+const (
+	StatsBucket        = 5 * time.Minute     // 流量统计的时间段长度
+	statsFlushInterval = 30 * time.Second    // 流量统计写入数据库的间隔
+	statsRetention     = 90 * 24 * time.Hour // 流量统计保留时间
+	statsCleanInterval = 24 * time.Hour      // 清理过期统计的间隔
+)
+
+type statsKey struct {
+	tunnelID string
+	routeID  string
+	bucket   int64
+}
+
+// Stats counts the traffic of each route in memory and periodically adds it to the
+// traffic_stats table
+type Stats struct {
+	model   model.TrafficStatModel
+	pending map[statsKey]*model.TrafficStat
+	cleaned time.Time
+	mutex   sync.Mutex
+	flush   sync.Mutex // 保证写入顺序, 查询前写入时与定时写入互斥
+}
+
+func NewStats(statModel model.TrafficStatModel) *Stats {
+	return &Stats{model: statModel, pending: map[statsKey]*model.TrafficStat{}}
+}
+
+// add applies f to the counters of the route in the current bucket
+func (s *Stats) add(route *model.Route, f func(stat *model.TrafficStat)) {
+	if route == nil {
+		return
+	}
+	bucket := time.Now().Truncate(StatsBucket).Unix()
+	key := statsKey{tunnelID: route.TunnelID, routeID: route.ID, bucket: bucket}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stat, ok := s.pending[key]
+	if !ok {
+		stat = &model.TrafficStat{TunnelID: route.TunnelID, RouteID: route.ID, Bucket: bucket}
+		s.pending[key] = stat
+	}
+	f(stat)
+}
+
+// BytesIn counts n bytes sent from a visitor to the target of the route
+func (s *Stats) BytesIn(route *model.Route, n int) {
+	if route != nil {
+		metrics.Bytes.WithLabelValues(route.Hostname, "in").Add(float64(n))
+	}
+	s.add(route, func(stat *model.TrafficStat) { stat.BytesIn += int64(n) })
+}
+
+// BytesOut counts n bytes sent from the target of the route to a visitor
+func (s *Stats) BytesOut(route *model.Route, n int) {
+	if route != nil {
+		metrics.Bytes.WithLabelValues(route.Hostname, "out").Add(float64(n))
+	}
+	s.add(route, func(stat *model.TrafficStat) { stat.BytesOut += int64(n) })
+}
+
+// Request counts an HTTP request to the route
+func (s *Stats) Request(route *model.Route) {
+	s.add(route, func(stat *model.TrafficStat) { stat.Requests++ })
+}
+
+// Connection counts a connection to a TCP-like route
+func (s *Stats) Connection(route *model.Route) {
+	s.add(route, func(stat *model.TrafficStat) { stat.Connections++ })
+}
+
+// Error counts a request or connection to the route that could not be forwarded
+func (s *Stats) Error(route *model.Route) {
+	s.add(route, func(stat *model.TrafficStat) { stat.Errors++ })
+}
+
+// Run flushes the counters and removes expired statistics until the process exits
+func (s *Stats) Run() {
+	ticker := time.NewTicker(statsFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.Flush()
+		if time.Since(s.cleaned) >= statsCleanInterval {
+			s.cleaned = time.Now()
+			if err := s.model.DeleteBefore(time.Now().Add(-statsRetention).Unix()); err != nil {
+				log.Error().Err(err).Msg("Failed to remove expired traffic statistics")
+			}
+		}
+	}
+}
+
+// Flush adds the counters collected since the last flush to the database
+func (s *Stats) Flush() {
+	s.flush.Lock()
+	defer s.flush.Unlock()
+
+	s.mutex.Lock()
+	pending := s.pending
+	s.pending = map[statsKey]*model.TrafficStat{}
+	s.mutex.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	stats := make([]model.TrafficStat, 0, len(pending))
+	for _, stat := range pending {
+		stats = append(stats, *stat)
+	}
+	if err := s.model.Add(stats); err != nil {
+		log.Error().Err(err).Msg("Failed to save traffic statistics")
+		// 下次再写入
+		s.mutex.Lock()
+		for key, stat := range pending {
+			if current, ok := s.pending[key]; ok {
+				current.Add(stat)
+			} else {
+				s.pending[key] = stat
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
@@ -0,0 +1,64 @@
+package svc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+func TestStatsFlush(t *testing.T) {
+	statModel := model.NewTrafficStatModel(openTestDB(t, &model.TrafficStat{}))
+	stats := NewStats(statModel)
+	route := &model.Route{ID: "r1", TunnelID: "t1", Hostname: "app.example.com"}
+	other := &model.Route{ID: "r2", TunnelID: "t1", Hostname: "ssh.example.com"}
+
+	stats.Request(route)
+	stats.BytesIn(route, 100)
+	stats.BytesOut(route, 2000)
+	stats.Connection(other)
+	stats.Error(other)
+	stats.Request(nil)
+	stats.Flush()
+
+	// 第二次写入累加到同一时间段的记录上
+	stats.Request(route)
+	stats.BytesIn(route, 50)
+	stats.Flush()
+	stats.Flush()
+
+	now := time.Now().Unix()
+	rows, err := statModel.GetStats("t1", 0, now+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 两次写入跨过时间段边界时分成两行, 按路由合计
+	totals := map[string]model.TrafficStat{}
+	for _, row := range rows {
+		if row.Bucket%int64(StatsBucket.Seconds()) != 0 || row.Bucket > now {
+			t.Errorf("bucket %d is not the start of a period", row.Bucket)
+		}
+		total := totals[row.RouteID]
+		total.TunnelID, total.RouteID = row.TunnelID, row.RouteID
+		total.Add(&row)
+		totals[row.RouteID] = total
+	}
+	for _, want := range []model.TrafficStat{
+		{TunnelID: "t1", RouteID: "r1", BytesIn: 150, BytesOut: 2000, Requests: 2},
+		{TunnelID: "t1", RouteID: "r2", Connections: 1, Errors: 1},
+	} {
+		if got := totals[want.RouteID]; got != want {
+			t.Errorf("route %s = %+v, want %+v", want.RouteID, got, want)
+		}
+	}
+	if len(totals) != 2 {
+		t.Errorf("statistics of %d routes, want 2", len(totals))
+	}
+
+	if err := statModel.DeleteBefore(now + 1); err != nil {
+		t.Fatal(err)
+	}
+	if rows, _ := statModel.GetStats("t1", 0, now+1); len(rows) != 0 {
+		t.Errorf("%d rows left after removing expired statistics", len(rows))
+	}
+}
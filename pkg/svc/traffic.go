@@ -0,0 +1,221 @@
+package svc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+const trafficFlushInterval = 10 * time.Second // 流量用量写入数据库的间隔
+
+// shaper paces the bytes sent in one direction of a tunnel, it allows a burst of one
+// second of traffic
+type shaper struct {
+	rate   int64 // 每秒字节数, 0 表示不限制
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller has to wait
+// before sending them
+func (s *shaper) reserve(n int, now time.Time) time.Duration {
+	if s.rate <= 0 {
+		return 0
+	}
+	if s.last.IsZero() {
+		s.tokens = float64(s.rate)
+	} else if elapsed := now.Sub(s.last).Seconds(); elapsed > 0 {
+		s.tokens += elapsed * float64(s.rate)
+		if s.tokens > float64(s.rate) {
+			s.tokens = float64(s.rate)
+		}
+	}
+	s.last = now
+	s.tokens -= float64(n)
+	if s.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-s.tokens / float64(s.rate) * float64(time.Second))
+}
+
+// tunnelTraffic is the bandwidth and quota state of a tunnel
+type tunnelTraffic struct {
+	upload   shaper
+	download shaper
+
+	quota   int64  // 周期内允许的字节数, 0 表示不限制
+	period  string // 配额重置周期
+	used    int64  // 周期内已使用的字节数, 包含未写入数据库的部分
+	pending int64  // 尚未写入数据库的字节数
+	resetAt int64  // 下次重置配额的时间
+}
+
+// Traffic shapes the bandwidth of tunnels and accounts their traffic against the quotas
+type Traffic struct {
+	model   model.TunnelModel
+	events  *EventBus
+	tunnels map[string]*tunnelTraffic // 隧道ID -> 流量状态
+	mutex   sync.Mutex
+}
+
+func NewTraffic(tunnelModel model.TunnelModel, events *EventBus) *Traffic {
+	return &Traffic{model: tunnelModel, events: events, tunnels: map[string]*tunnelTraffic{}}
+}
+
+// Load applies the bandwidth and quota settings of the tunnel, it is called when the tunnel
+// connects or its settings change
+func (t *Traffic) Load(tunnel *model.Tunnel) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tt, ok := t.tunnels[tunnel.ID]
+	if !ok {
+		tt = &tunnelTraffic{}
+		t.tunnels[tunnel.ID] = tt
+	}
+	tt.upload.rate = tunnel.UploadRate
+	tt.download.rate = tunnel.DownloadRate
+	tt.quota = tunnel.QuotaBytes
+	tt.period = tunnel.QuotaPeriod
+	tt.used = tunnel.QuotaUsed + tt.pending
+	tt.resetAt = tunnel.QuotaResetAt
+	if tt.resetAt == 0 && tt.period != "" {
+		// 首次设置周期时从下个周期开始重置
+		tt.resetAt = model.NextQuotaReset(tt.period, time.Now())
+		t.model.ResetQuota(tunnel.ID, tunnel.QuotaUsed, tt.resetAt)
+	}
+	t.reset(tunnel.ID, tt, time.Now())
+}
+
+// Remove forgets the state of a deleted tunnel
+func (t *Traffic) Remove(tid string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.tunnels, tid)
+}
+
+// reset starts a new quota period once the reset time has passed
+func (t *Traffic) reset(tid string, tt *tunnelTraffic, now time.Time) {
+	if tt.period == "" || tt.resetAt == 0 || now.Unix() < tt.resetAt {
+		return
+	}
+	tt.used, tt.pending = 0, 0
+	tt.resetAt = model.NextQuotaReset(tt.period, now)
+	if err := t.model.ResetQuota(tid, 0, tt.resetAt); err != nil {
+		log.Error().Err(err).Msgf("Failed to reset traffic quota of tunnel %s", tid)
+		return
+	}
+	log.Info().Msgf("Traffic quota of tunnel %s reset", tid)
+}
+
+// Exhausted reports whether the tunnel has used up its quota and when the quota resets,
+// a reset time of 0 means the quota never resets
+func (t *Traffic) Exhausted(tid string) (bool, time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tt, ok := t.tunnels[tid]
+	if !ok || tt.quota <= 0 {
+		return false, time.Time{}
+	}
+	t.reset(tid, tt, time.Now())
+	if tt.used < tt.quota {
+		return false, time.Time{}
+	}
+	if tt.resetAt == 0 {
+		return true, time.Time{}
+	}
+	return true, time.Unix(tt.resetAt, 0)
+}
+
+// Upload accounts n bytes sent from the tunnel client to a visitor and waits until the upload
+// rate allows sending them. It returns false when the quota is exhausted or done is closed
+func (t *Traffic) Upload(tid string, n int, done <-chan struct{}) bool {
+	return t.transfer(tid, n, true, done)
+}
+
+// Download accounts n bytes sent from a visitor to the tunnel client and waits until the
+// download rate allows sending them. It returns false when the quota is exhausted or done is closed
+func (t *Traffic) Download(tid string, n int, done <-chan struct{}) bool {
+	return t.transfer(tid, n, false, done)
+}
+
+func (t *Traffic) transfer(tid string, n int, upload bool, done <-chan struct{}) bool {
+	t.mutex.Lock()
+	tt, ok := t.tunnels[tid]
+	if !ok {
+		t.mutex.Unlock()
+		return true
+	}
+	if tt.quota > 0 && tt.used >= tt.quota {
+		t.mutex.Unlock()
+		return false
+	}
+	tt.used += int64(n)
+	tt.pending += int64(n)
+	exceeded := tt.quota > 0 && tt.used >= tt.quota
+	quota, resetAt := tt.quota, tt.resetAt
+	s := &tt.download
+	if upload {
+		s = &tt.upload
+	}
+	wait := s.reserve(n, time.Now())
+	t.mutex.Unlock()
+
+	// 用完配额后的传输会被拒绝, 事件只发布一次
+	if exceeded {
+		t.events.Publish(Event{Type: EventQuotaExceeded, TunnelID: tid, Data: map[string]any{
+			"quota_bytes": quota,
+			"reset_at":    resetAt,
+		}})
+	}
+
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// Run persists the traffic usage and resets the quotas on schedule until the process exits
+func (t *Traffic) Run() {
+	ticker := time.NewTicker(trafficFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.Flush()
+	}
+}
+
+// Flush writes the pending usage of all tunnels to the database
+func (t *Traffic) Flush() {
+	t.mutex.Lock()
+	now := time.Now()
+	pending := map[string]int64{}
+	for tid, tt := range t.tunnels {
+		t.reset(tid, tt, now)
+		if tt.pending > 0 {
+			pending[tid] = tt.pending
+			tt.pending = 0
+		}
+	}
+	t.mutex.Unlock()
+
+	for tid, n := range pending {
+		if err := t.model.AddQuotaUsed(tid, n); err != nil {
+			log.Error().Err(err).Msgf("Failed to save traffic usage of tunnel %s", tid)
+			// 下次再写入
+			t.mutex.Lock()
+			if tt, ok := t.tunnels[tid]; ok {
+				tt.pending += n
+			}
+			t.mutex.Unlock()
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package svc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+func TestShaperReserve(t *testing.T) {
+	now := time.Now()
+	s := shaper{rate: 1000}
+	// 允许一秒的突发流量
+	if wait := s.reserve(1000, now); wait != 0 {
+		t.Fatalf("burst waited %v", wait)
+	}
+	if wait := s.reserve(500, now); wait != 500*time.Millisecond {
+		t.Fatalf("wait = %v, want 500ms", wait)
+	}
+	// 欠下的字节在之后补充的令牌中扣除
+	if wait := s.reserve(500, now.Add(time.Second)); wait != 0 {
+		t.Fatalf("wait after refill = %v", wait)
+	}
+	if wait := (&shaper{}).reserve(1<<30, now); wait != 0 {
+		t.Fatalf("unlimited shaper waited %v", wait)
+	}
+}
+
+func TestTrafficQuota(t *testing.T) {
+	tunnelModel := model.NewTunnelModel(openTestDB(t, &model.Tunnel{}))
+	tunnel := &model.Tunnel{ID: "t1", Name: "t1", Token: "token", QuotaBytes: 100, QuotaUsed: 30}
+	if err := tunnelModel.Insert(tunnel); err != nil {
+		t.Fatal(err)
+	}
+	events := NewEventBus()
+	received, cancel := events.Subscribe(0)
+	defer cancel()
+	traffic := NewTraffic(tunnelModel, events)
+	traffic.Load(tunnel)
+
+	if !traffic.Download("t1", 40, nil) {
+		t.Fatal("transfer within the quota rejected")
+	}
+	if exhausted, _ := traffic.Exhausted("t1"); exhausted {
+		t.Fatal("exhausted before reaching the quota")
+	}
+	// 最后一次传输允许超出配额, 之后的传输被拒绝
+	if !traffic.Upload("t1", 40, nil) {
+		t.Fatal("transfer reaching the quota rejected")
+	}
+	if traffic.Upload("t1", 1, nil) || traffic.Download("t1", 1, nil) {
+		t.Fatal("transfer after the quota allowed")
+	}
+	if exhausted, resetAt := traffic.Exhausted("t1"); !exhausted || !resetAt.IsZero() {
+		t.Fatalf("exhausted = %v, reset at %v", exhausted, resetAt)
+	}
+	select {
+	case event := <-received:
+		if event.Type != EventQuotaExceeded || event.TunnelID != "t1" {
+			t.Fatalf("event = %+v", event)
+		}
+	default:
+		t.Fatal("quota exceeded event not published")
+	}
+	select {
+	case event := <-received:
+		t.Fatalf("unexpected event %+v", event)
+	default:
+	}
+
+	traffic.Flush()
+	saved, err := tunnelModel.GetTunnelByID("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.QuotaUsed != 110 {
+		t.Fatalf("saved usage = %d, want 110", saved.QuotaUsed)
+	}
+	// 重新加载设置不会重复计算已写入的用量
+	traffic.Load(saved)
+	traffic.Flush()
+	if saved, _ = tunnelModel.GetTunnelByID("t1"); saved.QuotaUsed != 110 {
+		t.Fatalf("usage after reload = %d, want 110", saved.QuotaUsed)
+	}
+
+	// 未加载的隧道不受限制
+	if !traffic.Download("t2", 1<<20, nil) {
+		t.Fatal("unknown tunnel limited")
+	}
+	traffic.Remove("t1")
+	if exhausted, _ := traffic.Exhausted("t1"); exhausted {
+		t.Fatal("removed tunnel still exhausted")
+	}
+}
+
+func TestTrafficQuotaReset(t *testing.T) {
+	tunnelModel := model.NewTunnelModel(openTestDB(t, &model.Tunnel{}))
+	tunnel := &model.Tunnel{ID: "t1", Name: "t1", Token: "token", QuotaBytes: 100, QuotaPeriod: model.QuotaDaily,
+		QuotaUsed: 100, QuotaResetAt: time.Now().Add(-time.Minute).Unix()}
+	if err := tunnelModel.Insert(tunnel); err != nil {
+		t.Fatal(err)
+	}
+	traffic := NewTraffic(tunnelModel, NewEventBus())
+	traffic.Load(tunnel)
+
+	// 重置时间已过, 新周期从 0 开始
+	if exhausted, _ := traffic.Exhausted("t1"); exhausted {
+		t.Fatal("quota not reset")
+	}
+	saved, err := tunnelModel.GetTunnelByID("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := model.NextQuotaReset(model.QuotaDaily, time.Now())
+	if saved.QuotaUsed != 0 || saved.QuotaResetAt != want {
+		t.Fatalf("saved usage %d reset at %d, want 0 and %d", saved.QuotaUsed, saved.QuotaResetAt, want)
+	}
+	if !traffic.Download("t1", 100, nil) {
+		t.Fatal("transfer in the new period rejected")
+	}
+	if exhausted, resetAt := traffic.Exhausted("t1"); !exhausted || resetAt.Unix() != want {
+		t.Fatalf("exhausted = %v, reset at %v", exhausted, resetAt)
+	}
+}
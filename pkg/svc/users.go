@@ -0,0 +1,90 @@
+package svc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/obud-dev/tunnel/pkg/config"
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/utils"
+)
+
+const (
+	DefaultAdminUser     = "admin"
+	DefaultAdminPassword = "123456" // 只有开启 AllowDefaultCredentials 时才能使用
+)
+
+// 用户名不存在时也比较一次密码, 使响应时间不暴露用户名是否存在
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := utils.HashPassword(DefaultAdminPassword)
+	return hash
+})
+
+// bootstrapAdmin creates the first admin from the configured User and Password when there are
+// no users yet. It refuses to continue while the admin user has the default password, unless
+// AllowDefaultCredentials is set
+func bootstrapAdmin(config config.ServerConfig, userModel model.UserModel) error {
+	count, err := userModel.Count()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		username, password := config.User, config.Password
+		if username == "" {
+			username = DefaultAdminUser
+		}
+		if password == "" {
+			if !config.AllowDefaultCredentials {
+				return errors.New("no API users exist, set User and Password to create the first admin")
+			}
+			password = DefaultAdminPassword
+		}
+		hash, err := utils.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		if err := userModel.Insert(&model.User{ID: utils.GenerateID(), Username: username, Password: hash, Admin: true}); err != nil {
+			return err
+		}
+		log.Info().Msgf("Created admin user %s", username)
+	} else if config.Password != "" {
+		log.Info().Msg("Users exist, User and Password are only used to create the first admin")
+	}
+
+	// 默认账号可能是之前允许时创建的, 每次启动都检查
+	user, err := userModel.GetUserByUsername(DefaultAdminUser)
+	if err != nil || !utils.CheckPassword(user.Password, DefaultAdminPassword) {
+		return nil
+	}
+	if !config.AllowDefaultCredentials {
+		return errors.New("user admin has the default password, change it or set AllowDefaultCredentials=true")
+	}
+	log.Warn().Msg("User admin has the default password, change it before exposing the API")
+	return nil
+}
+
+// Authenticate checks API credentials against the users table. A successful bcrypt check is
+// remembered together with the password hash of the user, so changing the password forgets it
+func (ctx *ServerCtx) Authenticate(username, password string) (*model.User, bool) {
+	user, err := ctx.UserModel.GetUserByUsername(username)
+	if err != nil {
+		utils.CheckPassword(dummyPasswordHash(), password)
+		return nil, false
+	}
+	key := sha256.Sum256([]byte(user.Password + "\x00" + password))
+	if v, ok := ctx.authenticated.Load(user.ID); ok {
+		verified := v.([sha256.Size]byte)
+		if subtle.ConstantTimeCompare(verified[:], key[:]) == 1 {
+			return user, true
+		}
+	}
+	if !utils.CheckPassword(user.Password, password) {
+		return nil, false
+	}
+	ctx.authenticated.Store(user.ID, key)
+	return user, true
+}
@@ -0,0 +1,92 @@
+package svc
+
+import (
+	"testing"
+
+	"github.com/obud-dev/tunnel/pkg/config"
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/utils"
+)
+
+func TestBootstrapAdmin(t *testing.T) {
+	newUserModel := func() model.UserModel {
+		return model.NewUserModel(openTestDB(t, &model.User{}))
+	}
+
+	// 配置的账号成为第一个管理员
+	users := newUserModel()
+	if err := bootstrapAdmin(config.ServerConfig{User: "root", Password: "s3cret"}, users); err != nil {
+		t.Fatal(err)
+	}
+	user, err := users.GetUserByUsername("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Admin || user.Password == "s3cret" || !utils.CheckPassword(user.Password, "s3cret") {
+		t.Fatalf("bootstrapped user = %+v", user)
+	}
+	// 已有用户时不再创建
+	if err := bootstrapAdmin(config.ServerConfig{User: "other", Password: "other"}, users); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := users.Count(); n != 1 {
+		t.Fatalf("%d users after restart, want 1", n)
+	}
+
+	// 未配置密码时拒绝启动, 除非允许默认账号
+	if err := bootstrapAdmin(config.ServerConfig{}, newUserModel()); err == nil {
+		t.Fatal("started without credentials")
+	}
+	users = newUserModel()
+	if err := bootstrapAdmin(config.ServerConfig{AllowDefaultCredentials: true}, users); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.GetUserByUsername(DefaultAdminUser); err != nil {
+		t.Fatal(err)
+	}
+	// 之前创建的默认账号在不再允许时拒绝启动
+	if err := bootstrapAdmin(config.ServerConfig{}, users); err == nil {
+		t.Fatal("started with the default admin password")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	users := model.NewUserModel(openTestDB(t, &model.User{}))
+	hash, err := utils.HashPassword("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Insert(&model.User{ID: "u1", Username: "alice", Password: hash}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &ServerCtx{UserModel: users}
+
+	for _, tc := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"alice", "first", true},
+		{"alice", "first", true}, // 使用缓存的验证结果
+		{"alice", "wrong", false},
+		{"bob", "first", false},
+	} {
+		if user, ok := ctx.Authenticate(tc.username, tc.password); ok != tc.ok || ok && user.ID != "u1" {
+			t.Errorf("Authenticate(%s, %s) = %v, %v", tc.username, tc.password, user, ok)
+		}
+	}
+
+	// 修改密码后旧密码的缓存失效
+	user, _ := users.GetUserByID("u1")
+	if user.Password, err = utils.HashPassword("second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Update(user); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ctx.Authenticate("alice", "first"); ok {
+		t.Error("old password accepted after the change")
+	}
+	if _, ok := ctx.Authenticate("alice", "second"); !ok {
+		t.Error("new password rejected")
+	}
+}
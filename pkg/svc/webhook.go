@@ -0,0 +1,260 @@
+package svc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/utils"
+)
+
+const (
+	EventWebhookPing = "webhook.ping" // 测试 Webhook 时发送的事件
+
+	webhookAttempts      = 6                  // 每个事件最多发送的次数
+	webhookBackoff       = 2 * time.Second    // 第一次重试前的等待时间, 之后每次加倍
+	webhookTimeout       = 10 * time.Second   // 等待接收方响应的时间
+	webhookRetention     = 7 * 24 * time.Hour // 发送记录保留时间
+	webhookCleanInterval = time.Hour          // 清理过期发送记录的间隔
+)
+
+// WebhookPayload is the request body of a webhook delivery
+type WebhookPayload struct {
+	Event
+	TunnelName string `json:"tunnel_name,omitempty"` // 事件所属隧道的名称
+}
+
+// Webhooks sends the server events to the subscribed webhooks. Every delivery is a POST of
+// the JSON payload with the headers
+//
+//	X-Tunnel-Event: the event type
+//	X-Tunnel-Delivery: the delivery ID, the same for all attempts
+//	X-Tunnel-Timestamp: unix seconds of the attempt
+//	X-Tunnel-Signature: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+//
+// Failed attempts, including non-2xx responses, are retried with exponential backoff
+type Webhooks struct {
+	model   model.WebhookModel
+	tunnels model.TunnelModel
+	events  *EventBus
+	client  *http.Client
+}
+
+func NewWebhooks(webhookModel model.WebhookModel, tunnelModel model.TunnelModel, events *EventBus) *Webhooks {
+	return &Webhooks{
+		model:   webhookModel,
+		tunnels: tunnelModel,
+		events:  events,
+		client:  &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Run delivers the published events to the subscribed webhooks until the process exits
+func (w *Webhooks) Run() {
+	// 继续发送服务重启前未完成的事件
+	pending, err := w.model.GetPendingDeliveries()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load pending webhook deliveries")
+	}
+	for i := range pending {
+		go w.deliver(&pending[i])
+	}
+
+	var last int64
+	events, _ := w.events.Subscribe(0)
+	ticker := time.NewTicker(webhookCleanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// 处理不及时被断开, 从最后处理的事件继续
+				events, _ = w.events.Subscribe(last)
+				continue
+			}
+			// 事件序号连续, 重新订阅时最近的事件中已不包含 last 之后的事件
+			if last > 0 && event.ID > last+1 {
+				log.Warn().Msgf("Webhooks fell behind, events %d to %d were not delivered", last+1, event.ID-1)
+			}
+			last = event.ID
+			w.dispatch(event)
+		case <-ticker.C:
+			if err := w.model.DeleteDeliveriesBefore(time.Now().Add(-webhookRetention).Unix()); err != nil {
+				log.Error().Err(err).Msg("Failed to remove expired webhook deliveries")
+			}
+		}
+	}
+}
+
+// dispatch records a delivery of the event for each enabled webhook subscribed to it
+func (w *Webhooks) dispatch(event Event) {
+	webhooks, err := w.model.GetWebhooks()
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to load webhooks for event %s", event.Type)
+		return
+	}
+	var payload string
+	for _, webhook := range webhooks {
+		if webhook.Disabled || !MatchEventType(event.Type, webhook.Events) {
+			continue
+		}
+		if payload == "" {
+			if payload, err = w.payload(event); err != nil {
+				log.Error().Err(err).Msgf("Failed to encode event %s", event.Type)
+				return
+			}
+		}
+		delivery, err := w.newDelivery(webhook.ID, event.Type, payload)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to save delivery of webhook %s", webhook.ID)
+			continue
+		}
+		go w.deliver(delivery)
+	}
+}
+
+// payload encodes the event with the name of its tunnel
+func (w *Webhooks) payload(event Event) (string, error) {
+	p := WebhookPayload{Event: event}
+	if event.TunnelID != "" {
+		if tunnel, err := w.tunnels.GetTunnelByID(event.TunnelID); err == nil {
+			p.TunnelName = tunnel.Name
+		}
+	}
+	data, err := json.Marshal(p)
+	return string(data), err
+}
+
+func (w *Webhooks) newDelivery(webhookID, eventType, payload string) (*model.WebhookDelivery, error) {
+	delivery := &model.WebhookDelivery{
+		ID:        utils.GenerateID(),
+		WebhookID: webhookID,
+		EventType: eventType,
+		Payload:   payload,
+		Status:    model.DeliveryPending,
+	}
+	return delivery, w.model.InsertDelivery(delivery)
+}
+
+// Ping sends a test event to the webhook even when it is disabled and returns the result
+// of the first attempt, failed attempts are retried in the background
+func (w *Webhooks) Ping(webhook *model.Webhook) (*model.WebhookDelivery, error) {
+	payload, err := w.payload(Event{
+		Type: EventWebhookPing,
+		Time: time.Now(),
+		Data: map[string]any{"webhook_id": webhook.ID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w.send(webhook.ID, EventWebhookPing, payload)
+}
+
+// Redeliver sends the payload of a previous delivery again as a new delivery and returns
+// the result of the first attempt, failed attempts are retried in the background
+func (w *Webhooks) Redeliver(delivery *model.WebhookDelivery) (*model.WebhookDelivery, error) {
+	return w.send(delivery.WebhookID, delivery.EventType, delivery.Payload)
+}
+
+func (w *Webhooks) send(webhookID, eventType, payload string) (*model.WebhookDelivery, error) {
+	delivery, err := w.newDelivery(webhookID, eventType, payload)
+	if err != nil {
+		return nil, err
+	}
+	w.attempt(delivery, true)
+	result := *delivery
+	if delivery.Status == model.DeliveryPending {
+		go w.deliver(delivery)
+	}
+	return &result, nil
+}
+
+// deliver retries the delivery until it succeeds or runs out of attempts
+func (w *Webhooks) deliver(delivery *model.WebhookDelivery) {
+	for delivery.Status == model.DeliveryPending {
+		if wait := time.Until(time.Unix(delivery.NextAt, 0)); wait > 0 {
+			time.Sleep(wait)
+		}
+		w.attempt(delivery, false)
+	}
+}
+
+// attempt sends the delivery once and saves the result. The webhook is loaded for every
+// attempt so that retries use its current URL and secret, force sends to disabled webhooks
+func (w *Webhooks) attempt(delivery *model.WebhookDelivery, force bool) {
+	webhook, err := w.model.GetWebhookByID(delivery.WebhookID)
+	switch {
+	case err != nil:
+		// webhook 已删除, 发送记录也随之删除
+		delivery.Status = model.DeliveryFailed
+		return
+	case webhook.Disabled && !force:
+		delivery.Status, delivery.Error, delivery.NextAt = model.DeliveryFailed, "webhook disabled", 0
+	default:
+		start := time.Now()
+		delivery.Attempts++
+		delivery.StatusCode, err = w.post(webhook, delivery)
+		delivery.Duration = float64(time.Since(start).Microseconds()) / 1000
+		delivery.Error = ""
+		if err == nil && delivery.StatusCode >= 200 && delivery.StatusCode < 300 {
+			delivery.Status, delivery.NextAt = model.DeliverySuccess, 0
+			break
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		} else {
+			delivery.Error = fmt.Sprintf("unexpected status %d", delivery.StatusCode)
+		}
+		if delivery.Attempts >= webhookAttempts {
+			delivery.Status, delivery.NextAt = model.DeliveryFailed, 0
+			log.Warn().Msgf("Giving up delivery %s of webhook %s: %s", delivery.ID, webhook.ID, delivery.Error)
+		} else {
+			delivery.NextAt = time.Now().Add(webhookBackoff << (delivery.Attempts - 1)).Unix()
+		}
+	}
+	if err := w.model.UpdateDelivery(delivery); err != nil {
+		log.Error().Err(err).Msgf("Failed to save delivery %s of webhook %s", delivery.ID, delivery.WebhookID)
+	}
+}
+
+// post sends the signed payload and returns the response status
+func (w *Webhooks) post(webhook *model.Webhook, delivery *model.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.Url, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tunnel-webhook")
+	req.Header.Set("X-Tunnel-Event", delivery.EventType)
+	req.Header.Set("X-Tunnel-Delivery", delivery.ID)
+	req.Header.Set("X-Tunnel-Timestamp", timestamp)
+	req.Header.Set("X-Tunnel-Signature", "sha256="+SignWebhook(webhook.Secret, timestamp, []byte(delivery.Payload)))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// 读完响应以复用连接
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// SignWebhook returns the hex encoded HMAC-SHA256 of the timestamp and body joined by a dot,
+// receivers compute the same value to verify a delivery
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
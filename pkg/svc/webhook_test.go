@@ -0,0 +1,110 @@
+package svc
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+func TestSignWebhook(t *testing.T) {
+	// echo -n '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	const want = "b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+	if got := SignWebhook("secret", "1700000000", []byte("{}")); got != want {
+		t.Fatalf("signature = %s, want %s", got, want)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	const secret = "webhook-secret"
+	var requests atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get("X-Tunnel-Timestamp")
+		if r.Header.Get("X-Tunnel-Signature") != "sha256="+SignWebhook(secret, timestamp, body) {
+			t.Errorf("invalid signature %q", r.Header.Get("X-Tunnel-Signature"))
+		}
+		if r.Header.Get("X-Tunnel-Event") == "" || r.Header.Get("X-Tunnel-Delivery") == "" {
+			t.Errorf("headers = %v", r.Header)
+		}
+		// 第一次失败, 之后成功
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	db := openTestDB(t, &model.Webhook{}, &model.WebhookDelivery{}, &model.Tunnel{})
+	webhookModel := model.NewWebhookModel(db)
+	webhook := &model.Webhook{ID: "w1", Url: receiver.URL, Secret: secret, Events: []string{"tunnel"}}
+	if err := webhookModel.Insert(webhook); err != nil {
+		t.Fatal(err)
+	}
+	tunnelModel := model.NewTunnelModel(db)
+	if err := tunnelModel.Insert(&model.Tunnel{ID: "t1", Name: "office", Token: "token"}); err != nil {
+		t.Fatal(err)
+	}
+	w := NewWebhooks(webhookModel, tunnelModel, NewEventBus())
+
+	w.dispatch(Event{ID: 1, Type: EventRouteCreated, Time: time.Now()})
+	if deliveries, _ := webhookModel.GetDeliveries(webhook.ID, 10); len(deliveries) != 0 {
+		t.Fatalf("unsubscribed event delivered: %+v", deliveries)
+	}
+
+	payload, err := w.payload(Event{ID: 2, Type: EventTunnelOffline, Time: time.Now(), TunnelID: "t1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(payload, `"tunnel_name":"office"`) {
+		t.Fatalf("payload = %s", payload)
+	}
+	delivery, err := w.newDelivery(webhook.ID, EventTunnelOffline, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.attempt(delivery, false)
+	saved, err := webhookModel.GetDeliveryByID(webhook.ID, delivery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != model.DeliveryPending || saved.Attempts != 1 || saved.StatusCode != http.StatusServiceUnavailable ||
+		saved.Error == "" || saved.NextAt < time.Now().Unix() {
+		t.Fatalf("after non-2xx response: %+v", saved)
+	}
+
+	// 重试成功后清除错误
+	w.attempt(delivery, false)
+	if saved, err = webhookModel.GetDeliveryByID(webhook.ID, delivery.ID); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != model.DeliverySuccess || saved.Attempts != 2 || saved.StatusCode != http.StatusOK ||
+		saved.Error != "" || saved.NextAt != 0 {
+		t.Fatalf("after retry: %+v", saved)
+	}
+
+	// 停用的 webhook 不再重试, 但仍可以测试发送
+	webhook.Disabled = true
+	if err := webhookModel.Update(webhook); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := w.newDelivery(webhook.ID, EventTunnelOffline, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.attempt(pending, false)
+	if pending.Status != model.DeliveryFailed || pending.Attempts != 0 {
+		t.Fatalf("delivery to disabled webhook: %+v", pending)
+	}
+	ping, err := w.Ping(webhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping.Status != model.DeliverySuccess || requests.Load() != 3 {
+		t.Fatalf("ping: %+v after %d requests", ping, requests.Load())
+	}
+}
@@ -0,0 +1,87 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 服务端和客户端共用的 OpenTelemetry 追踪, 未配置导出地址时 span 不会被记录,
+// 但访客请求携带的 trace context 仍会传递到目标服务
+
+// Tracer creates the spans of the server and clientd
+var Tracer = otel.Tracer("github.com/obud-dev/tunnel")
+
+// Propagator reads and writes the W3C traceparent and tracestate headers
+var Propagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// Init exports the spans of service to the OTLP/HTTP collector at endpoint, e.g.
+// http://127.0.0.1:4318. The returned function flushes the pending spans on shutdown
+func Init(service string, endpoint string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(Propagator)
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid trace endpoint: %s", endpoint)
+	}
+	// 未指定路径时使用 OTLP 默认路径
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Inject encodes the trace context of ctx for the frame metadata, it returns nil when ctx
+// carries no span
+func Inject(ctx context.Context) []byte {
+	carrier := propagation.MapCarrier{}
+	Propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(carrier)
+	return data
+}
+
+// Extract returns ctx with the remote span context encoded by Inject
+func Extract(ctx context.Context, data []byte) context.Context {
+	if len(data) == 0 {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{}
+	if err := json.Unmarshal(data, &carrier); err != nil {
+		return ctx
+	}
+	return Propagator.Extract(ctx, carrier)
+}
+
+// End records err on span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/utils"
+)
+
+// allowIP checks the address rules of the access policy, deny rules win over allow rules
+func allowIP(policy model.AccessPolicy, ip net.IP) bool {
+	if len(policy.Allow) == 0 && len(policy.Deny) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if matchIP(policy.Deny, ip) {
+		return false
+	}
+	return len(policy.Allow) == 0 || matchIP(policy.Allow, ip)
+}
+
+// matchIP reports whether ip is in one of the IP or CIDR entries
+func matchIP(entries []string, ip net.IP) bool {
+	for _, entry := range entries {
+		ipNet, err := utils.ParseIPNet(entry)
+		if err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the visitor IP of an HTTP request
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return net.ParseIP(r.RemoteAddr)
+	}
+	return net.ParseIP(host)
+}
+
+// authorize checks the access policy of the route for an HTTP request, it returns 0 when the
+// request may be forwarded and otherwise the status to answer with. The credential that
+// authenticated the request is removed so it is not passed on to the target
+func (s *TcpServer) authorize(route *model.Route, r *http.Request) int {
+	policy := route.Access
+	if !allowIP(policy, remoteIP(r)) {
+		return http.StatusForbidden
+	}
+	if policy.Oidc != nil {
+		// 访客不能自行提供身份头部
+		for _, header := range oidcIdentityHeaders {
+			r.Header.Del(header)
+		}
+	}
+	if len(policy.BasicAuth) == 0 && len(policy.Tokens) == 0 && policy.Oidc == nil {
+		return 0
+	}
+	if policy.Oidc != nil {
+		if identity := s.oidcSession(route, r); identity != nil {
+			setIdentityHeaders(r, identity)
+			return 0
+		}
+	}
+	if user, password, ok := r.BasicAuth(); ok && checkBasicAuth(&s.authCache, policy.BasicAuth, user, password) {
+		r.Header.Del("Authorization")
+		return 0
+	}
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") && checkTokens(policy.Tokens, token) {
+		r.Header.Del("Authorization")
+		return 0
+	}
+	if key := r.Header.Get("X-Api-Key"); key != "" && checkTokens(policy.Tokens, key) {
+		r.Header.Del("X-Api-Key")
+		return 0
+	}
+	return http.StatusUnauthorized
+}
+
+// checkBasicAuth verifies the credentials against the user:hash accounts. Verified credentials
+// are cached since bcrypt is too slow to run on every request
+func checkBasicAuth(cache *sync.Map, accounts []string, user, password string) bool {
+	for _, account := range accounts {
+		name, hash, _ := strings.Cut(account, ":")
+		if name != user {
+			continue
+		}
+		sum := sha256.Sum256([]byte(password))
+		key := account + "\x00" + string(sum[:])
+		if _, ok := cache.Load(key); ok {
+			return true
+		}
+		if utils.CheckPassword(hash, password) {
+			cache.Store(key, struct{}{})
+			return true
+		}
+	}
+	return false
+}
+
+// checkTokens reports whether token matches one of the token hashes
+func checkTokens(hashes []string, token string) bool {
+	for _, hash := range hashes {
+		if utils.CheckToken(hash, token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"gorm.io/gorm"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+// acmeCache keeps autocert account keys and certificates in the database
+type acmeCache struct {
+	model model.AcmeCacheModel
+}
+
+func (c *acmeCache) Get(_ context.Context, key string) ([]byte, error) {
+	item, err := c.model.Get(key)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.Data, nil
+}
+
+func (c *acmeCache) Put(_ context.Context, key string, data []byte) error {
+	return c.model.Put(&model.AcmeCache{Key: key, Data: data})
+}
+
+func (c *acmeCache) Delete(_ context.Context, key string) error {
+	return c.model.Delete(key)
+}
+
+// NewCertManager creates the ACME certificate manager for route hostnames. Certificates
+// are obtained with the tls-alpn-01 challenge on the public HTTPS listener and renewed
+// before they expire
+func NewCertManager(ctx *svc.ServerCtx) (*autocert.Manager, error) {
+	manager := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  &acmeCache{model: ctx.AcmeCacheModel},
+		Email:  ctx.Config.AcmeEmail,
+		HostPolicy: func(_ context.Context, host string) error {
+			ctx.Mutex.Lock()
+			route := ctx.MatchRoute(host)
+			ctx.Mutex.Unlock()
+			// 透传路由的 TLS 由目标服务自己终止
+			if route != nil && route.Protocol != model.TypeTlsPassthrough {
+				return nil
+			}
+			return fmt.Errorf("no route for host %q", host)
+		},
+	}
+
+	directory := ctx.Config.AcmeDirectory
+	if directory == "" {
+		directory = autocert.DefaultACMEDirectory
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// 自定义 ACME 服务 (如测试用的 Pebble) 使用的 HTTPS 证书
+	if ctx.Config.AcmeCA != "" {
+		data, err := os.ReadFile(ctx.Config.AcmeCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read acme ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in acme ca %s", ctx.Config.AcmeCA)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	manager.Client = &acme.Client{
+		DirectoryURL: directory,
+		HTTPClient: &http.Client{
+			Transport: &orderLocationTransport{base: transport, orders: map[string]string{}},
+		},
+	}
+	return manager, nil
+}
+
+// orderLocationTransport fills in the Location header some ACME servers (such as Pebble)
+// omit on finalize responses, x/crypto/acme needs it to poll the order until it is valid
+type orderLocationTransport struct {
+	base   http.RoundTripper
+	mutex  sync.Mutex
+	orders map[string]string // finalize URL -> order URL
+}
+
+func (t *orderLocationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	var order struct {
+		Finalize string `json:"finalize"`
+	}
+	if json.Unmarshal(body, &order) != nil || order.Finalize == "" {
+		return resp, nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if location := resp.Header.Get("Location"); location != "" {
+		t.orders[order.Finalize] = location
+	} else if location, ok := t.orders[order.Finalize]; ok {
+		resp.Header.Set("Location", location)
+	}
+	return resp, nil
+}
+
+// isAcmeChallenge reports whether the handshake is a tls-alpn-01 validation request
+func isAcmeChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
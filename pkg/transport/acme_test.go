@@ -0,0 +1,132 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/obud-dev/tunnel/pkg/config"
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+// roundTripFunc answers requests with a function
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func jsonResponse(body string, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json")
+	return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(strings.NewReader(body))}
+}
+
+func TestOrderLocationTransport(t *testing.T) {
+	const order = `{"status":"processing","finalize":"https://ca/finalize/1"}`
+	transport := &orderLocationTransport{orders: map[string]string{}, base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/new-order":
+			return jsonResponse(order, http.Header{"Location": {"https://ca/order/1"}}), nil
+		case "/finalize/1":
+			// 与 Pebble 一样 finalize 响应不带 Location
+			return jsonResponse(order, nil), nil
+		}
+		return jsonResponse(`{"status":"valid"}`, nil), nil
+	})}
+	post := func(url string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader("{}"))
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if len(body) == 0 {
+			t.Fatalf("%s: response body was consumed", url)
+		}
+		return resp
+	}
+
+	if location := post("https://ca/new-order").Header.Get("Location"); location != "https://ca/order/1" {
+		t.Fatalf("new-order Location = %q", location)
+	}
+	if location := post("https://ca/finalize/1").Header.Get("Location"); location != "https://ca/order/1" {
+		t.Fatalf("finalize Location = %q, want the order URL", location)
+	}
+	if location := post("https://ca/other").Header.Get("Location"); location != "" {
+		t.Fatalf("unrelated response got Location %q", location)
+	}
+}
+
+func newAcmeTestCtx(t *testing.T, conf config.ServerConfig) *svc.ServerCtx {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.AcmeCache{}); err != nil {
+		t.Fatal(err)
+	}
+	return &svc.ServerCtx{
+		Config:         conf,
+		AcmeCacheModel: model.NewAcmeCacheModel(db),
+		Routes: []model.Route{
+			{ID: "r1", Hostname: "app.example.com", Protocol: model.TypeHttp},
+			{ID: "r2", Hostname: "passthrough.example.com", Protocol: model.TypeTlsPassthrough},
+		},
+	}
+}
+
+func TestCertManagerHostPolicy(t *testing.T) {
+	manager, err := NewCertManager(newAcmeTestCtx(t, config.ServerConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, ok := range map[string]bool{
+		"app.example.com":         true,
+		"passthrough.example.com": false,
+		"unknown.example.com":     false,
+	} {
+		if err := manager.HostPolicy(context.Background(), host); (err == nil) != ok {
+			t.Errorf("HostPolicy(%s) = %v", host, err)
+		}
+	}
+}
+
+// TestCertManagerPebble obtains a certificate from a Pebble server, which omits the Location
+// header of finalize responses. It runs when PEBBLE_DIRECTORY is set, e.g.
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json
+//	PEBBLE_DIRECTORY=https://localhost:14000/dir PEBBLE_CA=test/certs/pebble.minica.pem go test -run Pebble ./pkg/transport
+func TestCertManagerPebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY is not set")
+	}
+	manager, err := NewCertManager(newAcmeTestCtx(t, config.ServerConfig{
+		AcmeDirectory: directory,
+		AcmeCA:        os.Getenv("PEBBLE_CA"),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := manager.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:   "app.example.com",
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("app.example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,45 @@
+package transport
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff produces capped exponential delays with jitter between reconnect attempts
+type Backoff struct {
+	Min     time.Duration // 首次重连等待时间
+	Max     time.Duration // 重连等待时间上限
+	Factor  float64       // 每次重连等待时间的增长倍数
+	Jitter  float64       // 随机抖动比例 (0~1)，避免大量客户端同时重连
+	attempt int
+}
+
+// NewBackoff creates a backoff with the default client reconnect settings
+func NewBackoff() *Backoff {
+	return &Backoff{
+		Min:    reconnectMinInterval,
+		Max:    reconnectMaxInterval,
+		Factor: 2,
+		Jitter: 0.5,
+	}
+}
+
+// Next returns the delay before the next attempt and advances the attempt counter
+func (b *Backoff) Next() time.Duration {
+	d := float64(b.Min) * math.Pow(b.Factor, float64(b.attempt))
+	if d > float64(b.Max) || math.IsInf(d, 0) {
+		d = float64(b.Max)
+	}
+	b.attempt++
+	if b.Jitter > 0 {
+		// 在 [d*(1-jitter), d] 区间内随机取值
+		d -= d * b.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// Reset starts the delay sequence over, used after a connection has been established
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
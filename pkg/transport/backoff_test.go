@@ -0,0 +1,36 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &Backoff{Min: time.Second, Max: 10 * time.Second, Factor: 2}
+	for _, want := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		if got := b.Next(); got != want*time.Second {
+			t.Fatalf("delay = %v, want %v", got, want*time.Second)
+		}
+	}
+	b.Reset()
+	if got := b.Next(); got != time.Second {
+		t.Fatalf("delay after reset = %v", got)
+	}
+
+	// 大量重连后不会溢出
+	b.attempt = 5000
+	if got := b.Next(); got != 10*time.Second {
+		t.Fatalf("delay after many attempts = %v", got)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := NewBackoff()
+	base := reconnectMinInterval * 8
+	for i := 0; i < 100; i++ {
+		b.attempt = 3
+		if got := b.Next(); got > base || got < base/2 {
+			t.Fatalf("delay %v outside [%v, %v]", got, base/2, base)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/obud-dev/tunnel/pkg/message"
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+// 内置错误页面模板，可通过 /api/errorpages 按服务或路由覆盖
+const (
+	defaultHtmlErrorPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`
+	defaultJsonErrorPage = `{"status":{{.Status}},"error":{{json .StatusText}},"message":{{json .Message}},"host":{{json .Host}}}`
+)
+
+// 内置模板在启动时解析一次
+var (
+	defaultHtmlTemplate = mustParseErrorTemplate(model.FormatHtml, defaultHtmlErrorPage)
+	defaultJsonTemplate = mustParseErrorTemplate(model.FormatJson, defaultJsonErrorPage)
+)
+
+func mustParseErrorTemplate(format model.ErrorPageFormat, text string) svc.ErrorTemplate {
+	tmpl, err := svc.ParseErrorTemplate(format, text)
+	if err != nil {
+		panic(err)
+	}
+	return tmpl
+}
+
+// errorPageData is the data available to error page templates
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Message    string
+	Host       string
+	Path       string
+	RouteID    string
+}
+
+// errorMessages are the default visitor-facing explanations of each status
+var errorMessages = map[int]string{
+	http.StatusUnauthorized:       "Authentication is required to access this host.",
+	http.StatusForbidden:          "Access to the target service is denied.",
+	http.StatusNotFound:           "No route is configured for this host.",
+	http.StatusTooManyRequests:    "Too many requests, please slow down and retry later.",
+	http.StatusBadGateway:         "The tunnel serving this host is offline.",
+	http.StatusServiceUnavailable: "The tunnel serving this host is reconnecting, please retry later.",
+	http.StatusGatewayTimeout:     "The target service did not respond in time.",
+}
+
+// errorStatus maps client error frames to the status returned to the visitor
+var errorStatus = map[message.ErrorCode]int{
+	message.ErrorDialRefused:  http.StatusBadGateway,
+	message.ErrorTimeout:      http.StatusGatewayTimeout,
+	message.ErrorTls:          http.StatusBadGateway,
+	message.ErrorPolicyDenied: http.StatusForbidden,
+}
+
+// errorCodeMessages are the visitor-facing explanations of client error frames,
+// the raw error is only recorded against the route since it exposes internal addresses
+var errorCodeMessages = map[message.ErrorCode]string{
+	message.ErrorDialRefused:  "The target service refused the connection.",
+	message.ErrorTimeout:      "The target service did not respond in time.",
+	message.ErrorTls:          "The TLS handshake with the target service failed.",
+	message.ErrorPolicyDenied: "The tunnel client is not allowed to reach the target service.",
+}
+
+// ParseErrorPage checks that an error page template can be rendered
+func ParseErrorPage(page *model.ErrorPage) error {
+	if page.Format != model.FormatHtml && page.Format != model.FormatJson {
+		return fmt.Errorf("unknown error page format: %s", page.Format)
+	}
+	if http.StatusText(page.Status) == "" || page.Status < 400 {
+		return fmt.Errorf("invalid error status: %d", page.Status)
+	}
+	tmpl, err := svc.ParseErrorTemplate(page.Format, page.Template)
+	if err != nil {
+		return err
+	}
+	// html/template 在执行时才检查转义上下文
+	return tmpl.Execute(io.Discard, errorPageData{Status: page.Status, StatusText: http.StatusText(page.Status)})
+}
+
+// findErrorPage selects the template for the status, preferring the route page over the server page
+func findErrorPage(pages []svc.LoadedErrorPage, routeID string, status int, format model.ErrorPageFormat) svc.ErrorTemplate {
+	var tmpl svc.ErrorTemplate
+	for _, page := range pages {
+		if page.Status != status || page.Format != format {
+			continue
+		}
+		if routeID != "" && page.RouteID == routeID {
+			return page.Tmpl
+		}
+		if page.RouteID == "" {
+			tmpl = page.Tmpl
+		}
+	}
+	if tmpl != nil {
+		return tmpl
+	}
+	if format == model.FormatJson {
+		return defaultJsonTemplate
+	}
+	return defaultHtmlTemplate
+}
+
+// renderErrorPage renders the error body for the status, picking html or json by the Accept header
+func renderErrorPage(pages []svc.LoadedErrorPage, route *model.Route, req *http.Request, status int, message string) (string, []byte) {
+	format := model.FormatHtml
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+	}
+	if data.Message == "" {
+		data.Message = errorMessages[status]
+	}
+	if req != nil {
+		if strings.Contains(req.Header.Get("Accept"), "application/json") {
+			format = model.FormatJson
+		}
+		data.Host = req.Host
+		data.Path = req.URL.Path
+	}
+	if route != nil {
+		data.RouteID = route.ID
+	}
+
+	var body bytes.Buffer
+	if err := findErrorPage(pages, data.RouteID, status, format).Execute(&body, data); err != nil {
+		// 自定义模板出错时退回纯文本
+		return "text/plain; charset=utf-8", []byte(data.StatusText)
+	}
+	if format == model.FormatJson {
+		return "application/json; charset=utf-8", body.Bytes()
+	}
+	return "text/html; charset=utf-8", body.Bytes()
+}
@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+func TestRenderErrorPageEscapesHtml(t *testing.T) {
+	page := model.ErrorPage{
+		Status:   http.StatusNotFound,
+		Format:   model.FormatHtml,
+		Template: `<p>{{.Host}}{{.Path}}</p><a href="{{.Path}}">retry</a>`,
+	}
+	tmpl, err := svc.ParseErrorTemplate(page.Format, page.Template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := []svc.LoadedErrorPage{{ErrorPage: page, Tmpl: tmpl}}
+	r := httptest.NewRequest(http.MethodGet, "/x", nil)
+	r.Host = `<script>alert(1)</script>`
+	r.URL.Path = `/"><img src=x onerror=alert(1)>`
+
+	for _, p := range [][]svc.LoadedErrorPage{nil, pages} {
+		contentType, body := renderErrorPage(p, nil, r, http.StatusNotFound, "<b>msg</b>")
+		if contentType != "text/html; charset=utf-8" {
+			t.Fatalf("content type = %q", contentType)
+		}
+		for _, raw := range []string{"<script>", "<img", "<b>"} {
+			if strings.Contains(string(body), raw) {
+				t.Errorf("body contains unescaped %q: %s", raw, body)
+			}
+		}
+	}
+}
+
+func TestRenderErrorPageJson(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/x", nil)
+	r.Host = `"quoted"`
+	r.Header.Set("Accept", "application/json")
+	contentType, body := renderErrorPage(nil, nil, r, http.StatusBadGateway, "")
+	if contentType != "application/json; charset=utf-8" {
+		t.Fatalf("content type = %q", contentType)
+	}
+	var page struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+		Host    string `json:"host"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatalf("invalid json %s: %v", body, err)
+	}
+	if page.Status != http.StatusBadGateway || page.Host != `"quoted"` || page.Message != errorMessages[http.StatusBadGateway] {
+		t.Errorf("page = %+v", page)
+	}
+}
+
+func TestParseErrorPage(t *testing.T) {
+	for _, tc := range []struct {
+		page model.ErrorPage
+		ok   bool
+	}{
+		{model.ErrorPage{Status: 404, Format: model.FormatHtml, Template: "<p>{{.Message}}</p>"}, true},
+		{model.ErrorPage{Status: 404, Format: model.FormatJson, Template: `{"m":{{json .Message}}}`}, true},
+		{model.ErrorPage{Status: 404, Format: model.FormatHtml, Template: "{{.Missing}}"}, false},
+		{model.ErrorPage{Status: 404, Format: model.FormatHtml, Template: "{{"}, false},
+		{model.ErrorPage{Status: 200, Format: model.FormatHtml, Template: ""}, false},
+		{model.ErrorPage{Status: 404, Format: "text", Template: ""}, false},
+	} {
+		if err := ParseErrorPage(&tc.page); (err == nil) != tc.ok {
+			t.Errorf("ParseErrorPage(%+v) = %v", tc.page, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package transport
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/obud-dev/tunnel/pkg/message"
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+// fileHandler serves a local directory for file:// targets
+type fileHandler struct {
+	root      http.Dir
+	opts      model.FileOptions
+	authCache *sync.Map // 已验证的访问账号, 由客户端的所有连接共享
+}
+
+func (h *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	f, err := h.root.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !info.IsDir() {
+		// ServeContent 处理 Range、If-Modified-Since 等条件请求
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+		return
+	}
+
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		// 使用相对地址, 避免 //example.com 这样的路径被当作外部地址
+		localRedirect(w, r, path.Base(r.URL.Path)+"/")
+		return
+	}
+	index := h.opts.Index
+	if len(index) == 0 {
+		index = []string{"index.html"}
+	}
+	for _, page := range index {
+		ff, err := h.root.Open(path.Join(name, page))
+		if err != nil {
+			continue
+		}
+		defer ff.Close()
+		if fi, err := ff.Stat(); err == nil && !fi.IsDir() {
+			http.ServeContent(w, r, fi.Name(), fi.ModTime(), ff)
+			return
+		}
+	}
+	if !h.opts.Listing {
+		http.NotFound(w, r)
+		return
+	}
+	h.list(w, f, name)
+}
+
+// authorized checks the request against the configured basic auth accounts
+func (h *fileHandler) authorized(r *http.Request) bool {
+	if len(h.opts.BasicAuth) == 0 {
+		return true
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	return checkBasicAuth(h.authCache, h.opts.BasicAuth, user, password)
+}
+
+// localRedirect redirects to a path relative to the current directory, keeping the query
+func localRedirect(w http.ResponseWriter, r *http.Request, target string) {
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+// list writes an html listing of the directory
+func (h *fileHandler) list(w http.ResponseWriter, dir http.File, name string) {
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"><title>Index of %s</title></head>\n<body>\n<h1>Index of %s</h1>\n<pre>\n", html.EscapeString(name), html.EscapeString(name))
+	if name != "/" {
+		fmt.Fprint(w, "<a href=\"../\">../</a>\n")
+	}
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if entry.IsDir() {
+			entryName += "/"
+		}
+		link := url.URL{Path: entryName}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", link.String(), html.EscapeString(entryName))
+	}
+	fmt.Fprint(w, "</pre>\n</body>\n</html>\n")
+}
+
+// serveFiles starts serving the directory on one end of an in-memory pipe and returns the other end,
+// so file:// targets are read exactly like a dialed http target
+func serveFiles(root string, opts *model.FileOptions, authCache *sync.Map) net.Conn {
+	handler := &fileHandler{root: http.Dir(root), authCache: authCache}
+	if opts != nil {
+		handler.opts = *opts
+	}
+	serverConn, clientConn := net.Pipe()
+	go (&http.Server{Handler: handler}).Serve(&onceListener{conn: serverConn})
+	return clientConn
+}
+
+// checkDir validates a file:// target against the directories clientd is allowed to serve
+func (c *TcpClient) checkDir(dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		return "", fmt.Errorf("directory path must be absolute: %s", dir)
+	}
+	dir = filepath.Clean(dir)
+	allowed := false
+	for _, base := range c.AllowedDirs {
+		base = filepath.Clean(base)
+		if dir == base || strings.HasPrefix(dir, base+string(filepath.Separator)) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", &targetError{code: message.ErrorPolicyDenied, err: fmt.Errorf("directory %s is not allowed", dir)}
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return dir, nil
+}
+
+// onceListener hands out a single connection, then reports itself closed
+type onceListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *onceListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+	if conn == nil {
+		return nil, io.EOF
+	}
+	return conn, nil
+}
+
+func (l *onceListener) Close() error {
+	return nil
+}
+
+func (l *onceListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/obud-dev/tunnel/pkg/message"
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/utils"
+)
+
+// testDir creates a directory with a site and a folder without an index page
+func testDir(t *testing.T) string {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":       "home",
+		"docs/readme.txt":  "readme",
+		"docs/<b>.txt":     "escaped",
+		"site/default.htm": "custom index",
+		"../outside.txt":   "secret",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func serveFile(h *fileHandler, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestFileHandler(t *testing.T) {
+	dir := testDir(t)
+	h := &fileHandler{root: http.Dir(dir), authCache: &sync.Map{}}
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{http.MethodGet, "/", http.StatusOK, "home"},
+		{http.MethodGet, "/docs/readme.txt", http.StatusOK, "readme"},
+		{http.MethodGet, "/docs", http.StatusMovedPermanently, ""},
+		{http.MethodGet, "//docs", http.StatusMovedPermanently, ""},
+		{http.MethodGet, "/docs/", http.StatusNotFound, ""},
+		{http.MethodGet, "/../outside.txt", http.StatusNotFound, ""},
+		{http.MethodGet, "/missing", http.StatusNotFound, ""},
+		{http.MethodPost, "/index.html", http.StatusMethodNotAllowed, ""},
+	} {
+		w := serveFile(h, tc.method, tc.path)
+		if w.Code != tc.status || tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("%s %s = %d %q", tc.method, tc.path, w.Code, w.Body.String())
+		}
+		// 目录重定向使用相对地址, 不能指向其他主机
+		if location := w.Header().Get("Location"); location != "" && location != "docs/" {
+			t.Errorf("%s %s redirects to %q", tc.method, tc.path, location)
+		}
+	}
+
+	// 自定义首页及目录列表
+	h.opts = model.FileOptions{Index: []string{"default.htm"}, Listing: true}
+	if w := serveFile(h, http.MethodGet, "/site/"); w.Body.String() != "custom index" {
+		t.Errorf("index page = %q", w.Body.String())
+	}
+	w := serveFile(h, http.MethodGet, "/docs/")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `href="readme.txt"`) || !strings.Contains(w.Body.String(), `href="../"`) {
+		t.Errorf("listing = %d %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "<b>") {
+		t.Errorf("listing contains an unescaped file name: %s", w.Body.String())
+	}
+}
+
+func TestFileHandlerBasicAuth(t *testing.T) {
+	hash, err := utils.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &fileHandler{root: http.Dir(testDir(t)), opts: model.FileOptions{BasicAuth: []string{"alice:" + hash}}, authCache: &sync.Map{}}
+	for _, tc := range []struct {
+		user, password string
+		status         int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"bob", "secret", http.StatusUnauthorized},
+		{"alice", "secret", http.StatusOK},
+		{"alice", "secret", http.StatusOK}, // 第二次命中缓存
+		{"alice", "wrong", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, tc.password)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s:%s = %d, want %d", tc.user, tc.password, w.Code, tc.status)
+		}
+	}
+}
+
+func TestCheckDir(t *testing.T) {
+	dir := testDir(t)
+	c := &TcpClient{AllowedDirs: []string{dir}}
+	for _, tc := range []struct {
+		dir string
+		ok  bool
+	}{
+		{dir, true},
+		{filepath.Join(dir, "docs"), true},
+		{filepath.Join(dir, "docs", ".."), true},
+		{filepath.Join(dir, "docs", "readme.txt"), false},
+		{filepath.Join(dir, "missing"), false},
+		{dir + "-other", false},
+		{filepath.Dir(dir), false},
+		{"relative", false},
+	} {
+		if _, err := c.checkDir(tc.dir); (err == nil) != tc.ok {
+			t.Errorf("checkDir(%s) = %v", tc.dir, err)
+		}
+	}
+	if _, err := c.checkDir(filepath.Dir(dir)); errorCode(err) != message.ErrorPolicyDenied {
+		t.Errorf("directory outside the allowed ones: %v", err)
+	}
+}
@@ -0,0 +1,519 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/obud-dev/tunnel/pkg/message"
+	"github.com/obud-dev/tunnel/pkg/metrics"
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/svc"
+	"github.com/obud-dev/tunnel/pkg/tracing"
+	"github.com/obud-dev/tunnel/pkg/utils"
+)
+
+// closeBody runs close after the body of a response read from a stream is closed
+type closeBody struct {
+	io.ReadCloser
+	close func()
+}
+
+func (b *closeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.close()
+	return err
+}
+
+// statusWriter records the status code and the number of body bytes sent to the visitor
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	bytes   int64
+	capture io.Writer // 记录响应体, 为 nil 时不记录
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	if w.capture != nil {
+		w.capture.Write(p[:n])
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the Flusher and Hijacker of the connection
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// countReader counts the bytes of the visitor request body
+type countReader struct {
+	io.ReadCloser
+	bytes   int64
+	capture io.Writer // 记录请求体, 为 nil 时不记录
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	if r.capture != nil {
+		r.capture.Write(p[:n])
+	}
+	return n, err
+}
+
+// connListener hands connections accepted by the protocol dispatcher to the HTTP server
+type connListener struct {
+	conns chan net.Conn
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// handleHttp serves the HTTP/1.x, h2c or TLS-terminated HTTP/2 requests of a visitor connection
+func (s *TcpServer) handleHttp(conn net.Conn) {
+	log.Info().Msgf("Connection established with visitor %s", conn.RemoteAddr())
+	s.httpOnce.Do(func() {
+		h2s := &http2.Server{}
+		server := &http.Server{
+			Handler:           h2c.NewHandler(s, h2s),
+			ReadHeaderTimeout: httpReadHeaderTimeout,
+			IdleTimeout:       httpIdleTimeout,
+		}
+		// TLS 连接协商出 h2 时交给 HTTP/2 服务处理
+		if err := http2.ConfigureServer(server, h2s); err != nil {
+			log.Error().Err(err).Msg("Failed to configure http2")
+		}
+		s.httpConns = &connListener{conns: make(chan net.Conn)}
+		go server.Serve(s.httpConns)
+	})
+	s.httpConns.conns <- conn
+}
+
+// ServeHTTP proxies a visitor request through the tunnel of the route matching its host
+func (s *TcpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// 延续访客请求携带的 trace context
+	ctx, span := tracing.Tracer.Start(tracing.Propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header)), "visitor.accept",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("server.address", r.Host),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("client.address", remoteIP(r).String()),
+		))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	body := &countReader{ReadCloser: r.Body}
+	r.Body = body
+	var route *model.Route
+	// 认证会移除凭据, 先记下 Basic Auth 用户名
+	user, _, _ := r.BasicAuth()
+	if s.ctx.AccessLog.Enabled() {
+		defer func(start time.Time) {
+			s.logRequest(r, route, sw, body.bytes, user, start)
+		}(time.Now())
+	}
+
+	_, matchSpan := tracing.Tracer.Start(ctx, "route.match")
+	s.ctx.Mutex.Lock()
+	route = s.ctx.MatchRoute(r.Host)
+	s.ctx.Mutex.Unlock()
+	if route != nil {
+		matchSpan.SetAttributes(attribute.String("tunnel.route_id", route.ID), attribute.String("tunnel.id", route.TunnelID))
+	}
+	matchSpan.End()
+	if route == nil || route.Protocol.IsStream() {
+		log.Error().Msgf("route not found for %s", r.Host)
+		route = nil
+		span.SetAttributes(attribute.Int("http.response.status_code", http.StatusNotFound))
+		s.writeError(w, r, nil, http.StatusNotFound, "")
+		return
+	}
+	s.ctx.Stats.Request(route)
+	defer func(start time.Time) {
+		metrics.RequestDuration.WithLabelValues(route.Hostname, strconv.Itoa(sw.code())).Observe(time.Since(start).Seconds())
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.code()))
+		if sw.code() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.code()))
+		}
+	}(time.Now())
+	if route.Inspect {
+		defer s.captureExchange(r, route, sw, body)()
+	}
+
+	if !s.ctx.Limiter.Allow(route, remoteIP(r).String()) {
+		log.Warn().Msgf("%s exceeded the request rate of %s", r.RemoteAddr, route.Hostname)
+		s.writeError(w, r, route, http.StatusTooManyRequests, "")
+		return
+	}
+	if exhausted, resetAt := s.ctx.Traffic.Exhausted(route.TunnelID); exhausted {
+		log.Warn().Msgf("Traffic quota of tunnel %s exhausted", route.TunnelID)
+		msg := "The traffic quota of the tunnel serving this host is exhausted."
+		if !resetAt.IsZero() {
+			w.Header().Set("Retry-After", fmt.Sprint(int(time.Until(resetAt).Seconds())+1))
+			msg = fmt.Sprintf("The traffic quota of the tunnel serving this host is exhausted until %s.", resetAt.UTC().Format(time.RFC1123))
+		}
+		s.writeError(w, r, route, http.StatusServiceUnavailable, msg)
+		return
+	}
+	if route.Access.Oidc != nil && strings.HasPrefix(r.URL.Path, oidcPathPrefix) {
+		s.handleOidc(w, r, route)
+		return
+	}
+	if status := s.authorize(route, r); status != 0 {
+		log.Warn().Msgf("%s denied access to %s with status %d", r.RemoteAddr, r.Host, status)
+		if status == http.StatusUnauthorized {
+			// 浏览器访问时跳转登录, 其他请求返回 401
+			if route.Access.Oidc != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+				s.startOidcLogin(w, r, route)
+				return
+			}
+			if len(route.Access.BasicAuth) > 0 {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", route.Hostname))
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+		}
+		s.writeError(w, r, route, status, "")
+		return
+	}
+	if route.Access.Oidc != nil {
+		// 身份头部由 authorize 设置
+		if email := r.Header.Get("X-Auth-Request-Email"); email != "" {
+			user = email
+		} else {
+			user = r.Header.Get("X-Auth-Request-User")
+		}
+	}
+
+	// 通过隧道ID获取隧道连接，隧道正在重连时等待其恢复
+	tunnel, err := s.ctx.WaitTunnel(route.TunnelID)
+	if err != nil {
+		log.Error().Err(err).Msgf("tunnel %s unavailable", route.TunnelID)
+		if err == svc.ErrTunnelReconnecting {
+			s.writeError(w, r, route, http.StatusServiceUnavailable, "")
+		} else {
+			s.writeError(w, r, route, http.StatusBadGateway, "")
+		}
+		return
+	}
+	release, ok := s.ctx.Limiter.Acquire(route, tunnel.MaxStreams)
+	if !ok {
+		log.Warn().Msgf("Too many concurrent requests to %s", route.Hostname)
+		s.writeError(w, r, route, http.StatusTooManyRequests, "")
+		return
+	}
+	defer release()
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			// 保留访客的 Host, 由客户端按路由目标发送
+			req.URL.Scheme = "http"
+			req.URL.Host = req.Host
+			req.Header.Set("X-Forwarded-Host", r.Host)
+			if r.TLS != nil {
+				req.Header.Set("X-Forwarded-Proto", "https")
+			} else {
+				req.Header.Set("X-Forwarded-Proto", "http")
+			}
+		},
+		Transport: &tunnelTransport{server: s, route: route, tunnel: tunnel},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			status, msg := http.StatusBadGateway, ""
+			var targetErr *targetError
+			if errors.As(err, &targetErr) {
+				if code, ok := errorStatus[targetErr.code]; ok {
+					status = code
+				}
+				msg = errorCodeMessages[targetErr.code]
+			} else if req.Context().Err() != nil {
+				// 访客已断开
+				return
+			}
+			log.Error().Err(err).Msgf("Error proxying %s%s", req.Host, req.URL.Path)
+			s.writeError(w, r, route, status, msg)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// logRequest writes the access log entry of a visitor request, route is nil when no route matched
+func (s *TcpServer) logRequest(r *http.Request, route *model.Route, sw *statusWriter, bytesIn int64, user string, start time.Time) {
+	entry := &svc.AccessEntry{
+		Time:      start,
+		Type:      "http",
+		Host:      r.Host,
+		ClientIP:  remoteIP(r).String(),
+		User:      user,
+		Method:    r.Method,
+		Path:      r.RequestURI,
+		Proto:     r.Proto,
+		Status:    sw.code(),
+		BytesIn:   bytesIn,
+		BytesOut:  sw.bytes,
+		Duration:  float64(time.Since(start).Microseconds()) / 1000,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+	if route != nil {
+		entry.RouteID, entry.TunnelID = route.ID, route.TunnelID
+	}
+	s.ctx.AccessLog.Log(entry)
+}
+
+// writeError answers the visitor with the error page for status, an empty message uses the
+// default explanation of the status
+func (s *TcpServer) writeError(w http.ResponseWriter, r *http.Request, route *model.Route, status int, msg string) {
+	if status >= http.StatusInternalServerError {
+		s.ctx.Stats.Error(route)
+	}
+	contentType, body := renderErrorPage(s.ctx.ErrorPages(), route, r, status, msg)
+	w.Header().Set("Content-Type", contentType)
+	if w.Header().Get("Retry-After") == "" {
+		switch status {
+		case http.StatusServiceUnavailable:
+			w.Header().Set("Retry-After", fmt.Sprint(int(s.ctx.Config.ReconnectGrace.Seconds())))
+		case http.StatusTooManyRequests:
+			w.Header().Set("Retry-After", "1")
+		}
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// tunnelTransport sends each request over a new stream of the tunnel
+type tunnelTransport struct {
+	server *TcpServer
+	route  *model.Route
+	tunnel *svc.ActiveTunnel
+}
+
+func (t *tunnelTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	s := t.server
+	// 从发送请求到收到响应头
+	ctx, span := tracing.Tracer.Start(req.Context(), "tunnel.send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("tunnel.id", t.route.TunnelID)))
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		}
+		tracing.End(span, err)
+	}()
+
+	local, remote := net.Pipe()
+	visitor := svc.NewActiveTunnel(remote, t.tunnel.Token)
+	visitor.Route = t.route
+	visitor.Trace = tracing.Inject(ctx)
+	go s.forwardStream(utils.GenerateID(), visitor, t.tunnel)
+
+	var once sync.Once
+	done := make(chan struct{})
+	release := func() {
+		once.Do(func() {
+			close(done)
+			local.Close()
+		})
+	}
+	go func() {
+		select {
+		case <-req.Context().Done():
+			release()
+		case <-done:
+		}
+	}()
+
+	visitor.Await(s.ctx.Config.ResponseTimeout, func() {
+		log.Error().Msgf("target %s response timeout", t.route.Target)
+		s.ctx.RouteModel.RecordFailure(t.route.ID, "response timeout")
+		visitor.Fail(&targetError{code: message.ErrorTimeout, err: errors.New("response timeout")})
+	})
+	go func() {
+		if err := writeHttpRequest(local, req); err != nil {
+			log.Debug().Err(err).Msg("Error sending request to tunnel")
+		}
+	}()
+
+	resp, err = http.ReadResponse(bufio.NewReader(local), req)
+	if err != nil {
+		release()
+		if streamErr := visitor.Err(); streamErr != nil {
+			return nil, streamErr
+		}
+		return nil, err
+	}
+	resp.Body = &closeBody{ReadCloser: resp.Body, close: release}
+	return resp, nil
+}
+
+// serveHttpStream returns the stream end of a pipe whose other end reads the visitor
+// request, sends it to the route target and writes back the response
+func (c *TcpClient) serveHttpStream(ctx context.Context, m message.Message) net.Conn {
+	local, remote := net.Pipe()
+	go c.proxyHttp(ctx, m, remote)
+	return local
+}
+
+// proxyHttp relays one request read from conn to the route target and writes the response to conn
+func (c *TcpClient) proxyHttp(ctx context.Context, m message.Message, conn net.Conn) {
+	defer conn.Close()
+
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		log.Error().Err(err).Msg("Error reading request from server")
+		return
+	}
+	req.RequestURI = ""
+	req.URL.Scheme = "http"
+	req.URL.Host = req.Host
+
+	// 连接及等待响应头超时后取消请求, 与服务端等待响应的时间保持一致
+	timeout := targetTimeout
+	if m.Timeout > 0 {
+		timeout = time.Duration(m.Timeout) * time.Millisecond
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := c.roundTripTarget(ctx, m, req.WithContext(ctx))
+	if !timer.Stop() && err != nil {
+		err = &targetError{code: message.ErrorTimeout, err: fmt.Errorf("target did not respond in %s", timeout)}
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Error requesting target")
+		c.SendError(m.Id, err)
+		return
+	}
+	defer resp.Body.Close()
+	log.Info().Msg("Received response")
+
+	if err := writeHttpResponse(conn, resp); err != nil {
+		log.Error().Err(err).Msg("Error relaying response")
+	}
+}
+
+// roundTripTarget sends req to the route target over a new connection, using HTTP/2 when the
+// route enables it or the TLS handshake negotiates it
+func (c *TcpClient) roundTripTarget(ctx context.Context, m message.Message, req *http.Request) (resp *http.Response, err error) {
+	var opts model.TargetOptions
+	if len(m.Options) > 0 {
+		if err := json.Unmarshal(m.Options, &opts); err != nil {
+			return nil, fmt.Errorf("invalid target options: %w", err)
+		}
+	}
+	dialCtx, dialSpan := tracing.Tracer.Start(ctx, "client.dial",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("tunnel.target", m.Target)))
+	conn, err := c.dialTarget(dialCtx, m)
+	tracing.End(dialSpan, err)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// 从发送请求到收到目标的响应头, 目标服务的 span 以此为父 span
+	spanCtx, span := tracing.Tracer.Start(ctx, "target.response",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.path", req.URL.Path),
+		))
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		}
+		tracing.End(span, err)
+	}()
+	tracing.Propagator.Inject(spanCtx, propagation.HeaderCarrier(req.Header))
+
+	useH2 := opts.Http2
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		useH2 = tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS
+	}
+	if useH2 {
+		cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp, err := cc.RoundTrip(req)
+		if err != nil {
+			cc.Close()
+			return nil, err
+		}
+		resp.Body = &closeBody{ReadCloser: resp.Body, close: func() { cc.Close() }}
+		return resp, nil
+	}
+
+	go func() {
+		if err := req.Write(conn); err != nil {
+			log.Debug().Err(err).Msg("Error writing to target")
+		}
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		// 跳过 100 Continue 等中间响应
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			continue
+		}
+		resp.Body = &closeBody{ReadCloser: resp.Body, close: func() { conn.Close() }}
+		return resp, nil
+	}
+}
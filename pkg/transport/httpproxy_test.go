@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/obud-dev/tunnel/pkg/message"
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+func TestGrpcThroughTunnel(t *testing.T) {
+	tt := startTestTunnel(t)
+
+	// 内网的 gRPC 服务 (h2c)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(target, healthServer)
+	go target.Serve(ln)
+	defer target.Stop()
+
+	tt.addRoute(t, &model.Route{
+		ID:       "grpc",
+		Hostname: "grpc.example.com",
+		Protocol: model.TypeHttp,
+		Target:   ln.Addr().String(),
+		Options:  model.TargetOptions{Http2: true},
+	})
+
+	conn, err := grpc.NewClient(tt.addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithAuthority("grpc.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "svc"})
+	if err != nil {
+		t.Fatalf("unary call: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("status = %v, want SERVING", resp.Status)
+	}
+	// 错误状态通过 trailer 返回
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "missing"}); err == nil {
+		t.Fatal("unknown service did not fail")
+	}
+
+	// 服务端流: 状态变化推送给访客
+	watch, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "svc"})
+	if err != nil {
+		t.Fatalf("streaming call: %v", err)
+	}
+	if update, err := watch.Recv(); err != nil || update.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("first update = %v, %v", update, err)
+	}
+	healthServer.SetServingStatus("svc", healthpb.HealthCheckResponse_NOT_SERVING)
+	if update, err := watch.Recv(); err != nil || update.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("second update = %v, %v", update, err)
+	}
+	cancel()
+	if _, err := watch.Recv(); err == nil || err == io.EOF {
+		t.Fatalf("stream not cancelled: %v", err)
+	}
+}
+
+func TestTargetErrorThroughTunnel(t *testing.T) {
+	tt := startTestTunnel(t)
+	// 没有监听的端口
+	target := freeAddr(t)
+	tt.addRoute(t, &model.Route{ID: "down", Hostname: "down.example.com", Protocol: model.TypeHttp, Target: target})
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+tt.addr+"/", nil)
+	req.Host = "down.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), errorCodeMessages[message.ErrorDialRefused]) {
+		t.Fatalf("response = %d %s", resp.StatusCode, body)
+	}
+	// 目标地址只记录在路由上, 不返回给访客
+	if strings.Contains(string(body), target) {
+		t.Fatalf("error page exposes the target address: %s", body)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		route, err := tt.ctx.RouteModel.GetRouteByID("down")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route.Failures == 1 && strings.HasPrefix(route.LastError, string(message.ErrorDialRefused)) && route.LastErrorAt > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failure not recorded: %d %q", route.Failures, route.LastError)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,129 @@
+package transport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+// HTTP 请求和响应在隧道流中以 HTTP/1.1 格式传输，长度未知的消息体使用 chunked 编码，
+// 消息体随读随发以支持流式传输，trailer (如 gRPC 的 grpc-status) 跟在最后一个 chunk 之后
+
+// framingHeaders are set by writeHttp itself and never copied from the message
+var framingHeaders = []string{"Content-Length", "Transfer-Encoding", "Trailer", "Connection"}
+
+// writeHttpRequest writes req to w in HTTP/1.1 format, streaming its body
+func writeHttpRequest(w io.Writer, req *http.Request) error {
+	header := req.Header.Clone()
+	header.Set("Host", req.Host)
+	var body io.Reader
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 {
+		body = req.Body
+	}
+	line := fmt.Sprintf("%s %s HTTP/1.1", req.Method, req.URL.RequestURI())
+	return writeHttp(w, line, header, body, req.ContentLength, func() http.Header { return req.Trailer })
+}
+
+// writeHttpResponse writes resp to w in HTTP/1.1 format, streaming its body
+func writeHttpResponse(w io.Writer, resp *http.Response) error {
+	var body io.Reader = resp.Body
+	if !responseHasBody(resp) {
+		body = nil
+	}
+	line := fmt.Sprintf("HTTP/1.1 %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	return writeHttp(w, line, resp.Header.Clone(), body, resp.ContentLength, func() http.Header { return resp.Trailer })
+}
+
+// responseHasBody reports whether a body may follow the response head
+func responseHasBody(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	status := resp.StatusCode
+	return !(status >= 100 && status < 200) && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// writeHttp writes the start line, header and body. Bodies of known length without trailers
+// keep their Content-Length, others are chunked and followed by the trailers
+func writeHttp(w io.Writer, line string, header http.Header, body io.Reader, length int64, trailer func() http.Header) error {
+	for _, key := range framingHeaders {
+		header.Del(key)
+	}
+	announced := trailer()
+	chunked := body != nil && (length < 0 || len(announced) > 0)
+	switch {
+	case chunked:
+		header.Set("Transfer-Encoding", "chunked")
+		if len(announced) > 0 {
+			keys := make([]string, 0, len(announced))
+			for key := range announced {
+				keys = append(keys, key)
+			}
+			header.Set("Trailer", strings.Join(keys, ", "))
+		}
+	case body != nil:
+		header.Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+
+	bw := bufio.NewWriterSize(w, messageChunkSize)
+	if _, err := fmt.Fprintf(bw, "%s\r\n", line); err != nil {
+		return err
+	}
+	if err := header.Write(bw); err != nil {
+		return err
+	}
+	if _, err := bw.WriteString("\r\n"); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if body == nil {
+		return nil
+	}
+
+	var dst io.Writer = bw
+	var cw io.WriteCloser
+	if chunked {
+		cw = httputil.NewChunkedWriter(bw)
+		dst = cw
+	}
+	buf := make([]byte, messageChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+			// 立即发出已读到的数据，保证流式响应 (SSE、gRPC) 不被缓冲
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if chunked {
+		if err := cw.Close(); err != nil {
+			return err
+		}
+		// 消息体读完后 trailer 的值才确定
+		if t := trailer(); len(t) > 0 {
+			if err := t.Write(bw); err != nil {
+				return err
+			}
+		}
+		if _, err := bw.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
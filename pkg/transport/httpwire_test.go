@@ -0,0 +1,125 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// trailerBody sets the trailer of resp once the body has been read, like a gRPC response
+type trailerBody struct {
+	io.Reader
+	resp *http.Response
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.resp.Trailer.Set("Grpc-Status", "0")
+	}
+	return n, err
+}
+
+func (b *trailerBody) Close() error { return nil }
+
+func TestWriteHttpRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		length  int64
+		chunked bool
+	}{
+		{"known length", 5, false},
+		{"unknown length", -1, true},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, "http://app.example.com/upload?x=1", strings.NewReader("hello"))
+		req.ContentLength = tc.length
+		req.Header.Set("Connection", "keep-alive")
+		req.Header.Set("Transfer-Encoding", "gzip")
+		req.Header.Set("X-Test", "1")
+
+		var buf bytes.Buffer
+		if err := writeHttpRequest(&buf, req); err != nil {
+			t.Fatal(err)
+		}
+		got, err := http.ReadRequest(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", tc.name, err, buf.String())
+		}
+		body, _ := io.ReadAll(got.Body)
+		if got.Method != http.MethodPost || got.Host != "app.example.com" || got.URL.RequestURI() != "/upload?x=1" || got.Header.Get("X-Test") != "1" {
+			t.Errorf("%s: request = %s %s %s %v", tc.name, got.Method, got.Host, got.URL, got.Header)
+		}
+		if string(body) != "hello" {
+			t.Errorf("%s: body = %q", tc.name, body)
+		}
+		if chunked := len(got.TransferEncoding) > 0; chunked != tc.chunked || got.Header.Get("Connection") != "" {
+			t.Errorf("%s: transfer encoding %v, header %v", tc.name, got.TransferEncoding, got.Header)
+		}
+	}
+
+	// 没有消息体的请求不带 Content-Length
+	req, _ := http.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	var buf bytes.Buffer
+	if err := writeHttpRequest(&buf, req); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "Content-Length") || !strings.HasSuffix(buf.String(), "\r\n\r\n") {
+		t.Errorf("request without body = %q", buf.String())
+	}
+}
+
+func TestWriteHttpResponseTrailer(t *testing.T) {
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"application/grpc"}},
+		Trailer:       http.Header{"Grpc-Status": nil},
+		ContentLength: -1,
+	}
+	resp.Body = &trailerBody{Reader: strings.NewReader("message"), resp: resp}
+
+	var buf bytes.Buffer
+	if err := writeHttpResponse(&buf, resp); err != nil {
+		t.Fatal(err)
+	}
+	got, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(got.Body)
+	if string(body) != "message" {
+		t.Errorf("body = %q", body)
+	}
+	// trailer 的值在消息体读完后写入
+	if got.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("trailer = %v", got.Trailer)
+	}
+}
+
+func TestWriteHttpResponseWithoutBody(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		method string
+	}{
+		{http.StatusNoContent, http.MethodGet},
+		{http.StatusNotModified, http.MethodGet},
+		{http.StatusOK, http.MethodHead},
+	} {
+		resp := &http.Response{
+			StatusCode:    tc.status,
+			Header:        http.Header{},
+			Body:          io.NopCloser(strings.NewReader("ignored")),
+			ContentLength: 7,
+			Request:       &http.Request{Method: tc.method},
+		}
+		var buf bytes.Buffer
+		if err := writeHttpResponse(&buf, resp); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(buf.String(), "\r\n\r\n") || strings.Contains(buf.String(), "ignored") {
+			t.Errorf("%d %s: wrote %q", tc.status, tc.method, buf.String())
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/svc"
+	"github.com/obud-dev/tunnel/pkg/utils"
+)
+
+// captureBuffer keeps the first svc.InspectBodyLimit bytes written to it
+type captureBuffer struct {
+	data      []byte
+	truncated bool
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := svc.InspectBodyLimit - len(b.data); n > room {
+		p = p[:room]
+		b.truncated = true
+	}
+	b.data = append(b.data, p...)
+	return n, nil
+}
+
+// captureExchange starts recording the request to an inspected route, the returned function
+// stores it once the response is complete
+func (s *TcpServer) captureExchange(r *http.Request, route *model.Route, sw *statusWriter, body *countReader) func() {
+	start := time.Now()
+	reqBody, respBody := &captureBuffer{}, &captureBuffer{}
+	body.capture, sw.capture = reqBody, respBody
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return func() {
+		s.ctx.Inspector.Add(&svc.CapturedRequest{
+			ID:       utils.GenerateID(),
+			RouteID:  route.ID,
+			Time:     start,
+			Duration: float64(time.Since(start).Microseconds()) / 1000,
+			ClientIP: remoteIP(r).String(),
+
+			Method:           r.Method,
+			Scheme:           scheme,
+			Host:             r.Host,
+			Path:             r.RequestURI,
+			Proto:            r.Proto,
+			RequestHeaders:   r.Header.Clone(), // 已移除通过认证的凭据
+			RequestBody:      reqBody.data,
+			RequestTruncated: reqBody.truncated,
+
+			Status:            sw.code(),
+			ResponseHeaders:   sw.Header().Clone(),
+			ResponseBody:      respBody.data,
+			ResponseTruncated: respBody.truncated,
+		})
+	}
+}
+
+// Replay sends req through the tunnel of route without checking the access policy, as the
+// API has already authenticated the caller. The exchange is captured like a visitor request
+func (s *TcpServer) Replay(route *model.Route, req *http.Request, replayOf string) (*svc.CapturedRequest, error) {
+	tunnel, err := s.ctx.WaitTunnel(route.TunnelID)
+	if err != nil {
+		return nil, err
+	}
+	release, ok := s.ctx.Limiter.Acquire(route, tunnel.MaxStreams)
+	if !ok {
+		return nil, errors.New("too many concurrent requests")
+	}
+	defer release()
+
+	reqBody := &captureBuffer{}
+	if req.Body != nil {
+		req.Body = &countReader{ReadCloser: req.Body, capture: reqBody}
+	}
+	// 记录原请求的 scheme, 经隧道发送时总是使用 http
+	scheme := req.URL.Scheme
+	req.URL.Scheme, req.URL.Host = "http", req.Host
+	start := time.Now()
+	transport := &tunnelTransport{server: s, route: route, tunnel: tunnel}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// 多读一个字节用于判断响应体是否被截断, 不等待流式响应结束
+	respBody := &captureBuffer{}
+	if _, err := io.Copy(respBody, io.LimitReader(resp.Body, svc.InspectBodyLimit+1)); err != nil {
+		return nil, err
+	}
+
+	capture := &svc.CapturedRequest{
+		ID:       utils.GenerateID(),
+		RouteID:  route.ID,
+		Time:     start,
+		Duration: float64(time.Since(start).Microseconds()) / 1000,
+		ReplayOf: replayOf,
+
+		Method:           req.Method,
+		Scheme:           scheme,
+		Host:             req.Host,
+		Path:             req.URL.RequestURI(),
+		Proto:            req.Proto,
+		RequestHeaders:   req.Header.Clone(),
+		RequestBody:      reqBody.data,
+		RequestTruncated: reqBody.truncated,
+
+		Status:            resp.StatusCode,
+		ResponseHeaders:   resp.Header.Clone(),
+		ResponseBody:      respBody.data,
+		ResponseTruncated: respBody.truncated,
+	}
+	s.ctx.Inspector.Add(capture)
+	return capture, nil
+}
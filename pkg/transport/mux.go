@@ -0,0 +1,165 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// connKind is the protocol of an accepted connection, detected from its first bytes
+type connKind string
+
+const (
+	connControl connKind = "control" // 内网客户端的隧道控制连接
+	connHttp    connKind = "http"    // HTTP/1.x 或 h2c 访客请求
+	connTls     connKind = "tls"     // TLS 访客连接
+	connSsh     connKind = "ssh"     // SSH 访客连接
+	connUnknown connKind = "unknown"
+)
+
+const sniffTimeout = 10 * time.Second // 等待连接发送首个数据的时间
+
+// allConnKinds are the kinds served on the shared ListenOn port
+var allConnKinds = []connKind{connControl, connHttp, connTls, connSsh}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "), []byte("HEAD "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+	[]byte("PRI "), // HTTP/2 prior knowledge (h2c)
+}
+
+// sniffConn replays the bytes read while sniffing and reports the client address
+// given in a PROXY protocol header
+type sniffConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *sniffConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *sniffConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// hasPrefix reports whether the next bytes of r are prefix
+func hasPrefix(r *bufio.Reader, prefix []byte) bool {
+	head, err := r.Peek(len(prefix))
+	return err == nil && bytes.Equal(head, prefix)
+}
+
+// classify detects the protocol from the first bytes of the connection without consuming them
+func classify(r *bufio.Reader) (connKind, error) {
+	head, err := r.Peek(1)
+	if err != nil {
+		return connUnknown, err
+	}
+	switch {
+	case head[0] == '{':
+		return connControl, nil
+	case head[0] == 0x16:
+		// TLS 握手记录: 0x16 0x03 0x0X
+		if head, err := r.Peek(2); err == nil && head[1] == 0x03 {
+			return connTls, nil
+		}
+	case head[0] == 'S':
+		if hasPrefix(r, []byte("SSH-")) {
+			return connSsh, nil
+		}
+	default:
+		for _, method := range httpMethods {
+			if method[0] == head[0] && hasPrefix(r, method) {
+				return connHttp, nil
+			}
+		}
+	}
+	return connUnknown, nil
+}
+
+// sniff classifies conn, consuming a PROXY protocol header from a trusted proxy first
+func (s *TcpServer) sniff(conn net.Conn) (connKind, *sniffConn, error) {
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	sc := &sniffConn{Conn: conn, r: bufio.NewReader(conn)}
+	if hasPrefix(sc.r, proxyV1Prefix) || hasPrefix(sc.r, proxyV2Signature) {
+		if !s.isTrustedProxy(conn.RemoteAddr()) {
+			return connUnknown, nil, fmt.Errorf("proxy protocol header from untrusted address %s", conn.RemoteAddr())
+		}
+		addr, err := readProxyHeader(sc.r)
+		if err != nil {
+			return connUnknown, nil, err
+		}
+		sc.remote = addr
+	}
+	kind, err := classify(sc.r)
+	return kind, sc, err
+}
+
+// serve accepts connections on addr and dispatches those of the given kinds to their handlers
+func (s *TcpServer) serve(addr string, kinds ...connKind) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error().Err(err).Msg("Error starting server")
+		return err
+	}
+	defer ln.Close()
+
+	log.Info().Msgf("Listening on %s %v", addr, kinds)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Error().Err(err).Msg("Error accepting connection")
+			continue
+		}
+		go s.dispatch(conn, kinds)
+	}
+}
+
+// dispatch sniffs the protocol of conn and hands it to the matching handler
+func (s *TcpServer) dispatch(conn net.Conn, kinds []connKind) {
+	kind, sc, err := s.sniff(conn)
+	if err != nil {
+		log.Debug().Err(err).Msgf("Failed to detect protocol from %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	allowed := false
+	for _, k := range kinds {
+		if k == kind {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		log.Debug().Msgf("Rejected %s connection from %s", kind, sc.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	switch kind {
+	case connControl:
+		s.handleControl(sc)
+	case connHttp:
+		s.handleHttp(sc)
+	case connTls:
+		conf, err := s.tlsConfig()
+		if err != nil {
+			log.Error().Err(err).Msg("TLS is not available")
+			conn.Close()
+			return
+		}
+		s.handleTls(sc, conf)
+	case connSsh:
+		s.handleSsh(sc)
+	}
+}
@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	for data, want := range map[string]connKind{
+		`{"type":1}`:                       connControl,
+		"\x16\x03\x01\x02\x00":             connTls,
+		"SSH-2.0-OpenSSH_9.6\r\n":          connSsh,
+		"GET / HTTP/1.1\r\n":               connHttp,
+		"OPTIONS * HTTP/1.1\r\n":           connHttp,
+		"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n": connHttp,
+		"GETX / HTTP/1.1\r\n":              connUnknown,
+		"SMTP":                             connUnknown,
+		"\x16\x01":                         connUnknown,
+		"\x00\x01\x02":                     connUnknown,
+	} {
+		r := bufio.NewReader(strings.NewReader(data))
+		kind, err := classify(r)
+		if err != nil || kind != want {
+			t.Errorf("classify(%q) = %s, %v, want %s", data, kind, err, want)
+		}
+		// 识别不消耗数据
+		if rest, _ := io.ReadAll(r); string(rest) != data {
+			t.Errorf("classify(%q) consumed data", data)
+		}
+	}
+	if _, err := classify(bufio.NewReader(strings.NewReader(""))); err == nil {
+		t.Error("empty connection classified")
+	}
+}
+
+func TestSniffProxyHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sniff := func(s *TcpServer, data string) (connKind, *sniffConn, error) {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if _, err := client.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return s.sniff(conn)
+	}
+	const request = "GET / HTTP/1.1\r\n\r\n"
+	const header = "PROXY TCP4 192.0.2.1 198.51.100.1 12345 80\r\n"
+
+	kind, sc, err := sniff(&TcpServer{}, request)
+	if err != nil || kind != connHttp || sc.RemoteAddr().String() != sc.Conn.RemoteAddr().String() {
+		t.Fatalf("plain request: %s, %v", kind, err)
+	}
+	if _, _, err := sniff(&TcpServer{}, header+request); err == nil {
+		t.Fatal("proxy header from an untrusted address accepted")
+	}
+
+	// 可信代理发送的头部被消耗, 访客地址取自头部
+	trusted := &TcpServer{trustedProxies: parseTrustedProxies([]string{"127.0.0.1"})}
+	kind, sc, err = sniff(trusted, header+request)
+	if err != nil || kind != connHttp {
+		t.Fatalf("request behind a proxy: %s, %v", kind, err)
+	}
+	if addr := sc.RemoteAddr().String(); addr != "192.0.2.1:12345" {
+		t.Fatalf("remote addr = %s", addr)
+	}
+	buf := make([]byte, len(request))
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != request {
+		t.Fatalf("replayed %q, %v", buf, err)
+	}
+	if _, _, err := sniff(trusted, "PROXY TCP4 bad\r\n"+request); err == nil {
+		t.Fatal("invalid proxy header accepted")
+	}
+}
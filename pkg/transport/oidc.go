@@ -0,0 +1,523 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+const (
+	oidcPathPrefix    = "/.tunnel/oidc/"            // 路由域名下由服务端处理的登录路径
+	oidcCallbackPath  = oidcPathPrefix + "callback" // 身份提供方回调地址
+	oidcLogoutPath    = oidcPathPrefix + "logout"   // 清除登录状态
+	oidcSessionCookie = "_tunnel_session"           // 登录状态 cookie
+	oidcStateCookie   = "_tunnel_oidc"              // 登录过程中绑定浏览器的随机值
+	oidcSessionTTL    = 12 * time.Hour              // 登录状态有效期
+	oidcStateTTL      = 10 * time.Minute            // 完成登录的时间
+	oidcHttpTimeout   = 10 * time.Second            // 请求身份提供方的超时时间
+	oidcKeysTTL       = time.Hour                   // 缓存身份提供方公钥的时间
+)
+
+// oidcIdentityHeaders carry the logged in identity to the target, visitor supplied values are dropped
+var oidcIdentityHeaders = []string{"X-Auth-Request-User", "X-Auth-Request-Email", "X-Auth-Request-Groups"}
+
+// oidcSigningAlgs are the id_token algorithms accepted from an issuer
+var oidcSigningAlgs = []string{
+	oidc.RS256, oidc.RS384, oidc.RS512,
+	oidc.PS256, oidc.PS384, oidc.PS512,
+	oidc.ES256, oidc.ES384, oidc.ES512,
+}
+
+// oidcCurves is the curve of the key each ES algorithm requires
+var oidcCurves = map[string]elliptic.Curve{
+	oidc.ES256: elliptic.P256(),
+	oidc.ES384: elliptic.P384(),
+	oidc.ES512: elliptic.P521(),
+}
+
+// oidcProvider is the discovered configuration and signing keys of an issuer
+type oidcProvider struct {
+	issuer   string
+	provider *oidc.Provider
+	keys     *oidcKeySet
+}
+
+// oidcIdentity is the part of the id_token kept in the session cookie
+type oidcIdentity struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	Host    string   `json:"host"` // 只在登录的域名下有效
+	Expiry  int64    `json:"exp"`
+}
+
+// oidcState is signed into the state parameter of the authorization request
+type oidcState struct {
+	Nonce  string `json:"nonce"`
+	URL    string `json:"url"` // 登录完成后返回的地址
+	Expiry int64  `json:"exp"`
+}
+
+// idTokenClaims are the id_token claims the login gate checks, the issuer, audience,
+// lifetime and signature are verified by go-oidc
+type idTokenClaims struct {
+	Subject       string   `json:"sub"`
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+	Groups        []string `json:"groups"`
+}
+
+// signValue encodes v as base64 json followed by its HMAC signature
+func (s *TcpServer) signValue(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyValue checks the signature created by signValue and decodes the value into v
+func (s *TcpServer) verifyValue(signed string, v any) error {
+	payload, sig, ok := strings.Cut(signed, ".")
+	if !ok {
+		return errors.New("malformed signed value")
+	}
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write([]byte(payload))
+	expected := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return errors.New("invalid signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// oidcSession returns the identity of a valid session cookie for the route host
+func (s *TcpServer) oidcSession(route *model.Route, r *http.Request) *oidcIdentity {
+	cookie, err := r.Cookie(oidcSessionCookie)
+	if err != nil {
+		return nil
+	}
+	var identity oidcIdentity
+	if err := s.verifyValue(cookie.Value, &identity); err != nil {
+		return nil
+	}
+	if identity.Host != route.Hostname || time.Now().Unix() > identity.Expiry {
+		return nil
+	}
+	return &identity
+}
+
+// setIdentityHeaders passes the identity to the target and removes the session cookie
+func setIdentityHeaders(r *http.Request, identity *oidcIdentity) {
+	r.Header.Set("X-Auth-Request-User", identity.Subject)
+	if identity.Email != "" {
+		r.Header.Set("X-Auth-Request-Email", identity.Email)
+	}
+	if len(identity.Groups) > 0 {
+		r.Header.Set("X-Auth-Request-Groups", strings.Join(identity.Groups, ","))
+	}
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != oidcSessionCookie {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// requestURL rebuilds the absolute URL the visitor requested
+func requestURL(r *http.Request) *url.URL {
+	u := *r.URL
+	u.Scheme = "http"
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	u.Host = r.Host
+	return &u
+}
+
+// redirectURI is the callback address registered with the identity provider for the host
+func redirectURI(r *http.Request) string {
+	u := requestURL(r)
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: oidcCallbackPath}).String()
+}
+
+// randomString returns a random URL-safe string
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// startOidcLogin redirects the visitor to the identity provider
+func (s *TcpServer) startOidcLogin(w http.ResponseWriter, r *http.Request, route *model.Route) {
+	policy := route.Access.Oidc
+	provider, err := s.oidcProvider(policy.Issuer)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to discover oidc issuer %s", policy.Issuer)
+		s.writeError(w, r, route, http.StatusBadGateway, "The login provider is unavailable.")
+		return
+	}
+
+	nonce := randomString()
+	state, err := s.signValue(oidcState{
+		Nonce:  nonce,
+		URL:    requestURL(r).String(),
+		Expiry: time.Now().Add(oidcStateTTL).Unix(),
+	})
+	if err != nil {
+		s.writeError(w, r, route, http.StatusInternalServerError, "")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    nonce,
+		Path:     oidcPathPrefix,
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	config := provider.oauth2Config(policy, redirectURI(r))
+	http.Redirect(w, r, config.AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusFound)
+}
+
+// handleOidc serves the login paths under oidcPathPrefix on a route host
+func (s *TcpServer) handleOidc(w http.ResponseWriter, r *http.Request, route *model.Route) {
+	switch r.URL.Path {
+	case oidcCallbackPath:
+		s.handleOidcCallback(w, r, route)
+	case oidcLogoutPath:
+		s.handleOidcLogout(w, r, route)
+	default:
+		s.writeError(w, r, route, http.StatusNotFound, "")
+	}
+}
+
+// handleOidcLogout clears the session cookie. Only same-origin POST requests are accepted so
+// that other sites cannot log the visitor out with a link or an image
+func (s *TcpServer) handleOidcLogout(w http.ResponseWriter, r *http.Request, route *model.Route) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.writeError(w, r, route, http.StatusMethodNotAllowed, "Log out with a POST request.")
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			s.writeError(w, r, route, http.StatusForbidden, "Cross-site logout requests are not allowed.")
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcSessionCookie, Value: "", Path: "/", MaxAge: -1})
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("Logged out\n"))
+}
+
+// handleOidcCallback exchanges the authorization code, checks the id_token against the route
+// policy and sets the session cookie
+func (s *TcpServer) handleOidcCallback(w http.ResponseWriter, r *http.Request, route *model.Route) {
+	policy := route.Access.Oidc
+	fail := func(status int, msg string, err error) {
+		log.Warn().Err(err).Msgf("OIDC login to %s failed", route.Hostname)
+		s.writeError(w, r, route, status, msg)
+	}
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		fail(http.StatusForbidden, "The login was rejected by the login provider.", errors.New(e))
+		return
+	}
+	var state oidcState
+	if err := s.verifyValue(r.URL.Query().Get("state"), &state); err != nil {
+		fail(http.StatusBadRequest, "The login request is invalid, please retry.", err)
+		return
+	}
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || cookie.Value != state.Nonce || time.Now().Unix() > state.Expiry {
+		fail(http.StatusBadRequest, "The login request has expired, please retry.", err)
+		return
+	}
+
+	provider, err := s.oidcProvider(policy.Issuer)
+	if err != nil {
+		fail(http.StatusBadGateway, "The login provider is unavailable.", err)
+		return
+	}
+	ctx := oidcContext(r.Context())
+	token, err := provider.oauth2Config(policy, redirectURI(r)).Exchange(ctx, r.URL.Query().Get("code"))
+	if err != nil {
+		fail(http.StatusBadGateway, "The login provider did not accept the login.", err)
+		return
+	}
+	rawToken, _ := token.Extra("id_token").(string)
+	if rawToken == "" {
+		fail(http.StatusBadGateway, "The login provider did not accept the login.", errors.New("no id_token in token response"))
+		return
+	}
+	claims, err := provider.verify(ctx, policy, rawToken, state.Nonce)
+	if err != nil {
+		fail(http.StatusForbidden, "The login could not be verified.", err)
+		return
+	}
+	if !oidcAllowed(policy, claims) {
+		fail(http.StatusForbidden, "Your account is not allowed to access this host.", fmt.Errorf("%s (%s) is not allowed", claims.Subject, claims.Email))
+		return
+	}
+
+	session, err := s.signValue(oidcIdentity{
+		Subject: claims.Subject,
+		Email:   claims.Email,
+		Groups:  claims.Groups,
+		Host:    route.Hostname,
+		Expiry:  time.Now().Add(oidcSessionTTL).Unix(),
+	})
+	if err != nil {
+		fail(http.StatusInternalServerError, "", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcSessionCookie,
+		Value:    session,
+		Path:     "/",
+		MaxAge:   int(oidcSessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: oidcPathPrefix, MaxAge: -1})
+	log.Info().Msgf("%s logged in to %s", claims.Email, route.Hostname)
+
+	// 只允许跳回当前域名，避免开放重定向
+	next := "/"
+	if u, err := url.Parse(state.URL); err == nil && u.Host == r.Host {
+		next = u.RequestURI()
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// oidcAllowed checks the identity against the allowed emails, domains and groups of the policy,
+// an empty policy allows every account of the issuer
+func oidcAllowed(policy *model.OidcPolicy, claims *idTokenClaims) bool {
+	if len(policy.AllowedEmails) == 0 && len(policy.AllowedDomains) == 0 && len(policy.AllowedGroups) == 0 {
+		return true
+	}
+	emailOk := claims.Email != "" && (claims.EmailVerified == nil || *claims.EmailVerified)
+	if emailOk {
+		for _, email := range policy.AllowedEmails {
+			if strings.EqualFold(email, claims.Email) {
+				return true
+			}
+		}
+		for _, domain := range policy.AllowedDomains {
+			if strings.HasSuffix(strings.ToLower(claims.Email), "@"+strings.ToLower(strings.TrimPrefix(domain, "@"))) {
+				return true
+			}
+		}
+	}
+	for _, group := range policy.AllowedGroups {
+		for _, g := range claims.Groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var oidcClient = &http.Client{Timeout: oidcHttpTimeout}
+
+// oidcContext makes go-oidc and oauth2 use oidcClient for requests to the identity provider
+func oidcContext(ctx context.Context) context.Context {
+	ctx = oidc.ClientContext(ctx, oidcClient)
+	return context.WithValue(ctx, oauth2.HTTPClient, oidcClient)
+}
+
+// oidcProvider returns the discovered configuration of the issuer
+func (s *TcpServer) oidcProvider(issuer string) (*oidcProvider, error) {
+	if p, ok := s.oidcProviders.Load(issuer); ok {
+		return p.(*oidcProvider), nil
+	}
+	// 发现过程不随访客请求取消, 结果会被缓存
+	provider, err := oidc.NewProvider(oidcContext(context.Background()), issuer)
+	if err != nil {
+		return nil, err
+	}
+	var discovery struct {
+		JwksURI string `json:"jwks_uri"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		return nil, err
+	}
+	if discovery.JwksURI == "" {
+		return nil, errors.New("incomplete openid configuration")
+	}
+	p, _ := s.oidcProviders.LoadOrStore(issuer, &oidcProvider{issuer: issuer, provider: provider, keys: &oidcKeySet{uri: discovery.JwksURI}})
+	return p.(*oidcProvider), nil
+}
+
+// oauth2Config is the authorization code flow configuration of the route policy
+func (p *oidcProvider) oauth2Config(policy *model.OidcPolicy, redirect string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     policy.ClientID,
+		ClientSecret: policy.ClientSecret,
+		Endpoint:     p.provider.Endpoint(),
+		RedirectURL:  redirect,
+		Scopes:       append([]string{oidc.ScopeOpenID, "email", "profile"}, policy.Scopes...),
+	}
+}
+
+// verify checks the signature, issuer, audience, lifetime and nonce of the id_token
+func (p *oidcProvider) verify(ctx context.Context, policy *model.OidcPolicy, rawToken, nonce string) (*idTokenClaims, error) {
+	// 使用检查密钥类型的 key set 代替 go-oidc 默认的 RemoteKeySet
+	verifier := oidc.NewVerifier(p.issuer, p.keys, &oidc.Config{ClientID: policy.ClientID, SupportedSigningAlgs: oidcSigningAlgs})
+	idToken, err := verifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	var claims idTokenClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id_token has no subject")
+	}
+	return &claims, nil
+}
+
+// oidcKeySet is the JWKS of an issuer. Besides the algorithm allowlist it checks that the
+// algorithm in the token header matches the type and curve of the signing key
+type oidcKeySet struct {
+	uri       string
+	keys      []jose.JSONWebKey
+	fetchedAt time.Time
+	mutex     sync.Mutex
+}
+
+// VerifySignature implements oidc.KeySet
+func (k *oidcKeySet) VerifySignature(ctx context.Context, rawToken string) ([]byte, error) {
+	algs := make([]jose.SignatureAlgorithm, len(oidcSigningAlgs))
+	for i, alg := range oidcSigningAlgs {
+		algs[i] = jose.SignatureAlgorithm(alg)
+	}
+	jws, err := jose.ParseSigned(rawToken, algs)
+	if err != nil {
+		return nil, err
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, errors.New("id_token must have exactly one signature")
+	}
+	header := jws.Signatures[0].Protected
+	key, err := k.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if !keyMatchesAlg(key, header.Algorithm) {
+		return nil, fmt.Errorf("signing key %q does not match algorithm %s", header.KeyID, header.Algorithm)
+	}
+	return jws.Verify(key.Key)
+}
+
+// key returns the signing key with the ID, the keys are fetched again when they are stale
+// or the ID is unknown, to pick up rotated keys
+func (k *oidcKeySet) key(ctx context.Context, kid string) (*jose.JSONWebKey, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if time.Since(k.fetchedAt) < oidcKeysTTL {
+		if key := k.find(kid); key != nil {
+			return key, nil
+		}
+	}
+	if err := k.fetch(ctx); err != nil {
+		return nil, err
+	}
+	if key := k.find(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// find returns the signing key with the ID, a token without key ID uses the only key
+func (k *oidcKeySet) find(kid string) *jose.JSONWebKey {
+	var keys []*jose.JSONWebKey
+	for i := range k.keys {
+		if k.keys[i].Use == "" || k.keys[i].Use == "sig" {
+			keys = append(keys, &k.keys[i])
+		}
+	}
+	if kid == "" && len(keys) == 1 {
+		return keys[0]
+	}
+	for _, key := range keys {
+		if kid != "" && key.KeyID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+func (k *oidcKeySet) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.uri, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching signing keys: unexpected status %d", resp.StatusCode)
+	}
+	var set jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	k.keys, k.fetchedAt = set.Keys, time.Now()
+	return nil
+}
+
+// keyMatchesAlg reports whether the key can sign with the algorithm, RS and PS need an RSA
+// key and ES needs an ECDSA key on the curve of the algorithm
+func keyMatchesAlg(key *jose.JSONWebKey, alg string) bool {
+	if key.Algorithm != "" && key.Algorithm != alg {
+		return false
+	}
+	switch pub := key.Key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		curve, ok := oidcCurves[alg]
+		return ok && pub.Curve == curve
+	}
+	return false
+}
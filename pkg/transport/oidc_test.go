@@ -0,0 +1,307 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+// mockIdp is an OpenID provider serving discovery, a JWKS with an RSA and a P-256 key and a
+// token endpoint returning idToken
+type mockIdp struct {
+	*httptest.Server
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	idToken string
+}
+
+func newMockIdp(t *testing.T) *mockIdp {
+	idp := &mockIdp{}
+	var err error
+	if idp.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if idp.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256", "ES256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &idp.rsaKey.PublicKey, KeyID: "rsa", Use: "sig"},
+			{Key: &idp.ecKey.PublicKey, KeyID: "ec", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     idp.idToken,
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdp) claims(nonce string) map[string]any {
+	return map[string]any{
+		"iss":   idp.URL,
+		"sub":   "user-1",
+		"aud":   "client",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": nonce,
+		"email": "alice@example.com",
+	}
+}
+
+// sign signs the claims with a key of the provider
+func (idp *mockIdp) sign(t *testing.T, alg jose.SignatureAlgorithm, kid string, claims map[string]any) string {
+	var key any = idp.rsaKey
+	if kid == "ec" {
+		key = idp.ecKey
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: jose.JSONWebKey{Key: key, KeyID: kid}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(claims)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// forge builds a token with an arbitrary header and signature
+func forge(header map[string]any, claims map[string]any, signature []byte) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc(h) + "." + enc(c) + "." + enc(signature)
+}
+
+func newOidcTestServer(issuer string) (*TcpServer, *model.Route) {
+	s := &TcpServer{
+		ctx:        &svc.ServerCtx{Stats: svc.NewStats(nil)},
+		sessionKey: []byte("test-session-key"),
+	}
+	route := &model.Route{ID: "r1", Hostname: "app.example.com", Access: model.AccessPolicy{
+		Oidc: &model.OidcPolicy{Issuer: issuer, ClientID: "client", ClientSecret: "secret"},
+	}}
+	return s, route
+}
+
+func TestOidcLogin(t *testing.T) {
+	idp := newMockIdp(t)
+	s, route := newOidcTestServer(idp.URL)
+
+	// 未登录的访客被重定向到身份提供方
+	r := httptest.NewRequest(http.MethodGet, "http://app.example.com/private?x=1", nil)
+	w := httptest.NewRecorder()
+	s.startOidcLogin(w, r, route)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login status = %d, want 302", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), idp.URL+"/authorize") {
+		t.Fatalf("login redirect = %q", w.Header().Get("Location"))
+	}
+	query := location.Query()
+	if query.Get("client_id") != "client" || !strings.Contains(query.Get("scope"), "openid") {
+		t.Fatalf("authorize query = %v", query)
+	}
+	var stateCookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			stateCookie = c
+		}
+	}
+	if stateCookie == nil || stateCookie.Value != query.Get("nonce") {
+		t.Fatalf("state cookie %v does not carry the nonce %q", stateCookie, query.Get("nonce"))
+	}
+
+	idp.idToken = idp.sign(t, jose.RS256, "rsa", idp.claims(query.Get("nonce")))
+	callback := "http://app.example.com" + oidcCallbackPath + "?" + url.Values{
+		"code":  {"good-code"},
+		"state": {query.Get("state")},
+	}.Encode()
+	r = httptest.NewRequest(http.MethodGet, callback, nil)
+	r.AddCookie(stateCookie)
+	w = httptest.NewRecorder()
+	s.handleOidc(w, r, route)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/private?x=1" {
+		t.Fatalf("callback = %d %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://app.example.com/private", nil)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcSessionCookie {
+			r.AddCookie(c)
+		}
+	}
+	identity := s.oidcSession(route, r)
+	if identity == nil || identity.Subject != "user-1" || identity.Email != "alice@example.com" {
+		t.Fatalf("session identity = %+v", identity)
+	}
+	other := *route
+	other.Hostname = "other.example.com"
+	if s.oidcSession(&other, r) != nil {
+		t.Fatal("session cookie accepted for another host")
+	}
+}
+
+func TestOidcLogout(t *testing.T) {
+	s, route := newOidcTestServer("https://idp.example.com")
+	logout := "http://app.example.com" + oidcLogoutPath
+	for _, tc := range []struct {
+		method, origin string
+		status         int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "https://evil.example.com", http.StatusForbidden},
+		{http.MethodPost, "http://app.example.com", http.StatusOK},
+		{http.MethodPost, "", http.StatusOK},
+	} {
+		r := httptest.NewRequest(tc.method, logout, nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		s.handleOidc(w, r, route)
+		cleared := false
+		for _, c := range w.Result().Cookies() {
+			cleared = cleared || c.Name == oidcSessionCookie && c.MaxAge < 0
+		}
+		if w.Code != tc.status || cleared != (tc.status == http.StatusOK) {
+			t.Errorf("%s origin %q = %d, cookie cleared %v", tc.method, tc.origin, w.Code, cleared)
+		}
+	}
+}
+
+func TestOidcVerifyRejects(t *testing.T) {
+	idp := newMockIdp(t)
+	s, route := newOidcTestServer(idp.URL)
+	provider, err := s.oidcProvider(idp.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := oidcContext(context.Background())
+	verify := func(token string) error {
+		_, err := provider.verify(ctx, route.Access.Oidc, token, "n")
+		return err
+	}
+
+	if err := verify(idp.sign(t, jose.RS256, "rsa", idp.claims("n"))); err != nil {
+		t.Fatalf("RS256 token rejected: %v", err)
+	}
+	if err := verify(idp.sign(t, jose.ES256, "ec", idp.claims("n"))); err != nil {
+		t.Fatalf("ES256 token rejected: %v", err)
+	}
+
+	claims := idp.claims("n")
+	for name, token := range map[string]string{
+		"empty alg":     forge(map[string]any{"alg": "", "kid": "rsa"}, claims, []byte("x")),
+		"short alg":     forge(map[string]any{"alg": "no", "kid": "rsa"}, claims, []byte("x")),
+		"none alg":      forge(map[string]any{"alg": "none", "kid": "rsa"}, claims, nil),
+		"HS256":         forge(map[string]any{"alg": "HS256", "kid": "rsa"}, claims, []byte("x")),
+		"ES384 on P256": forge(map[string]any{"alg": "ES384", "kid": "ec"}, claims, make([]byte, 96)),
+		"ES256 on RSA":  forge(map[string]any{"alg": "ES256", "kid": "rsa"}, claims, make([]byte, 64)),
+		"unknown key":   forge(map[string]any{"alg": "RS256", "kid": "missing"}, claims, []byte("x")),
+		"garbage":       "not.a.token",
+	} {
+		if err := verify(token); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+
+	if err := verify(idp.sign(t, jose.RS256, "rsa", idp.claims("other"))); err == nil {
+		t.Error("nonce mismatch accepted")
+	}
+	claims = idp.claims("n")
+	claims["aud"] = "another-client"
+	if err := verify(idp.sign(t, jose.RS256, "rsa", claims)); err == nil {
+		t.Error("wrong audience accepted")
+	}
+	claims = idp.claims("n")
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	if err := verify(idp.sign(t, jose.RS256, "rsa", claims)); err == nil {
+		t.Error("expired token accepted")
+	}
+}
+
+func TestOidcAllowed(t *testing.T) {
+	claims := &idTokenClaims{Subject: "u", Email: "alice@example.com", Groups: []string{"dev"}}
+	for _, tc := range []struct {
+		policy model.OidcPolicy
+		want   bool
+	}{
+		{model.OidcPolicy{}, true},
+		{model.OidcPolicy{AllowedEmails: []string{"alice@example.com"}}, true},
+		{model.OidcPolicy{AllowedEmails: []string{"bob@example.com"}}, false},
+		{model.OidcPolicy{AllowedDomains: []string{"example.com"}}, true},
+		{model.OidcPolicy{AllowedDomains: []string{"example.org"}}, false},
+		{model.OidcPolicy{AllowedGroups: []string{"dev"}}, true},
+		{model.OidcPolicy{AllowedGroups: []string{"ops"}}, false},
+	} {
+		if got := oidcAllowed(&tc.policy, claims); got != tc.want {
+			t.Errorf("oidcAllowed(%+v) = %v, want %v", tc.policy, got, tc.want)
+		}
+	}
+}
+
+func TestKeyMatchesAlg(t *testing.T) {
+	idp := newMockIdp(t)
+	rsaKey := &jose.JSONWebKey{Key: &idp.rsaKey.PublicKey}
+	ecKey := &jose.JSONWebKey{Key: &idp.ecKey.PublicKey}
+	for _, tc := range []struct {
+		key  *jose.JSONWebKey
+		alg  string
+		want bool
+	}{
+		{rsaKey, "RS256", true},
+		{rsaKey, "PS512", true},
+		{rsaKey, "ES256", false},
+		{ecKey, "ES256", true},
+		{ecKey, "ES384", false},
+		{ecKey, "RS256", false},
+		{&jose.JSONWebKey{Key: &idp.rsaKey.PublicKey, Algorithm: "RS512"}, "RS256", false},
+	} {
+		if got := keyMatchesAlg(tc.key, tc.alg); got != tc.want {
+			t.Errorf("keyMatchesAlg(%T, %s) = %v, want %v", tc.key.Key, tc.alg, got, tc.want)
+		}
+	}
+}
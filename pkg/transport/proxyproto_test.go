@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header builds a PROXY protocol v2 header with the command and address family
+func proxyV2Header(command, family byte, addr []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addr)))
+	return append(header, addr...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(v6[32:34], 443)
+
+	for _, tc := range []struct {
+		name   string
+		header string
+		addr   string // 为空表示没有客户端地址
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n", "192.0.2.1:12345", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 443 80\r\n", "[2001:db8::1]:443", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 missing fields", "PROXY TCP4 192.0.2.1\r\n", "", true},
+		{"v1 udp", "PROXY UDP4 192.0.2.1 198.51.100.1 1 2\r\n", "", true},
+		{"v1 bad address", "PROXY TCP4 example 198.51.100.1 1 2\r\n", "", true},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 http 2\r\n", "", true},
+		{"v1 no crlf", "PROXY TCP4 192.0.2.1 198.51.100.1 1 2\n", "", true},
+		{"v1 too long", "PROXY " + strings.Repeat("x", proxyV1MaxLength), "", true},
+		{"not proxy", "GET / HTTP/1.1\r\n", "", true},
+		{"v2 tcp4", string(proxyV2Header(1, 0x11, v4)), "192.0.2.1:12345", false},
+		{"v2 tcp6", string(proxyV2Header(1, 0x21, v6)), "[2001:db8::1]:443", false},
+		{"v2 local", string(proxyV2Header(0, 0x11, v4)), "", false},
+		{"v2 unix", string(proxyV2Header(1, 0x31, make([]byte, 216))), "", false},
+		{"v2 short address", string(proxyV2Header(1, 0x11, v4[:8])), "", true},
+		{"v2 truncated", string(proxyV2Header(1, 0x11, v4)[:20]), "", true},
+	} {
+		r := bufio.NewReader(strings.NewReader(tc.header + "payload"))
+		addr, err := readProxyHeader(r)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: err = %v", tc.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tc.addr {
+			t.Errorf("%s: addr = %q, want %q", tc.name, got, tc.addr)
+		}
+		// 头部之后的数据保留给协议识别
+		if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+			t.Errorf("%s: remaining data %q", tc.name, rest)
+		}
+	}
+
+	version1 := proxyV2Header(1, 0x11, v4)
+	version1[12] = 0x11
+	if _, err := readProxyHeader(bufio.NewReader(strings.NewReader(string(version1)))); err == nil {
+		t.Error("v2 signature with version 1 accepted")
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	s := &TcpServer{trustedProxies: parseTrustedProxies([]string{"10.0.0.0/8", " ", "192.0.2.1", "not-an-ip"})}
+	if len(s.trustedProxies) != 2 {
+		t.Fatalf("parsed %d trusted proxies, want 2", len(s.trustedProxies))
+	}
+	for addr, want := range map[string]bool{
+		"10.1.2.3:1000":    true,
+		"192.0.2.1:1000":   true,
+		"192.0.2.2:1000":   false,
+		"[2001:db8::]:100": false,
+	} {
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+		if got := s.isTrustedProxy(tcpAddr); got != want {
+			t.Errorf("isTrustedProxy(%s) = %v", addr, got)
+		}
+	}
+}
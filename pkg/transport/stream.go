@@ -0,0 +1,513 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/acme"
+
+	"github.com/obud-dev/tunnel/pkg/message"
+	"github.com/obud-dev/tunnel/pkg/metrics"
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/svc"
+	"github.com/obud-dev/tunnel/pkg/tracing"
+	"github.com/obud-dev/tunnel/pkg/utils"
+)
+
+const streamQueueSize = 64 // 每个流等待写入目标的消息数上限
+
+// streamDefaultPorts are the target ports used when a stream route target has none
+var streamDefaultPorts = map[model.Protocol]string{
+	model.TypeTlsPassthrough: "443",
+	model.TypeSsh:            "22",
+}
+
+var errClientHelloRead = errors.New("client hello read")
+
+// readOnlyConn lets the tls package read a ClientHello without answering it
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekedConn replays the bytes read while peeking before reading from the connection
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// peekClientHello reads the TLS ClientHello from conn and returns its SNI server name
+// together with a connection that still yields the ClientHello to the next reader
+func peekClientHello(conn net.Conn) (string, net.Conn, error) {
+	var buf bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return "", nil, err
+	}
+	return hello.ServerName, &peekedConn{Conn: conn, r: io.MultiReader(&buf, conn)}, nil
+}
+
+// handleTls dispatches a public TLS connection by its SNI server name, tls-passthrough routes
+// are forwarded without decrypting and everything else is terminated with conf
+func (s *TcpServer) handleTls(conn net.Conn, conf *tls.Config) {
+	conn.SetReadDeadline(time.Now().Add(tlsHandshakeTimeout))
+	name, peeked, err := peekClientHello(conn)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to read TLS ClientHello")
+		metrics.HandshakeFailures.WithLabelValues("tls").Inc()
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	s.ctx.Mutex.Lock()
+	route := s.ctx.MatchRoute(name)
+	s.ctx.Mutex.Unlock()
+	if route != nil && route.Protocol == model.TypeTlsPassthrough {
+		s.handleStream(peeked, route)
+		return
+	}
+
+	tlsConn := tls.Server(peeked, conf)
+	// 首次访问某个域名时握手期间会申请证书，超时时间需要留足
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	err = tlsConn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		log.Debug().Err(err).Msg("TLS handshake failed")
+		metrics.HandshakeFailures.WithLabelValues("tls").Inc()
+		conn.Close()
+		return
+	}
+	// tls-alpn-01 验证连接在握手后即结束
+	if tlsConn.ConnectionState().NegotiatedProtocol == acme.ALPNProto {
+		tlsConn.Close()
+		return
+	}
+	s.handleHttp(tlsConn)
+}
+
+// handleSsh forwards an SSH visitor to the ssh route. SSH does not tell which host the
+// visitor wants, so exactly one ssh route may exist
+func (s *TcpServer) handleSsh(conn net.Conn) {
+	var route *model.Route
+	s.ctx.Mutex.Lock()
+	for i := range s.ctx.Routes {
+		if s.ctx.Routes[i].Protocol != model.TypeSsh {
+			continue
+		}
+		if route != nil {
+			route = nil
+			log.Error().Msg("More than one ssh route, cannot forward ssh connection")
+			break
+		}
+		r := s.ctx.Routes[i]
+		route = &r
+	}
+	s.ctx.Mutex.Unlock()
+	if route == nil {
+		log.Error().Msgf("No ssh route for %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	s.handleStream(conn, route)
+}
+
+// handleStream forwards a visitor connection through the tunnel of route as a raw byte stream
+func (s *TcpServer) handleStream(conn net.Conn, route *model.Route) {
+	ctx, span := tracing.Tracer.Start(context.Background(), "visitor.accept",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("server.address", route.Hostname),
+			attribute.String("client.address", utils.AddrIP(conn.RemoteAddr()).String()),
+			attribute.String("tunnel.route_id", route.ID),
+		))
+	defer span.End()
+	s.ctx.Stats.Connection(route)
+
+	// 连接结束或被拒绝时记录访问日志
+	entry := &svc.AccessEntry{
+		Time:     time.Now(),
+		Type:     string(route.Protocol),
+		Host:     route.Hostname,
+		RouteID:  route.ID,
+		TunnelID: route.TunnelID,
+		ClientIP: utils.AddrIP(conn.RemoteAddr()).String(),
+	}
+	defer func() {
+		entry.Duration = float64(time.Since(entry.Time).Microseconds()) / 1000
+		s.ctx.AccessLog.Log(entry)
+	}()
+
+	if !allowIP(route.Access, utils.AddrIP(conn.RemoteAddr())) {
+		log.Warn().Msgf("%s denied access to %s", conn.RemoteAddr(), route.Hostname)
+		entry.Error = "access_denied"
+		conn.Close()
+		return
+	}
+	if !s.ctx.Limiter.Allow(route, utils.AddrIP(conn.RemoteAddr()).String()) {
+		log.Warn().Msgf("%s exceeded the connection rate of %s", conn.RemoteAddr(), route.Hostname)
+		entry.Error = "rate_limited"
+		conn.Close()
+		return
+	}
+	if exhausted, _ := s.ctx.Traffic.Exhausted(route.TunnelID); exhausted {
+		log.Warn().Msgf("Traffic quota of tunnel %s exhausted", route.TunnelID)
+		entry.Error = "quota_exhausted"
+		conn.Close()
+		return
+	}
+	tunnel, err := s.ctx.WaitTunnel(route.TunnelID)
+	if err != nil {
+		log.Error().Err(err).Msgf("tunnel %s unavailable", route.TunnelID)
+		span.SetStatus(codes.Error, err.Error())
+		s.ctx.Stats.Error(route)
+		entry.Error = "tunnel_unavailable"
+		conn.Close()
+		return
+	}
+	release, ok := s.ctx.Limiter.Acquire(route, tunnel.MaxStreams)
+	if !ok {
+		log.Warn().Msgf("Too many connections to %s", route.Hostname)
+		entry.Error = "conn_limited"
+		conn.Close()
+		return
+	}
+	defer release()
+
+	ctx, send := tracing.Tracer.Start(ctx, "tunnel.send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("tunnel.id", route.TunnelID)))
+	defer send.End()
+	visitor := svc.NewActiveTunnel(conn, tunnel.Token)
+	visitor.Route = route
+	visitor.Trace = tracing.Inject(ctx)
+	if route.Inspect {
+		visitor.Capture = &svc.CapturedStream{
+			ID:         utils.GenerateID(),
+			RouteID:    route.ID,
+			Protocol:   string(route.Protocol),
+			Time:       time.Now(),
+			ClientAddr: conn.RemoteAddr().String(),
+			Target:     route.Target,
+		}
+		s.ctx.Inspector.AddStream(visitor.Capture)
+		defer visitor.Capture.Close()
+	}
+	s.forwardStream(utils.GenerateID(), visitor, tunnel)
+	entry.BytesIn, entry.BytesOut = visitor.BytesIn.Load(), visitor.BytesOut.Load()
+	if err := visitor.Err(); err != nil {
+		entry.Error = string(errorCode(err))
+	}
+}
+
+// forwardStream relays the visitor connection through tunnel until either side closes it,
+// all messages of the stream share messageId and either side ends it with a disconnect message
+func (s *TcpServer) forwardStream(messageId string, visitor *svc.ActiveTunnel, tunnel *svc.ActiveTunnel) {
+	route := visitor.Route
+	log.Debug().Msgf("Stream %s opened for %s", messageId, route.Hostname)
+	s.ctx.Mutex.Lock()
+	s.ctx.Messages[messageId] = visitor
+	s.ctx.Mutex.Unlock()
+	metrics.ActiveStreams.Inc()
+	defer func() {
+		metrics.ActiveStreams.Dec()
+		visitor.Close()
+		s.ctx.Mutex.Lock()
+		delete(s.ctx.Messages, messageId)
+		s.ctx.Mutex.Unlock()
+		log.Debug().Msgf("Stream %s closed", messageId)
+	}()
+
+	go s.sendToVisitor(visitor)
+
+	target, traceData := route.Target, visitor.Trace
+	var options []byte
+	if route.Options != (model.TargetOptions{}) {
+		options, _ = json.Marshal(route.Options)
+	}
+	var timeout int64
+	if route.Protocol == model.TypeHttp {
+		timeout = s.ctx.Config.ResponseTimeout.Milliseconds()
+	}
+	buf := make([]byte, messageChunkSize)
+	for {
+		n, err := visitor.Conn.Read(buf)
+		if n > 0 {
+			if !s.ctx.Traffic.Download(route.TunnelID, n, visitor.Done) {
+				log.Warn().Msgf("Traffic quota of tunnel %s exhausted", route.TunnelID)
+				return
+			}
+			visitor.BytesIn.Add(int64(n))
+			if visitor.Capture != nil {
+				visitor.Capture.Record(false, buf[:n])
+			}
+			s.ctx.Stats.BytesIn(route, n)
+			m := message.Message{
+				Id:       messageId,
+				Type:     message.MessageTypeData,
+				Protocol: route.Protocol,
+				Target:   target,
+				Options:  options,
+				Trace:    traceData,
+				Timeout:  timeout,
+				Data:     buf[:n],
+			}
+			data, err := m.Encrypt(tunnel.Token)
+			if err != nil {
+				log.Error().Err(err).Msg("Error marshalling message")
+				return
+			}
+			if !tunnel.Send(data) {
+				return
+			}
+			// 只有第一条消息需要携带目标信息
+			target, options, traceData, timeout = "", nil, nil, 0
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// 通知客户端关闭目标连接
+	m := message.Message{Id: messageId, Type: message.MessageTypeDisconnect}
+	if data, err := m.Encrypt(tunnel.Token); err == nil {
+		tunnel.Send(data)
+	}
+}
+
+// handleClientDisconnect closes the visitor stream whose target connection was closed,
+// after the data already sent to it has been written
+func (s *TcpServer) handleClientDisconnect(m message.Message) {
+	s.ctx.Mutex.Lock()
+	visitor, ok := s.ctx.Messages[m.Id]
+	s.ctx.Mutex.Unlock()
+	if !ok {
+		return
+	}
+	// 等待写完之前的数据, 不阻塞读取客户端消息
+	go visitor.Send(nil)
+}
+
+// stream is a connection to the target carried by the data messages with the same id
+type stream struct {
+	id      string
+	channel chan []byte // 发往目标的数据, nil 表示关闭
+	done    chan struct{}
+	once    sync.Once
+	mutex   sync.Mutex
+	conn    net.Conn
+}
+
+// setConn sets the target connection, it fails if the stream was closed while dialing
+func (st *stream) setConn(conn net.Conn) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	select {
+	case <-st.done:
+		return false
+	default:
+	}
+	st.conn = conn
+	return true
+}
+
+// close closes the target connection and stops the stream goroutines
+func (st *stream) close() {
+	st.once.Do(func() {
+		st.mutex.Lock()
+		defer st.mutex.Unlock()
+		close(st.done)
+		if st.conn != nil {
+			st.conn.Close()
+		}
+	})
+}
+
+// handleStreamData queues data for the target connection of the stream, opening the
+// connection on the first message. It runs in readLoop to keep the data in order, a stream
+// whose target does not keep up is closed instead of blocking the other streams
+func (c *TcpClient) handleStreamData(s *session, m message.Message) {
+	data, err := m.Decrypt(c.conf.Token)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to decrypt message")
+		return
+	}
+	m.Data = data
+
+	s.mutex.Lock()
+	st, ok := s.streams[m.Id]
+	if !ok && m.Target == "" {
+		// 目标连接已关闭，丢弃剩余数据
+		s.mutex.Unlock()
+		return
+	}
+	if !ok {
+		st = &stream{
+			id:      m.Id,
+			channel: make(chan []byte, streamQueueSize),
+			done:    make(chan struct{}),
+		}
+		s.streams[m.Id] = st
+		go c.runStream(s, st, m)
+	}
+	s.mutex.Unlock()
+
+	select {
+	case st.channel <- m.Data:
+	case <-st.done:
+	default:
+		log.Warn().Msgf("Target of stream %s is too slow, closing the stream", m.Id)
+		c.removeStream(s, st)
+		// 通知服务端关闭访客连接, 不阻塞读取服务端消息
+		go c.SendMessage(message.Message{Id: m.Id, Type: message.MessageTypeDisconnect})
+	}
+}
+
+// closeStream ends the stream with id once the queued data is written
+func (c *TcpClient) closeStream(s *session, id string) {
+	s.mutex.Lock()
+	st, ok := s.streams[id]
+	s.mutex.Unlock()
+	if !ok {
+		return
+	}
+	// 等待写完之前的数据, 不阻塞读取服务端消息
+	go func() {
+		select {
+		case st.channel <- nil:
+		case <-st.done:
+		}
+	}()
+}
+
+// removeStream closes the stream and forgets it
+func (c *TcpClient) removeStream(s *session, st *stream) {
+	s.mutex.Lock()
+	if s.streams[st.id] == st {
+		delete(s.streams, st.id)
+	}
+	s.mutex.Unlock()
+	st.close()
+}
+
+// runStream connects to the target and writes the queued data to it in order
+func (c *TcpClient) runStream(s *session, st *stream, m message.Message) {
+	metrics.ClientStreams.Inc()
+	defer metrics.ClientStreams.Dec()
+	defer c.removeStream(s, st)
+
+	ctx, cancel := context.WithTimeout(tracing.Extract(context.Background(), m.Trace), targetTimeout)
+	conn, err := c.openStream(ctx, m)
+	cancel()
+	if err != nil {
+		log.Error().Err(err).Msg("Error connecting to target")
+		c.SendError(m.Id, err)
+		return
+	}
+	if !st.setConn(conn) {
+		conn.Close()
+		return
+	}
+	go c.readStream(s, st)
+
+	for {
+		select {
+		case <-st.done:
+			return
+		case data := <-st.channel:
+			if data == nil {
+				return
+			}
+			if _, err := conn.Write(data); err != nil {
+				log.Error().Err(err).Msg("Error writing to target")
+				return
+			}
+			metrics.ClientBytes.WithLabelValues("in").Add(float64(len(data)))
+		}
+	}
+}
+
+// readStream relays data from the target to the server until the target closes the connection
+func (c *TcpClient) readStream(s *session, st *stream) {
+	defer c.removeStream(s, st)
+
+	w := &messageWriter{client: c, id: st.id}
+	if _, err := io.CopyBuffer(w, st.conn, make([]byte, messageChunkSize)); err != nil {
+		select {
+		case <-st.done:
+			// 服务端已关闭该流
+			return
+		default:
+			log.Debug().Err(err).Msg("Error reading from target")
+		}
+	}
+	c.SendMessage(message.Message{Id: st.id, Type: message.MessageTypeDisconnect})
+}
+
+// openStream returns the connection carrying the stream: HTTP requests are proxied by
+// clientd itself, other protocols are forwarded to the target as is
+func (c *TcpClient) openStream(ctx context.Context, m message.Message) (net.Conn, error) {
+	if m.Protocol == model.TypeHttp {
+		// 请求在拨号超时后仍会继续, 只保留 trace context
+		return c.serveHttpStream(context.WithoutCancel(ctx), m), nil
+	}
+	if m.Protocol.IsStream() {
+		ctx, span := tracing.Tracer.Start(ctx, "client.dial",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("tunnel.target", m.Target)))
+		conn, err := c.dialStream(ctx, m)
+		tracing.End(span, err)
+		return conn, err
+	}
+	return nil, fmt.Errorf("unsupported protocol: %s", m.Protocol)
+}
+
+// dialStream connects to the target of a stream route without interpreting the stream,
+// targets are host:port or unix:// sockets
+func (c *TcpClient) dialStream(ctx context.Context, m message.Message) (net.Conn, error) {
+	dialer := net.Dialer{}
+	scheme, addr := splitTarget(m.Target)
+	switch scheme {
+	case "http", "tcp":
+		return dialer.DialContext(ctx, "tcp", withDefaultPort(addr, streamDefaultPorts[m.Protocol]))
+	case "unix":
+		path, err := c.checkSocket(addr)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, "unix", path)
+	default:
+		return nil, fmt.Errorf("unsupported target scheme for %s: %s", m.Protocol, scheme)
+	}
+}
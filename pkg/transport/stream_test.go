@@ -0,0 +1,176 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/obud-dev/tunnel/pkg/config"
+	"github.com/obud-dev/tunnel/pkg/message"
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+const testToken = "0123456789abcdef"
+
+func encryptedData(t *testing.T, m message.Message) message.Message {
+	data, err := m.Encrypt(testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := message.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *encrypted
+}
+
+func TestHandleStreamDataOverflow(t *testing.T) {
+	// 接受连接但从不读取的目标
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c := &TcpClient{conf: &config.ClientConfig{Token: testToken}}
+	server, conn := net.Pipe()
+	defer server.Close()
+	s := &session{
+		conn:    conn,
+		channel: make(chan []byte, 16),
+		done:    make(chan struct{}),
+		streams: map[string]*stream{},
+	}
+	c.session = s
+	defer s.close()
+
+	chunk := make([]byte, 1<<20)
+	first := encryptedData(t, message.Message{Id: "s1", Type: message.MessageTypeData, Protocol: model.TypeSsh, Target: ln.Addr().String(), Data: chunk})
+	next := encryptedData(t, message.Message{Id: "s1", Type: message.MessageTypeData, Data: chunk})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.handleStreamData(s, first)
+		for i := 0; i < 256; i++ {
+			c.handleStreamData(s, next)
+			s.mutex.Lock()
+			_, ok := s.streams["s1"]
+			s.mutex.Unlock()
+			if !ok {
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("handleStreamData blocked on a slow target")
+	}
+
+	s.mutex.Lock()
+	_, ok := s.streams["s1"]
+	s.mutex.Unlock()
+	if ok {
+		t.Fatal("stream not closed after its queue overflowed")
+	}
+	// 服务端收到关闭该流的消息
+	select {
+	case data := <-s.channel:
+		m, err := message.Unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Type != message.MessageTypeDisconnect || m.Id != "s1" {
+			t.Fatalf("sent type %v for %q, want disconnect of s1", m.Type, m.Id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no disconnect sent to the server")
+	}
+}
+
+func TestPeekClientHello(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: "secure.example.com", InsecureSkipVerify: true}).Handshake()
+	defer client.Close()
+
+	name, conn, err := peekClientHello(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "secure.example.com" {
+		t.Fatalf("server name = %q", name)
+	}
+	// 读取 SNI 后 ClientHello 仍然完整地交给目标
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		t.Fatal(err)
+	}
+	if head[0] != 0x16 || head[1] != 0x03 {
+		t.Fatalf("replayed data starts with % x, want a TLS handshake record", head)
+	}
+
+	// 不是 TLS 的连接
+	plain, other := net.Pipe()
+	defer plain.Close()
+	go func() {
+		other.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		other.Close()
+	}()
+	if _, _, err := peekClientHello(plain); err == nil {
+		t.Fatal("plain text accepted as a ClientHello")
+	}
+}
+
+func TestTlsPassthroughThroughTunnel(t *testing.T) {
+	tt := startTestTunnel(t)
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "from target")
+	}))
+	defer target.Close()
+	tt.addRoute(t, &model.Route{
+		ID:       "passthrough",
+		Hostname: "secure.example.com",
+		Protocol: model.TypeTlsPassthrough,
+		Target:   target.Listener.Addr().String(),
+	})
+
+	// 访客与目标直接握手, 服务端不终止 TLS. 测试证书不含该域名, 握手后比较证书
+	client := &http.Client{Transport: &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial("tcp", tt.addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: "secure.example.com", InsecureSkipVerify: true})
+			return tlsConn, tlsConn.HandshakeContext(ctx)
+		},
+	}}
+	resp, err := client.Get("https://secure.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "from target" {
+		t.Fatalf("body = %q", body)
+	}
+	if !resp.TLS.PeerCertificates[0].Equal(target.Certificate()) {
+		t.Fatal("visitor did not see the target certificate")
+	}
+}
@@ -0,0 +1,182 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/obud-dev/tunnel/pkg/message"
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+// targetError tags a target failure with the code reported in the error frame
+type targetError struct {
+	code message.ErrorCode
+	err  error
+}
+
+func (e *targetError) Error() string {
+	return e.err.Error()
+}
+
+func (e *targetError) Unwrap() error {
+	return e.err
+}
+
+// errorCode classifies a target error for the error frame
+func errorCode(err error) message.ErrorCode {
+	var targetErr *targetError
+	if errors.As(err, &targetErr) {
+		return targetErr.code
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return message.ErrorTimeout
+	}
+	return message.ErrorDialRefused
+}
+
+// splitTarget splits a route target into scheme and address, targets without a scheme are plain http.
+// For unix:///var/run/app.sock and file:///srv/www the address is the local path
+func splitTarget(target string) (string, string) {
+	scheme, addr, ok := strings.Cut(target, "://")
+	if !ok {
+		return "http", target
+	}
+	return strings.ToLower(scheme), strings.TrimSuffix(addr, "/")
+}
+
+// dialTarget connects to the route target of the message, wrapping https:// targets in TLS.
+// file:// targets are served by clientd itself
+func (c *TcpClient) dialTarget(ctx context.Context, m message.Message) (net.Conn, error) {
+	var opts model.TargetOptions
+	if len(m.Options) > 0 {
+		if err := json.Unmarshal(m.Options, &opts); err != nil {
+			return nil, fmt.Errorf("invalid target options: %w", err)
+		}
+	}
+
+	dialer := net.Dialer{}
+	scheme, addr := splitTarget(m.Target)
+	switch scheme {
+	case "http":
+		return dialer.DialContext(ctx, "tcp", withDefaultPort(addr, "80"))
+	case "https":
+		addr = withDefaultPort(addr, "443")
+		conf, err := targetTlsConfig(opts.Tls, addr)
+		if err != nil {
+			return nil, &targetError{code: message.ErrorTls, err: err}
+		}
+		if opts.Http2 {
+			conf.NextProtos = []string{"h2", "http/1.1"}
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, conf)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, err
+			}
+			return nil, &targetError{code: message.ErrorTls, err: err}
+		}
+		return tlsConn, nil
+	case "unix":
+		path, err := c.checkSocket(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialer.DialContext(ctx, "unix", path)
+		if errors.Is(err, os.ErrPermission) {
+			return nil, &targetError{code: message.ErrorPolicyDenied, err: err}
+		}
+		return conn, err
+	case "file":
+		root, err := c.checkDir(addr)
+		if err != nil {
+			return nil, err
+		}
+		return serveFiles(root, opts.File, &c.fileAuth), nil
+	default:
+		return nil, fmt.Errorf("unsupported target scheme: %s", scheme)
+	}
+}
+
+// withDefaultPort appends port to addresses that do not have one
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	return addr
+}
+
+// targetTlsConfig builds the TLS config for connecting to addr with the route options
+func targetTlsConfig(opts *model.TlsOptions, addr string) (*tls.Config, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	conf := &tls.Config{ServerName: host}
+	if opts == nil {
+		return conf, nil
+	}
+	if opts.ServerName != "" {
+		conf.ServerName = opts.ServerName
+	}
+	conf.InsecureSkipVerify = opts.InsecureSkipVerify
+	if opts.CaFile != "" {
+		data, err := os.ReadFile(opts.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in ca file %s", opts.CaFile)
+		}
+		conf.RootCAs = pool
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// checkSocket validates a unix:// target against the sockets clientd is allowed to expose
+func (c *TcpClient) checkSocket(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("unix socket path must be absolute: %s", path)
+	}
+	path = filepath.Clean(path)
+	allowed := false
+	for _, pattern := range c.AllowedSockets {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", &targetError{code: message.ErrorPolicyDenied, err: fmt.Errorf("unix socket %s is not allowed", path)}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return "", &targetError{code: message.ErrorPolicyDenied, err: err}
+		}
+		return "", err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return "", fmt.Errorf("%s is not a unix socket", path)
+	}
+	return path, nil
+}
@@ -0,0 +1,140 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/obud-dev/tunnel/pkg/message"
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+func targetMessage(t *testing.T, target string, opts model.TargetOptions) message.Message {
+	data, err := json.Marshal(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message.Message{Target: target, Options: data}
+}
+
+func TestSplitTarget(t *testing.T) {
+	for target, want := range map[string][2]string{
+		"127.0.0.1:8080":          {"http", "127.0.0.1:8080"},
+		"HTTPS://example.com/":    {"https", "example.com"},
+		"unix:///run/app.sock":    {"unix", "/run/app.sock"},
+		"file:///srv/www/":        {"file", "/srv/www"},
+		"https://[::1]:8443":      {"https", "[::1]:8443"},
+		"ftp://files.example.com": {"ftp", "files.example.com"},
+	} {
+		if scheme, addr := splitTarget(target); scheme != want[0] || addr != want[1] {
+			t.Errorf("splitTarget(%s) = %s, %s", target, scheme, addr)
+		}
+	}
+	for addr, want := range map[string]string{
+		"example.com":      "example.com:443",
+		"example.com:8443": "example.com:8443",
+		"[::1]":            "[::1]:443",
+	} {
+		if got := withDefaultPort(addr, "443"); got != want {
+			t.Errorf("withDefaultPort(%s) = %s", addr, got)
+		}
+	}
+}
+
+func TestDialHttpsTarget(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	target := "https://" + server.Listener.Addr().String()
+	c := &TcpClient{}
+
+	// 测试证书签发给 example.com 及 127.0.0.1
+	for _, tc := range []struct {
+		name string
+		opts model.TargetOptions
+		code message.ErrorCode // 为空表示连接成功
+	}{
+		{"untrusted", model.TargetOptions{}, message.ErrorTls},
+		{"ca file", model.TargetOptions{Tls: &model.TlsOptions{CaFile: caFile}}, ""},
+		{"server name", model.TargetOptions{Tls: &model.TlsOptions{CaFile: caFile, ServerName: "example.com"}}, ""},
+		{"wrong server name", model.TargetOptions{Tls: &model.TlsOptions{CaFile: caFile, ServerName: "other.com"}}, message.ErrorTls},
+		{"skip verify", model.TargetOptions{Tls: &model.TlsOptions{InsecureSkipVerify: true}}, ""},
+		{"missing ca file", model.TargetOptions{Tls: &model.TlsOptions{CaFile: caFile + ".missing"}}, message.ErrorTls},
+	} {
+		conn, err := c.dialTarget(context.Background(), targetMessage(t, target, tc.opts))
+		if err == nil {
+			conn.Close()
+		}
+		if tc.code == "" && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if tc.code != "" && (err == nil || errorCode(err) != tc.code) {
+			t.Errorf("%s: err = %v, want code %s", tc.name, err, tc.code)
+		}
+	}
+
+	// 开启 HTTP/2 时通过 ALPN 协商
+	conn, err := c.dialTarget(context.Background(), targetMessage(t, target, model.TargetOptions{
+		Http2: true,
+		Tls:   &model.TlsOptions{CaFile: caFile},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if proto := conn.(interface{ ConnectionState() tls.ConnectionState }).ConnectionState().NegotiatedProtocol; proto != "h2" {
+		t.Errorf("negotiated %q, want h2", proto)
+	}
+}
+
+func TestDialUnixTarget(t *testing.T) {
+	// unix socket 路径长度有限, 不使用较长的 t.TempDir
+	dir, err := os.MkdirTemp("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	regular := filepath.Join(dir, "file")
+	if err := os.WriteFile(regular, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &TcpClient{AllowedSockets: []string{filepath.Join(dir, "*")}}
+	conn, err := c.dialTarget(context.Background(), message.Message{Target: "unix://" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	for _, tc := range []struct {
+		target string
+		code   message.ErrorCode
+	}{
+		{"unix:///var/run/docker.sock", message.ErrorPolicyDenied},
+		{"unix://" + regular, message.ErrorDialRefused},
+		{"unix://" + filepath.Join(dir, "missing.sock"), message.ErrorDialRefused},
+		{"unix://relative.sock", message.ErrorDialRefused},
+	} {
+		if _, err := c.dialTarget(context.Background(), message.Message{Target: tc.target}); err == nil || errorCode(err) != tc.code {
+			t.Errorf("%s: err = %v, want code %s", tc.target, err, tc.code)
+		}
+	}
+}
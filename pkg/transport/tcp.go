@@ -2,34 +2,89 @@ package transport
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/http2"
 
 	"github.com/obud-dev/tunnel/pkg/config"
 	"github.com/obud-dev/tunnel/pkg/message"
-	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/metrics"
 	"github.com/obud-dev/tunnel/pkg/svc"
 	"github.com/obud-dev/tunnel/pkg/utils"
 )
 
 // TCP Client Constants
 const (
-	heartbeatInterval = 60 * time.Second // 心跳包发送间隔
-	reconnectAttempts = 3                // 最大重连尝试次数
-	reconnectInterval = 10 * time.Second // 每次重连间隔
-	heartTimeout      = 5 * time.Second  // 心跳包超时时间
+	heartbeatInterval    = 60 * time.Second      // 心跳包发送间隔
+	heartTimeout         = 5 * time.Second       // 心跳包超时时间
+	readTimeout          = 3 * heartbeatInterval // 超过该时间未收到服务端消息视为连接已断开
+	dialTimeout          = 10 * time.Second      // 连接服务器超时时间
+	reconnectMinInterval = 1 * time.Second       // 首次重连等待时间
+	reconnectMaxInterval = 60 * time.Second      // 重连等待时间上限
+	targetTimeout        = 30 * time.Second      // 连接内网目标服务的时间, 也是服务端未指定时等待 HTTP 响应的时间
+	messageChunkSize     = 32 * 1024             // 目标服务响应拆分成消息的大小
 )
 
+// TCP Server Constants
+const (
+	tlsHandshakeTimeout   = 1 * time.Minute  // 公网 HTTPS 握手超时时间 (包含申请证书的时间)
+	httpReadHeaderTimeout = 30 * time.Second // 读取访客请求头的时间, 避免慢速请求占用连接
+	httpIdleTimeout       = 2 * time.Minute  // 访客 keep-alive 连接的空闲时间
+)
+
+var errSessionClosed = errors.New("connection to server is closed")
+
+// session holds the goroutines and state of a single connection to the server
+type session struct {
+	conn        net.Conn
+	channel     chan []byte
+	done        chan struct{}
+	once        sync.Once
+	established bool // 是否收到服务端的连接确认
+
+	streams map[string]*stream // 消息ID -> 目标连接 (仅流式路由)
+	pingAt  time.Time          // 等待响应的心跳发送时间
+	rtt     time.Duration      // 上次心跳往返时间, 随下次心跳发给服务端
+	mutex   sync.Mutex
+}
+
+// close tears the session down, stopping its readLoop, sendToServer and Heartbeat goroutines
+// and closing the target connections of its streams
+func (s *session) close() {
+	s.once.Do(func() {
+		metrics.ClientConnected.Set(0)
+		close(s.done)
+		s.conn.Close()
+		s.mutex.Lock()
+		for _, st := range s.streams {
+			st.close()
+		}
+		s.mutex.Unlock()
+	})
+}
+
 // TcpClient is a client for the TCP protocol
 type TcpClient struct {
-	conn    net.Conn
-	conf    *config.ClientConfig
-	channel chan []byte
+	conf       *config.ClientConfig
+	session    *session
+	mutex      sync.Mutex
+	Backoff    *Backoff // 重连等待策略
+	MaxRetries int      // 连续重连失败的最大次数, 0 表示无限重试
+
+	AllowedSockets []string // 允许作为目标的 unix socket 路径 (支持通配符), 为空时禁止 unix:// 目标
+	AllowedDirs    []string // 允许通过 file:// 目标共享的目录 (包含子目录), 为空时禁止 file:// 目标
+
+	fileAuth sync.Map // 已验证的 file:// 目标访问账号
 }
 
 // NewTcpClient creates a new TCP client
@@ -38,15 +93,57 @@ func NewTcpClient(token string) (*TcpClient, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
-	return &TcpClient{conf: conf, channel: make(chan []byte)}, nil
+	return &TcpClient{conf: conf, Backoff: NewBackoff()}, nil
 }
 
-// Connect establishes a TCP connection to the server
-func (c *TcpClient) Connect() error {
-	var err error
-	c.conn, err = net.Dial("tcp", c.conf.Server)
+// Run keeps the client connected to the server until ctx is cancelled,
+// reconnecting with capped exponential backoff whenever the connection drops
+func (c *TcpClient) Run(ctx context.Context) error {
+	retries := 0
+	for {
+		s, err := c.connect(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to connect to server")
+		} else {
+			select {
+			case <-s.done:
+				log.Warn().Msg("Connection to server lost")
+			case <-ctx.Done():
+				s.close()
+				return ctx.Err()
+			}
+			// 只有成功完成握手的连接才重置重连计数，避免服务端拒绝时快速重试
+			c.mutex.Lock()
+			if s.established {
+				c.Backoff.Reset()
+				retries = 0
+			}
+			c.mutex.Unlock()
+		}
+
+		retries++
+		metrics.ClientReconnects.Inc()
+		if c.MaxRetries > 0 && retries > c.MaxRetries {
+			return fmt.Errorf("giving up after %d reconnect attempts", c.MaxRetries)
+		}
+		delay := c.Backoff.Next()
+		log.Info().Msgf("Reconnect attempt %d in %s", retries, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// connect establishes a TCP connection to the server and starts its session goroutines
+func (c *TcpClient) connect(ctx context.Context) (*session, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.conf.Server)
 	if err != nil {
-		return fmt.Errorf("failed to connect to server: %w", err)
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
 	}
 	log.Info().Msgf("Connecting to server: %s", c.conf.Server)
 	// Send connection message
@@ -57,30 +154,50 @@ func (c *TcpClient) Connect() error {
 	}
 	req, err := m.Marshal()
 	if err != nil {
-		return fmt.Errorf("failed to marshal connect message: %w", err)
+		conn.Close()
+		return nil, fmt.Errorf("failed to marshal connect message: %w", err)
+	}
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send connect message: %w", err)
 	}
-	c.conn.Write(req)
 
-	go c.readLoop()
-	go c.Heartbeat()
-	go c.sendToServer()
-	select {}
+	s := &session{
+		conn:    conn,
+		channel: make(chan []byte),
+		done:    make(chan struct{}),
+		streams: make(map[string]*stream),
+	}
+	c.mutex.Lock()
+	c.session = s
+	c.mutex.Unlock()
+
+	go c.readLoop(s)
+	go c.Heartbeat(s)
+	go c.sendToServer(s)
+	return s, nil
 }
 
 // readLoop handles incoming messages from the server
-func (c *TcpClient) readLoop() {
-	defer c.conn.Close()
+func (c *TcpClient) readLoop(s *session) {
+	defer s.close()
 
-	reader := bufio.NewReader(c.conn)
+	reader := bufio.NewReader(s.conn)
 	for {
+		s.conn.SetReadDeadline(time.Now().Add(readTimeout))
 		data, err := reader.ReadBytes('}')
 		if err != nil {
-			if err == io.EOF {
-				log.Info().Msg("Connection closed by server")
-			} else {
-				log.Error().Err(err).Msg("Error reading from server")
+			select {
+			case <-s.done:
+				// 连接已被主动关闭
+			default:
+				if err == io.EOF {
+					log.Info().Msg("Connection closed by server")
+				} else {
+					log.Error().Err(err).Msg("Error reading from server")
+				}
 			}
-			break
+			return
 		}
 
 		m, err := message.Unmarshal(data)
@@ -89,20 +206,38 @@ func (c *TcpClient) readLoop() {
 			continue
 		}
 
-		c.handleMessage(m)
+		c.handleMessage(s, m)
 	}
 }
 
 // handleMessage processes different types of messages from the server
-func (c *TcpClient) handleMessage(m *message.Message) {
+func (c *TcpClient) handleMessage(s *session, m *message.Message) {
 	switch m.Type {
 	case message.MessageTypeData:
-		go c.RecieveData(*m)
+		// 同一流的数据需按顺序处理
+		c.handleStreamData(s, *m)
 	case message.MessageTypeConnect:
+		c.mutex.Lock()
+		s.established = true
+		c.mutex.Unlock()
+		metrics.ClientConnected.Set(1)
 		log.Info().Msg("Connected to server")
 	case message.MessageTypeDisconnect:
-		log.Info().Msg("Disconnected from server")
+		// 带消息ID的断开消息只关闭对应的流
+		if m.Id != "" {
+			c.closeStream(s, m.Id)
+			return
+		}
+		log.Info().Msgf("Disconnected from server: %s", m.Data)
+		s.close()
 	case message.MessageTypeHeartbeat:
+		s.mutex.Lock()
+		if !s.pingAt.IsZero() {
+			s.rtt = time.Since(s.pingAt)
+			s.pingAt = time.Time{}
+			metrics.ClientHeartbeatRtt.Observe(s.rtt.Seconds())
+		}
+		s.mutex.Unlock()
 		log.Debug().Msg("Received heartbeat")
 	default:
 		log.Warn().Msg("Unknown message type")
@@ -116,198 +251,201 @@ func (c *TcpClient) SendMessage(m message.Message) error {
 		log.Error().Err(err).Msg("Failed to marshal message")
 		return err
 	}
-	c.channel <- data
-	return nil
+	c.mutex.Lock()
+	s := c.session
+	c.mutex.Unlock()
+	if s == nil {
+		return errSessionClosed
+	}
+	select {
+	case s.channel <- data:
+		return nil
+	case <-s.done:
+		return errSessionClosed
+	}
 }
 
 // sendToServer send data to server
-func (c *TcpClient) sendToServer() {
-	for message := range c.channel {
-		_, err := c.conn.Write(message)
-		if err != nil {
-			log.Error().Err(err).Msg("Error sending message to server")
+func (c *TcpClient) sendToServer(s *session) {
+	defer s.close()
+
+	for {
+		select {
+		case <-s.done:
 			return
+		case message := <-s.channel:
+			_, err := s.conn.Write(message)
+			if err != nil {
+				log.Error().Err(err).Msg("Error sending message to server")
+				return
+			}
+			log.Debug().Msg("Data sent to server")
 		}
-		log.Debug().Msg("Data sent to server")
 	}
 }
 
-// RecieveData processes data received from the server
-func (c *TcpClient) RecieveData(m message.Message) {
-	log.Debug().Msg("Received data from server")
-
-	// Decrypt data
-	data, err := m.Decrypt(c.conf.Token)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to decrypt message")
-		return
-	}
-	m.Data = data
+// SendError reports to the server that the request could not be served by the target
+func (c *TcpClient) SendError(id string, err error) error {
+	metrics.ClientTargetErrors.WithLabelValues(string(errorCode(err))).Inc()
+	return c.SendMessage(message.Message{
+		Id:   id,
+		Type: message.MessageTypeError,
+		Code: errorCode(err),
+		Data: []byte(err.Error()),
+	})
+}
 
-	// Handle the received data based on the protocol
-	switch m.Protocol {
-	case model.TypeHttp:
-		// For HTTP data, initiate a request
-		c.handleHttpData(m)
-	default:
-		log.Warn().Msg("Unknown protocol type for received data")
-	}
+// messageWriter sends everything written to it as data messages for one visitor request
+type messageWriter struct {
+	client *TcpClient
+	id     string
 }
 
-// handleHttpData processes HTTP data received from the server
-func (c *TcpClient) handleHttpData(m message.Message) {
-	// You need to implement the actual HTTP handling logic here.
-	// For example, you might create a new HTTP request using the received data.
-	conn, err := net.Dial("tcp", m.Target)
+func (w *messageWriter) Write(p []byte) (int, error) {
+	err := w.client.SendMessage(message.Message{
+		Id:   w.id,
+		Data: p,
+		Type: message.MessageTypeData,
+	})
 	if err != nil {
-		log.Error().Err(err).Msg("Error connecting to target")
-		return
+		return 0, err
 	}
-	conn.Write(m.Data)
-	go func() {
-		defer conn.Close()
-
-		buf := make([]byte, 2048)
-		n, err := conn.Read(buf)
-		if err != nil {
-			log.Error().Err(err).Msg("Error reading from target")
-			return
-		}
-		log.Info().Msg("Received response")
-		// 通过tunnel发送本地响应到服务器
-		c.SendMessage(message.Message{
-			Id:   m.Id,
-			Data: buf[:n],
-			Type: message.MessageTypeData,
-		})
-	}()
+	metrics.ClientBytes.WithLabelValues("out").Add(float64(len(p)))
+	return len(p), nil
 }
 
-// Heartbeat sends periodic heartbeat messages to the server
-func (c *TcpClient) Heartbeat() {
-	timer := time.NewTimer(heartTimeout)
-	defer timer.Stop()
+// Heartbeat sends periodic heartbeat messages to the server, closing the session
+// when a heartbeat cannot be sent in time
+func (c *TcpClient) Heartbeat(s *session) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
 
 	for {
-		time.Sleep(heartbeatInterval)
-		done := make(chan error, 1)
-		go func() {
-			m := message.Message{
-				Id:   utils.GenerateID(),
-				Type: message.MessageTypeHeartbeat,
-				Data: []byte("ping"),
-			}
-			err := c.SendMessage(m)
-			done <- err
-		}()
-		if !timer.Stop() {
-			// 如果计时器已经触发，清空通道
-			<-timer.C
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
 		}
-		timer.Reset(heartTimeout)
+		s.mutex.Lock()
+		m := message.Message{
+			Id:   utils.GenerateID(),
+			Type: message.MessageTypeHeartbeat,
+			Data: []byte("ping"),
+			Rtt:  s.rtt.Microseconds(),
+		}
+		s.pingAt = time.Now()
+		s.mutex.Unlock()
+		data, err := m.Encrypt(c.conf.Token)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to marshal heartbeat")
+			continue
+		}
+		timer := time.NewTimer(heartTimeout)
 		select {
-		case err := <-done:
-			if err != nil {
-				c.ReconnectToServer()
-				return
-			}
+		case s.channel <- data:
+			timer.Stop()
 		case <-timer.C:
-			fmt.Print("Send heartbeat timeout")
-			c.ReconnectToServer()
+			log.Warn().Msg("Send heartbeat timeout")
+			s.close()
+			return
+		case <-s.done:
+			timer.Stop()
 			return
 		}
 	}
 }
 
-// ReconnectToServer attempts to reconnect to the TCP server
-func (c *TcpClient) ReconnectToServer() error {
-	if c.conn != nil {
-		c.conn.Close()
-	}
-	for i := 0; i < reconnectAttempts; i++ {
-		log.Info().Msgf("Reconnect attempt %d/%d", i+1, reconnectAttempts)
-		if err := c.Connect(); err == nil {
-			return nil
-		}
-		time.Sleep(reconnectInterval)
-	}
-	return fmt.Errorf("all reconnect attempts failed")
-}
-
 // TcpServer represents a TCP server
 type TcpServer struct {
-	ctx *svc.ServerCtx
+	ctx            *svc.ServerCtx
+	trustedProxies []*net.IPNet // 允许发送 PROXY protocol 头部的地址
+
+	tlsOnce sync.Once
+	tlsConf *tls.Config
+	tlsErr  error
+
+	httpOnce  sync.Once
+	httpConns *connListener // 交给 HTTP 服务处理的访客连接
+	authCache sync.Map      // 已验证的路由访问账号
+
+	sessionKey    []byte   // 签名路由登录 cookie 的密钥
+	oidcProviders sync.Map // 已获取配置的身份提供方
 }
 
 // NewTcpServer creates a new TCP server instance
 func NewTcpServer(ctx *svc.ServerCtx) *TcpServer {
-	return &TcpServer{ctx: ctx}
+	sessionKey := []byte(ctx.Config.SessionSecret)
+	if len(sessionKey) == 0 {
+		// 未配置时重启后需要重新登录
+		sessionKey = make([]byte, 32)
+		rand.Read(sessionKey)
+		log.Warn().Msg("SessionSecret is not set, route logins will not survive a restart")
+	}
+	return &TcpServer{
+		ctx:            ctx,
+		trustedProxies: parseTrustedProxies(ctx.Config.TrustedProxies),
+		sessionKey:     sessionKey,
+	}
 }
 
-// Listen starts the TCP server and listens for incoming connections
+// Listen starts the shared listener, which serves tunnel control connections, HTTP, TLS
+// and SSH visitors on one port
 func (s *TcpServer) Listen() error {
-	ln, err := net.Listen("tcp", s.ctx.Config.ListenOn)
-	if err != nil {
-		log.Error().Err(err).Msg("Error starting server")
-		return err
-	}
-	defer ln.Close()
+	return s.serve(s.ctx.Config.ListenOn, allConnKinds...)
+}
 
-	log.Info().Msgf("Listening on %s", s.ctx.Config.ListenOn)
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Error().Err(err).Msg("Error accepting connection")
-			continue
-		}
-		go s.handleConn(conn)
-	}
+// ListenControl starts a listener that only accepts tunnel control connections
+func (s *TcpServer) ListenControl() error {
+	return s.serve(s.ctx.Config.ListenControl, connControl)
 }
 
-// handleConn manages an individual connection from a client
-func (s *TcpServer) handleConn(conn net.Conn) {
-	log.Info().Msg("Connection established with client")
+// ListenHttp starts a listener that only accepts plaintext HTTP visitors
+func (s *TcpServer) ListenHttp() error {
+	return s.serve(s.ctx.Config.ListenHttp, connHttp)
+}
 
-	messageId := utils.GenerateID()
-	log.Debug().Msgf("New message ID: %s", messageId)
-	tunnel := &svc.ActiveTunnel{
-		Conn:    conn,
-		Channel: make(chan []byte),
+// ListenTls terminates TLS on the public HTTPS listener with uploaded certificates or ACME
+// certificates for route hostnames, decrypted connections are handled like plaintext ones.
+// Connections for tls-passthrough routes are forwarded to the target without decrypting
+func (s *TcpServer) ListenTls() error {
+	if _, err := s.tlsConfig(); err != nil {
+		log.Error().Err(err).Msg("Error creating certificate manager")
+		return err
 	}
+	return s.serve(s.ctx.Config.ListenTls, connTls)
+}
 
-	s.ctx.Mutex.Lock()
-	s.ctx.Messages[messageId] = tunnel
-	s.ctx.Mutex.Unlock()
-
-	go s.sendToVisitor(messageId)
-
-	reader := bufio.NewReader(conn)
-	var buffer bytes.Buffer
-
-	for {
-		headBuf := make([]byte, 1)
-		_, err := reader.Read(headBuf)
+// tlsConfig returns the config terminating visitor TLS, created on first use
+func (s *TcpServer) tlsConfig() (*tls.Config, error) {
+	s.tlsOnce.Do(func() {
+		manager, err := NewCertManager(s.ctx)
 		if err != nil {
-			break
+			s.tlsErr = err
+			return
 		}
-		if headBuf[0] == '{' {
-			data, err := reader.ReadBytes('}')
-			if err != nil {
-				if err == io.EOF {
-					log.Info().Msg("Connection closed by client")
-				} else {
-					log.Error().Err(err).Msg("Error reading from client")
+		conf := manager.TLSConfig()
+		conf.NextProtos = []string{http2.NextProtoTLS, "http/1.1", acme.ALPNProto}
+		conf.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// 手动上传的证书优先, ACME 验证请求交给 autocert 处理
+			if !isAcmeChallenge(hello) {
+				if cert := s.ctx.MatchCertificate(hello.ServerName); cert != nil {
+					return cert, nil
 				}
-				break
 			}
-			data = append(headBuf, data...)
-			s.processMessage(data, conn, messageId)
-			continue
+			return manager.GetCertificate(hello)
 		}
+		s.tlsConf = conf
+	})
+	return s.tlsConf, s.tlsErr
+}
+
+// handleControl reads the messages of a tunnel control connection from a client
+func (s *TcpServer) handleControl(conn net.Conn) {
+	log.Info().Msg("Connection established with client")
 
-		// http
-		buffer.Write(headBuf)
-		line, err := reader.ReadBytes('\n')
+	reader := bufio.NewReader(conn)
+	for {
+		data, err := reader.ReadBytes('}')
 		if err != nil {
 			if err == io.EOF {
 				log.Info().Msg("Connection closed by client")
@@ -316,33 +454,19 @@ func (s *TcpServer) handleConn(conn net.Conn) {
 			}
 			break
 		}
-		buffer.Write(line)
-		// http 请求结束
-		if len(line) == 1 && line[0] == '\n' {
-			// 处理http请求
-			s.processMessage(buffer.Bytes(), conn, messageId)
-			buffer.Reset()
-		}
+		s.processMessage(data, conn)
 	}
-	close(tunnel.Channel)
-	s.ctx.Mutex.Lock()
-	delete(s.ctx.Messages, messageId)
-	s.ctx.Mutex.Unlock()
 	conn.Close()
+	// 标记隧道进入重连状态
+	s.ctx.ReleaseTunnel(conn)
 }
 
 // processMessage processes incoming messages from the client
-func (s *TcpServer) processMessage(messageStr []byte, conn net.Conn, mid string) {
+func (s *TcpServer) processMessage(data []byte, conn net.Conn) {
 	log.Debug().Msgf("Processing message")
-	m, err := message.Unmarshal(messageStr)
+	m, err := message.Unmarshal(data)
 	if err != nil {
-		// 从外部接收到的数据，转发到内部
-		m := message.Message{
-			Type: message.MessageTypeData,
-			Data: messageStr,
-			Id:   mid,
-		}
-		s.handleData(m)
+		log.Error().Err(err).Msg("Invalid message from client")
 		return
 	}
 
@@ -350,11 +474,19 @@ func (s *TcpServer) processMessage(messageStr []byte, conn net.Conn, mid string)
 	case message.MessageTypeConnect:
 		s.HandleConnect(*m, conn)
 	case message.MessageTypeData:
-		go s.handleClientData(*m)
+		// 同一请求的响应可能拆分为多条消息，按顺序放入访客的写队列
+		s.handleClientData(*m)
 	case message.MessageTypeDisconnect:
-		log.Info().Msg("Client disconnected")
+		s.handleClientDisconnect(*m)
 	case message.MessageTypeHeartbeat:
+		if m.Rtt > 0 {
+			if tid := s.ctx.TunnelID(conn); tid != "" {
+				metrics.HeartbeatRtt.WithLabelValues(tid).Set(float64(m.Rtt) / 1e6)
+			}
+		}
 		s.sendHeartbeatResponse(conn)
+	case message.MessageTypeError:
+		s.handleClientError(*m)
 	default:
 		log.Warn().Msg("Unknown message type")
 	}
@@ -367,6 +499,7 @@ func (s *TcpServer) HandleConnect(m message.Message, conn net.Conn) {
 	tunnel, err := s.ctx.TunnelModel.GetTunnelByID(TunnelID)
 	if err != nil {
 		log.Error().Err(err).Msg("Error retrieving tunnel")
+		metrics.HandshakeFailures.WithLabelValues("tunnel").Inc()
 		s.sendDisconnectResponse(conn, "Tunnel not found")
 		conn.Close()
 		return
@@ -374,12 +507,14 @@ func (s *TcpServer) HandleConnect(m message.Message, conn net.Conn) {
 
 	tunnel.Status = "online"
 	s.ctx.TunnelModel.Update(tunnel)
-	s.ctx.Tunnels[tunnel.ID] = &svc.ActiveTunnel{
-		Conn:    conn,
-		Token:   tunnel.Token,
-		Channel: make(chan []byte),
-	}
-	go s.sendToClient(TunnelID)
+	s.ctx.Traffic.Load(tunnel)
+	active := svc.NewActiveTunnel(conn, tunnel.Token)
+	active.MaxStreams = tunnel.MaxStreams
+	if active.MaxStreams == 0 {
+		active.MaxStreams = s.ctx.Config.MaxStreams
+	}
+	s.ctx.AddTunnel(tunnel.ID, active)
+	go s.sendToClient(active)
 	response := message.Message{
 		Id:   m.Id,
 		Type: message.MessageTypeConnect,
@@ -391,60 +526,54 @@ func (s *TcpServer) HandleConnect(m message.Message, conn net.Conn) {
 	log.Info().Msgf("Client connected: %s", TunnelID)
 }
 
-// handleData processes the data from the visitor
-func (s *TcpServer) handleData(m message.Message) {
-	tunnelID := ""
-	// 消息规则知道转发到哪个隧道
-	if utils.HttpPattern.Match(m.Data) {
-		// todo: 处理消息 把消息host 转换为规则host
-		host := utils.GetHostFromHttpMessage(m.Data)
-		for _, route := range s.ctx.Routes {
-			if route.Hostname == host {
-				m.Protocol = route.Protocol
-				tunnelID = route.TunnelID
-				m.Target = route.Target
-				break
-			}
-		}
-	}
-
-	if utils.SshPattern.Match(m.Data) {
-		m.Protocol = model.TypeSsh
-	}
-
-	// 通过隧道ID获取隧道连接
-	if _, ok := s.ctx.Tunnels[tunnelID]; !ok {
-		log.Error().Msg("tunnel not found")
-		return
-	}
-
-	tunnel := s.ctx.Tunnels[tunnelID]
+// handleClientData processes the data from the client
+func (s *TcpServer) handleClientData(m message.Message) {
 	s.ctx.Mutex.Lock()
-	s.ctx.Messages[m.Id].Token = tunnel.Token
+	tunnel, ok := s.ctx.Messages[m.Id]
 	s.ctx.Mutex.Unlock()
-	mData, err := m.Encrypt(tunnel.Token)
+	if !ok {
+		log.Error().Msg("message conn not found")
+		return
+	}
+	data, err := m.Decrypt(tunnel.Token)
 	if err != nil {
-		log.Error().Err(err).Msg("Error marshalling message")
+		fmt.Println("Error to decrypt data:", err)
 		return
 	}
-	tunnel.Channel <- mData
+	tunnel.Responded()
+	if !tunnel.Queue(data) && errors.Is(tunnel.Err(), svc.ErrStreamOverflow) {
+		log.Warn().Msgf("Visitor of stream %s is too slow, closing the stream", m.Id)
+	}
 }
 
-// handleClientData processes the data from the client
-func (s *TcpServer) handleClientData(m message.Message) {
+// handleClientError fails the visitor stream when the client could not reach the target,
+// HTTP visitors get the error page matching the error code
+func (s *TcpServer) handleClientError(m message.Message) {
 	s.ctx.Mutex.Lock()
-	if _, ok := s.ctx.Messages[m.Id]; !ok {
+	visitor, ok := s.ctx.Messages[m.Id]
+	s.ctx.Mutex.Unlock()
+	if !ok {
 		log.Error().Msg("message conn not found")
 		return
 	}
-	tunnel := s.ctx.Messages[m.Id]
-	s.ctx.Mutex.Unlock()
-	data, err := m.Decrypt(tunnel.Token)
+	data, err := m.Decrypt(visitor.Token)
 	if err != nil {
-		fmt.Println("Error to decrypt data:", err)
+		log.Error().Err(err).Msg("Error to decrypt error message")
 		return
 	}
-	tunnel.Channel <- data
+	visitor.Responded()
+
+	log.Error().Msgf("target error %s: %s", m.Code, data)
+	if route := visitor.Route; route != nil {
+		if err := s.ctx.RouteModel.RecordFailure(route.ID, fmt.Sprintf("%s: %s", m.Code, data)); err != nil {
+			log.Error().Err(err).Msg("Failed to record route failure")
+		}
+		// HTTP 路由的错误在返回错误页面时统计
+		if route.Protocol.IsStream() {
+			s.ctx.Stats.Error(route)
+		}
+	}
+	visitor.Fail(&targetError{code: m.Code, err: errors.New(string(data))})
 }
 
 // sendHeartbeatResponse sends a heartbeat response to the client
@@ -480,31 +609,52 @@ func (s *TcpServer) sendDisconnectResponse(conn net.Conn, reason string) {
 }
 
 // sendToVisitor sends client response to visitor with deal all Producter-Goroutine
-func (s *TcpServer) sendToVisitor(mid string) {
-	s.ctx.Mutex.Lock()
-	m := s.ctx.Messages[mid]
-	s.ctx.Mutex.Unlock()
-
-	for message := range m.Channel {
-		_, err := m.Conn.Write(message)
-		if err != nil {
-			log.Error().Err(err).Msg("Error sending message")
+func (s *TcpServer) sendToVisitor(m *svc.ActiveTunnel) {
+	for {
+		select {
+		case <-m.Done:
 			return
+		case message := <-m.Channel:
+			if message == nil {
+				// 目标连接已关闭，写完之前的数据后关闭访客连接
+				m.Close()
+				return
+			}
+			if m.Route != nil && !s.ctx.Traffic.Upload(m.Route.TunnelID, len(message), m.Done) {
+				log.Warn().Msgf("Traffic quota of tunnel %s exhausted", m.Route.TunnelID)
+				m.Close()
+				return
+			}
+			_, err := m.Conn.Write(message)
+			if err != nil {
+				log.Error().Err(err).Msg("Error sending message")
+				return
+			}
+			m.BytesOut.Add(int64(len(message)))
+			if m.Capture != nil {
+				m.Capture.Record(true, message)
+			}
+			s.ctx.Stats.BytesOut(m.Route, len(message))
+			log.Debug().Msg("Data sent to visitor")
 		}
-		log.Debug().Msg("Data sent to visitor")
 	}
 }
 
 // sendToClient sends to client with deal all Producter-Goroutine
-func (s *TcpServer) sendToClient(tid string) {
-	tunnel := s.ctx.Tunnels[tid]
-
-	for message := range tunnel.Channel {
-		_, err := tunnel.Conn.Write(message)
-		if err != nil {
-			log.Error().Err(err).Msg("Error sending message")
+func (s *TcpServer) sendToClient(tunnel *svc.ActiveTunnel) {
+	for {
+		select {
+		case <-tunnel.Done:
 			return
+		case message := <-tunnel.Channel:
+			_, err := tunnel.Conn.Write(message)
+			if err != nil {
+				log.Error().Err(err).Msg("Error sending message")
+				// 关闭连接，由 handleConn 将隧道标记为重连状态
+				tunnel.Close()
+				return
+			}
+			log.Debug().Msg("Data sent to tunnel")
 		}
-		log.Debug().Msg("Data sent to tunnel")
 	}
 }
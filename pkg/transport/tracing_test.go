@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+func TestTraceThroughTunnel(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	tt := startTestTunnel(t)
+	traceparent := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("Traceparent")
+	}))
+	defer target.Close()
+	tt.addRoute(t, &model.Route{
+		ID:       "web",
+		Hostname: "web.example.com",
+		Protocol: model.TypeHttp,
+		Target:   target.Listener.Addr().String(),
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+tt.addr+"/", nil)
+	req.Host = "web.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+
+	// visitor.accept 在响应写完后结束
+	want := []string{"visitor.accept", "route.match", "tunnel.send", "client.dial", "target.response"}
+	spans := map[string]tracetest.SpanStub{}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(spans) < len(want) && time.Now().Before(deadline) {
+		for _, span := range exporter.GetSpans() {
+			spans[span.Name] = span
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	traceID := spans["visitor.accept"].SpanContext.TraceID()
+	for _, name := range want {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("span %s not recorded, got %v", name, exporter.GetSpans().Snapshots())
+		}
+		if span.SpanContext.TraceID() != traceID {
+			t.Errorf("span %s in trace %s, want %s", name, span.SpanContext.TraceID(), traceID)
+		}
+	}
+
+	// 目标服务收到的 traceparent 以 target.response 为父 span
+	header := <-traceparent
+	parent := spans["target.response"].SpanContext
+	if want := "00-" + traceID.String() + "-" + parent.SpanID().String() + "-01"; header != want {
+		t.Errorf("traceparent = %q, want %q", header, want)
+	}
+}
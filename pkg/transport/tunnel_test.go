@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/obud-dev/tunnel/pkg/config"
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+// testTunnel is a server with one tunnel and a connected clientd, running in the test process
+type testTunnel struct {
+	ctx    *svc.ServerCtx
+	server *TcpServer
+	addr   string // 服务端监听地址, 访客及客户端都连接这里
+	tunnel *model.Tunnel
+}
+
+// freeAddr returns a loopback address with a free port
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// startTestTunnel starts a server whose database lives in a temporary directory, creates a
+// tunnel and connects a client to it
+func startTestTunnel(t *testing.T) *testTunnel {
+	// NewServerCtx 在当前目录打开数据库
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	addr := freeAddr(t)
+	ctx := svc.NewServerCtx(config.ServerConfig{
+		ListenOn: addr,
+		User:     "admin",
+		Password: "test-password",
+	})
+	tunnel := &model.Tunnel{ID: "t1", Name: "test", Token: testToken}
+	if err := ctx.TunnelModel.Insert(tunnel); err != nil {
+		t.Fatal(err)
+	}
+	server := NewTcpServer(ctx)
+	go server.Listen()
+
+	client := &TcpClient{
+		conf:    &config.ClientConfig{TunnelID: tunnel.ID, Token: tunnel.Token, Server: addr},
+		Backoff: NewBackoff(),
+	}
+	runCtx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go client.Run(runCtx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := ctx.GetTunnel(tunnel.ID); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client did not connect")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return &testTunnel{ctx: ctx, server: server, addr: addr, tunnel: tunnel}
+}
+
+// addRoute saves the route of the test tunnel and reloads the routes
+func (tt *testTunnel) addRoute(t *testing.T, route *model.Route) {
+	route.TunnelID = tt.tunnel.ID
+	if err := tt.ctx.RouteModel.Insert(route); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.ctx.UpdateRoutes(); err != nil {
+		t.Fatal(err)
+	}
+}
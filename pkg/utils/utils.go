@@ -8,7 +8,6 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"runtime"
 	"time"
 
 	"github.com/google/uuid"
@@ -43,18 +42,12 @@ func GetHostFromHttpMessage(m []byte) string {
 	return req.Host
 }
 
-func PrintMemoryUsage() {
-	// 打印内存使用情况
-	for {
-		var m runtime.MemStats
-		runtime.ReadMemStats(&m)
-		log.Info().Msgf("Alloc = %v MiB TotalAlloc = %v MiB Sys = %v MiB NumGC = %v", bToMb(m.Alloc), bToMb(m.TotalAlloc), bToMb(m.Sys), m.NumGC)
-		time.Sleep(10 * time.Second)
+// StripPort removes the port from a host header value
+func StripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
 	}
-}
-
-func bToMb(b uint64) uint64 {
-	return b / 1024 / 1024
+	return host
 }
 
 func InitLogger() {
@@ -2,30 +2,55 @@ package main
 
 import (
 	"embed"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
 	"github.com/obud-dev/tunnel/pkg/config"
+	"github.com/obud-dev/tunnel/pkg/metrics"
 	"github.com/obud-dev/tunnel/pkg/model"
 	"github.com/obud-dev/tunnel/pkg/response"
 	"github.com/obud-dev/tunnel/pkg/svc"
+	"github.com/obud-dev/tunnel/pkg/transport"
 	"github.com/obud-dev/tunnel/pkg/utils"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	userKey           = "user" // gin 上下文中通过认证的用户
+	minPasswordLength = 8
+)
+
 //go:embed web/dist/*
 var staticFiles embed.FS
 
 //go:embed web/dist/index.html
 var indexHtml []byte
 
-func ApiServer(ctx *svc.ServerCtx) {
+func ApiServer(ctx *svc.ServerCtx, server svc.Server) {
 	r := gin.Default()
+	// Prometheus 指标, 开启 PublicMetrics 时不需要认证
+	if ctx.Config.PublicMetrics {
+		r.GET("/metrics", gin.WrapH(metrics.ServerHandler()))
+	}
 	r.Use(AuthMiddleware(ctx))
+	if !ctx.Config.PublicMetrics {
+		r.GET("/metrics", gin.WrapH(metrics.ServerHandler()))
+	}
 
 	api := r.Group("/api")
+	// 隧道、连接及路由变化的实时推送 (Server-Sent Events)
+	api.GET("/events", func(c *gin.Context) {
+		streamEvents(ctx, c)
+	})
+
 	api.GET("/tunnels", func(c *gin.Context) {
 		tunnels, err := ctx.TunnelModel.GetTunnels()
 		response.Response(c, tunnels, err)
@@ -37,10 +62,18 @@ func ApiServer(ctx *svc.ServerCtx) {
 			response.Response(c, nil, response.New(-1, err.Error()))
 			return
 		}
+		if err := checkTunnelLimits(&tunnel); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
 		tunnel.ID = utils.GenerateID()
+		tunnel.QuotaUsed, tunnel.QuotaResetAt = 0, 0
 		tunnel.Token = utils.GenerateID()[0:32]
 		tunnel.Uptime = time.Now().Unix()
 		err := ctx.TunnelModel.Insert(&tunnel)
+		if err == nil {
+			ctx.Events.Publish(svc.Event{Type: svc.EventTunnelCreated, TunnelID: tunnel.ID, Data: tunnelEventData(&tunnel)})
+		}
 		response.Response(c, nil, err)
 	})
 
@@ -57,9 +90,27 @@ func ApiServer(ctx *svc.ServerCtx) {
 			response.Response(c, nil, response.New(-1, err.Error()))
 			return
 		}
+		if err := checkTunnelLimits(&tunnel); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		old, err := ctx.TunnelModel.GetTunnelByID(id)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		// 用量由服务端统计, 修改周期后重新计算重置时间
+		tunnel.QuotaUsed, tunnel.QuotaResetAt = old.QuotaUsed, old.QuotaResetAt
+		if tunnel.QuotaPeriod != old.QuotaPeriod {
+			tunnel.QuotaResetAt = 0
+		}
 		tunnel.ID = id
 		tunnel.Uptime = time.Now().Unix()
-		err := ctx.TunnelModel.Update(&tunnel)
+		err = ctx.TunnelModel.Update(&tunnel)
+		if err == nil {
+			ctx.Traffic.Load(&tunnel)
+			ctx.Events.Publish(svc.Event{Type: svc.EventTunnelUpdated, TunnelID: tunnel.ID, Data: tunnelEventData(&tunnel)})
+		}
 		response.Response(c, nil, err)
 	})
 
@@ -84,13 +135,139 @@ func ApiServer(ctx *svc.ServerCtx) {
 					response.Response(c, nil, err)
 					return
 				}
+				ctx.ErrorPageModel.DeleteByRouteID(route.ID)
+				ctx.Inspector.Clear(route.ID)
+				ctx.Limiter.RemoveRoute(route.ID)
+				ctx.Events.Publish(svc.Event{Type: svc.EventRouteDeleted, TunnelID: route.TunnelID, RouteID: route.ID, Data: routeEventData(&route)})
 			}
 		}
+		ctx.UpdateRoutes()
+		ctx.UpdateErrorPages()
 		ctx.DelTunnel(tunnel.ID)
+		ctx.Traffic.Remove(tunnel.ID)
+		ctx.Limiter.RemoveTunnel(tunnel.ID)
 		err = ctx.TunnelModel.Delete(tunnel)
+		if err == nil {
+			ctx.Events.Publish(svc.Event{Type: svc.EventTunnelDeleted, TunnelID: tunnel.ID, Data: tunnelEventData(tunnel)})
+		}
 		response.Response(c, nil, err)
 	})
 
+	// 隧道及其路由的限制计数
+	api.GET("/tunnels/:id/limits", func(c *gin.Context) {
+		id := c.Param("id")
+		routes, err := ctx.RouteModel.GetRoutesByTunnelID(id)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		maxStreams := 0
+		if tunnel, ok := ctx.GetTunnel(id); ok {
+			maxStreams = tunnel.MaxStreams
+		}
+		type routeLimits struct {
+			RouteID  string            `json:"route_id"`
+			Hostname string            `json:"hostname"`
+			Limits   model.RouteLimits `json:"limits"`
+			svc.RouteCounters
+		}
+		result := struct {
+			MaxStreams int           `json:"max_streams"`
+			Routes     []routeLimits `json:"routes"`
+			svc.TunnelCounters
+		}{MaxStreams: maxStreams, Routes: []routeLimits{}, TunnelCounters: ctx.Limiter.TunnelCounters(id)}
+		for _, route := range routes {
+			result.Routes = append(result.Routes, routeLimits{
+				RouteID:       route.ID,
+				Hostname:      route.Hostname,
+				Limits:        route.Limits,
+				RouteCounters: ctx.Limiter.RouteCounters(route.ID),
+			})
+		}
+		response.Response(c, result, nil)
+	})
+
+	// 隧道流量的时间序列, 可按路由过滤
+	api.GET("/tunnels/:id/stats", func(c *gin.Context) {
+		id := c.Param("id")
+		query, err := parseStatsQuery(c)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		routes, err := ctx.RouteModel.GetRoutesByTunnelID(id)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		// 先写入内存中的计数, 使结果包含最近的流量
+		ctx.Stats.Flush()
+		stats, err := ctx.TrafficStatModel.GetStats(id, query.from, query.to)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		response.Response(c, buildTrafficSeries(query, routes, stats), nil)
+	})
+
+	// 导出开启 inspect 的路由记录的 HTTP 请求, HAR 1.2 格式
+	api.GET("/tunnels/:id/export/har", func(c *gin.Context) {
+		id := c.Param("id")
+		query, err := parseExportQuery(c)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		routes, err := ctx.RouteModel.GetRoutesByTunnelID(id)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		server, err := ctx.ServerModel.GetServer()
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		captures := []*svc.CapturedRequest{}
+		for _, route := range routes {
+			for _, capture := range ctx.Inspector.List(route.ID) {
+				if query.match(&route, capture.Time) {
+					captures = append(captures, capture)
+				}
+			}
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="tunnel-%s.har"`, id))
+		c.JSON(http.StatusOK, buildHar(captures, server.Version))
+	})
+
+	// 导出开启 inspect 的 TCP 类路由记录的连接, pcapng 格式
+	api.GET("/tunnels/:id/export/pcapng", func(c *gin.Context) {
+		id := c.Param("id")
+		query, err := parseExportQuery(c)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		routes, err := ctx.RouteModel.GetRoutesByTunnelID(id)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		streams := []*svc.CapturedStream{}
+		for _, route := range routes {
+			for _, stream := range ctx.Inspector.Streams(route.ID) {
+				if query.match(&route, stream.Time) {
+					streams = append(streams, stream)
+				}
+			}
+		}
+		c.Header("Content-Type", "application/vnd.tcpdump.pcap")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="tunnel-%s.pcapng"`, id))
+		if err := writePcapng(c.Writer, streams); err != nil {
+			log.Error().Err(err).Msg("Failed to write pcapng export")
+		}
+	})
+
 	api.POST("/tunnels/:id/refreshtoken", func(c *gin.Context) {
 		id := c.Param("id")
 		tunnel, err := ctx.TunnelModel.GetTunnelByID(id)
@@ -103,12 +280,21 @@ func ApiServer(ctx *svc.ServerCtx) {
 		tunnel.Token = token
 		ctx.DelTunnel(tunnel.ID)
 		err = ctx.TunnelModel.Update(tunnel)
+		if err == nil {
+			ctx.Events.Publish(svc.Event{Type: svc.EventTokenRefreshed, TunnelID: tunnel.ID, Data: tunnelEventData(tunnel)})
+		}
 		response.Response(c, token, err)
 	})
 
-	api.GET("/routes/:tid", func(c *gin.Context) {
-		tid := c.Param("tid")
+	// 隧道的路由. 与路由 ID 的子路径共用同一个通配符, 这里的 :id 为隧道 ID
+	api.GET("/routes/:id", func(c *gin.Context) {
+		tid := c.Param("id")
 		routes, err := ctx.RouteModel.GetRoutesByTunnelID(tid)
+		for i := range routes {
+			if oidc := routes[i].Access.Oidc; oidc != nil {
+				oidc.ClientSecret = ""
+			}
+		}
 		response.Response(c, routes, err)
 	})
 
@@ -119,8 +305,23 @@ func ApiServer(ctx *svc.ServerCtx) {
 			return
 		}
 		route.ID = utils.GenerateID()
+		if err := hashRouteOptions(&route); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		if err := prepareRouteAccess(&route); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		if err := checkRouteLimits(&route); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
 		err := ctx.RouteModel.Insert(&route)
 		ctx.UpdateRoutes()
+		if err == nil {
+			ctx.Events.Publish(svc.Event{Type: svc.EventRouteCreated, TunnelID: route.TunnelID, RouteID: route.ID, Data: routeEventData(&route)})
+		}
 		response.Response(c, nil, err)
 	})
 
@@ -133,6 +334,13 @@ func ApiServer(ctx *svc.ServerCtx) {
 		}
 		err = ctx.RouteModel.Delete(route)
 		ctx.UpdateRoutes()
+		if err == nil {
+			ctx.Inspector.Clear(route.ID)
+			ctx.Limiter.RemoveRoute(route.ID)
+			ctx.Events.Publish(svc.Event{Type: svc.EventRouteDeleted, TunnelID: route.TunnelID, RouteID: route.ID, Data: routeEventData(route)})
+			err = ctx.ErrorPageModel.DeleteByRouteID(route.ID)
+			ctx.UpdateErrorPages()
+		}
 		response.Response(c, nil, err)
 	})
 
@@ -142,8 +350,386 @@ func ApiServer(ctx *svc.ServerCtx) {
 			response.Response(c, nil, response.New(-1, err.Error()))
 			return
 		}
+		// 查询路由时不返回 oidc 客户端密钥, 不传时保留原密钥
+		if oidc := route.Access.Oidc; oidc != nil && oidc.ClientSecret == "" {
+			if old, err := ctx.RouteModel.GetRouteByID(route.ID); err == nil && old.Access.Oidc != nil {
+				oidc.ClientSecret = old.Access.Oidc.ClientSecret
+			}
+		}
+		if err := hashRouteOptions(&route); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		if err := prepareRouteAccess(&route); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		if err := checkRouteLimits(&route); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
 		err := ctx.RouteModel.Update(&route)
 		ctx.UpdateRoutes()
+		if err == nil && !route.Inspect {
+			ctx.Inspector.Clear(route.ID)
+		}
+		if err == nil {
+			ctx.Events.Publish(svc.Event{Type: svc.EventRouteUpdated, TunnelID: route.TunnelID, RouteID: route.ID, Data: routeEventData(&route)})
+		}
+		response.Response(c, nil, err)
+	})
+
+	// 开启 inspect 的路由最近的请求及响应, 最新的在前
+	api.GET("/routes/:id/requests", func(c *gin.Context) {
+		response.Response(c, ctx.Inspector.List(c.Param("id")), nil)
+	})
+
+	// 开启 inspect 的 TCP 类路由最近的连接, 不含数据
+	api.GET("/routes/:id/streams", func(c *gin.Context) {
+		summaries := []svc.StreamSummary{}
+		for _, stream := range ctx.Inspector.Streams(c.Param("id")) {
+			summaries = append(summaries, stream.Summary())
+		}
+		response.Response(c, summaries, nil)
+	})
+
+	api.GET("/routes/:id/requests/:rid", func(c *gin.Context) {
+		capture, ok := ctx.Inspector.Get(c.Param("id"), c.Param("rid"))
+		if !ok {
+			response.Response(c, nil, response.New(-1, "request not found"))
+			return
+		}
+		response.Response(c, capture, nil)
+	})
+
+	api.DELETE("/routes/:id/requests", func(c *gin.Context) {
+		ctx.Inspector.Clear(c.Param("id"))
+		response.Response(c, nil, nil)
+	})
+
+	// 通过隧道重新发送记录的请求, 可修改方法、路径、头部及请求体
+	api.POST("/routes/:id/requests/:rid/replay", func(c *gin.Context) {
+		var mod replayRequest
+		if err := c.ShouldBindJSON(&mod); err != nil && !errors.Is(err, io.EOF) {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		route, err := ctx.RouteModel.GetRouteByID(c.Param("id"))
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		capture, ok := ctx.Inspector.Get(route.ID, c.Param("rid"))
+		if !ok {
+			response.Response(c, nil, response.New(-1, "request not found"))
+			return
+		}
+		req, err := buildReplayRequest(c.Request.Context(), capture, &mod)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		replay, err := server.Replay(route, req, capture.ID)
+		if err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		response.Response(c, replay, nil)
+	})
+
+	// 当前登录的用户
+	api.GET("/user", func(c *gin.Context) {
+		user := *currentUser(c)
+		user.Password = ""
+		response.Response(c, user, nil)
+	})
+
+	api.PUT("/user/password", func(c *gin.Context) {
+		var req struct {
+			OldPassword string `json:"old_password"`
+			Password    string `json:"password"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		user := *currentUser(c)
+		if !utils.CheckPassword(user.Password, req.OldPassword) {
+			response.Response(c, nil, response.New(-1, "old password is incorrect"))
+			return
+		}
+		if err := setUserPassword(&user, req.Password); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		err := ctx.UserModel.Update(&user)
+		response.Response(c, nil, err)
+	})
+
+	// 账号管理, 只有管理员可以访问
+	admin := api.Group("/users", AdminMiddleware)
+	admin.GET("", func(c *gin.Context) {
+		users, err := ctx.UserModel.GetUsers()
+		for i := range users {
+			users[i].Password = ""
+		}
+		response.Response(c, users, err)
+	})
+
+	admin.POST("", func(c *gin.Context) {
+		var user model.User
+		if err := c.BindJSON(&user); err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		if err := checkUsername(user.Username); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		if err := setUserPassword(&user, user.Password); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		user.ID = utils.GenerateID()
+		err := ctx.UserModel.Insert(&user)
+		user.Password = ""
+		response.Response(c, user, err)
+	})
+
+	admin.GET("/:id", func(c *gin.Context) {
+		user, err := ctx.UserModel.GetUserByID(c.Param("id"))
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		user.Password = ""
+		response.Response(c, user, nil)
+	})
+
+	admin.PUT("/:id", func(c *gin.Context) {
+		old, err := ctx.UserModel.GetUserByID(c.Param("id"))
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		var user model.User
+		if err := c.BindJSON(&user); err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		if err := checkUsername(user.Username); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		// 不传密码时保留原密码
+		if user.Password == "" {
+			user.Password = old.Password
+		} else if err := setUserPassword(&user, user.Password); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		if old.Admin && !user.Admin {
+			if admins, err := ctx.UserModel.CountAdmins(); err != nil || admins <= 1 {
+				response.Response(c, nil, response.New(-1, "at least one admin is required"))
+				return
+			}
+		}
+		user.ID, user.CreatedAt = old.ID, old.CreatedAt
+		err = ctx.UserModel.Update(&user)
+		user.Password = ""
+		response.Response(c, user, err)
+	})
+
+	admin.DELETE("/:id", func(c *gin.Context) {
+		user, err := ctx.UserModel.GetUserByID(c.Param("id"))
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		// 最后一个管理员只能删除自己, 因此也保证了至少保留一个管理员
+		if user.ID == currentUser(c).ID {
+			response.Response(c, nil, response.New(-1, "can not delete the current user"))
+			return
+		}
+		err = ctx.UserModel.Delete(user)
+		response.Response(c, nil, err)
+	})
+
+	// 订阅事件的 Webhook, 密钥只在创建时返回
+	api.GET("/webhooks", func(c *gin.Context) {
+		webhooks, err := ctx.WebhookModel.GetWebhooks()
+		for i := range webhooks {
+			webhooks[i].Secret = ""
+		}
+		response.Response(c, webhooks, err)
+	})
+
+	api.POST("/webhooks", func(c *gin.Context) {
+		var webhook model.Webhook
+		if err := c.BindJSON(&webhook); err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		if err := checkWebhook(&webhook); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		webhook.ID = utils.GenerateID()
+		if webhook.Secret == "" {
+			webhook.Secret = utils.GenerateID()[0:32]
+		}
+		err := ctx.WebhookModel.Insert(&webhook)
+		response.Response(c, webhook, err)
+	})
+
+	api.GET("/webhooks/:id", func(c *gin.Context) {
+		webhook, err := ctx.WebhookModel.GetWebhookByID(c.Param("id"))
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		webhook.Secret = ""
+		response.Response(c, webhook, nil)
+	})
+
+	api.PUT("/webhooks/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		old, err := ctx.WebhookModel.GetWebhookByID(id)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		var webhook model.Webhook
+		if err := c.BindJSON(&webhook); err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		if err := checkWebhook(&webhook); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		// 不传密钥时保留原密钥
+		if webhook.Secret == "" {
+			webhook.Secret = old.Secret
+		}
+		webhook.ID = id
+		err = ctx.WebhookModel.Update(&webhook)
+		webhook.Secret = ""
+		response.Response(c, webhook, err)
+	})
+
+	api.DELETE("/webhooks/:id", func(c *gin.Context) {
+		webhook, err := ctx.WebhookModel.GetWebhookByID(c.Param("id"))
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		err = ctx.WebhookModel.Delete(webhook)
+		response.Response(c, nil, err)
+	})
+
+	// 发送测试事件, 返回第一次发送的结果
+	api.POST("/webhooks/:id/ping", func(c *gin.Context) {
+		webhook, err := ctx.WebhookModel.GetWebhookByID(c.Param("id"))
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		delivery, err := ctx.Webhooks.Ping(webhook)
+		response.Response(c, delivery, err)
+	})
+
+	// 最近的发送记录, 最新的在前
+	api.GET("/webhooks/:id/deliveries", func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit <= 0 || limit > 500 {
+			response.Response(c, nil, response.New(-1, "limit must be between 1 and 500"))
+			return
+		}
+		deliveries, err := ctx.WebhookModel.GetDeliveries(c.Param("id"), limit)
+		response.Response(c, deliveries, err)
+	})
+
+	api.GET("/webhooks/:id/deliveries/:did", func(c *gin.Context) {
+		delivery, err := ctx.WebhookModel.GetDeliveryByID(c.Param("id"), c.Param("did"))
+		response.Response(c, delivery, err)
+	})
+
+	// 以新的发送记录重新发送事件
+	api.POST("/webhooks/:id/deliveries/:did/redeliver", func(c *gin.Context) {
+		delivery, err := ctx.WebhookModel.GetDeliveryByID(c.Param("id"), c.Param("did"))
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		redelivery, err := ctx.Webhooks.Redeliver(delivery)
+		response.Response(c, redelivery, err)
+	})
+
+	// 自定义错误页面, route_id 为空时作用于整个服务
+	api.GET("/errorpages", func(c *gin.Context) {
+		var pages []model.ErrorPage
+		var err error
+		if routeID, ok := c.GetQuery("route_id"); ok {
+			pages, err = ctx.ErrorPageModel.GetErrorPagesByRouteID(routeID)
+		} else {
+			pages, err = ctx.ErrorPageModel.GetErrorPages()
+		}
+		response.Response(c, pages, err)
+	})
+
+	api.POST("/errorpages", func(c *gin.Context) {
+		var page model.ErrorPage
+		if err := c.BindJSON(&page); err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		if err := transport.ParseErrorPage(&page); err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		if page.RouteID != "" {
+			if _, err := ctx.RouteModel.GetRouteByID(page.RouteID); err != nil {
+				response.Response(c, nil, err)
+				return
+			}
+		}
+		page.ID = utils.GenerateID()
+		err := ctx.ErrorPageModel.Insert(&page)
+		ctx.UpdateErrorPages()
+		response.Response(c, page, err)
+	})
+
+	api.PUT("/errorpages/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		if _, err := ctx.ErrorPageModel.GetErrorPageByID(id); err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		var page model.ErrorPage
+		if err := c.BindJSON(&page); err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		if err := transport.ParseErrorPage(&page); err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		page.ID = id
+		err := ctx.ErrorPageModel.Update(&page)
+		ctx.UpdateErrorPages()
+		response.Response(c, nil, err)
+	})
+
+	api.DELETE("/errorpages/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		page, err := ctx.ErrorPageModel.GetErrorPageByID(id)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		err = ctx.ErrorPageModel.Delete(page)
+		ctx.UpdateErrorPages()
 		response.Response(c, nil, err)
 	})
 
@@ -154,10 +740,15 @@ func ApiServer(ctx *svc.ServerCtx) {
 			response.Response(c, nil, err)
 			return
 		}
+		// 配置了客户端专用端口时连接该端口
+		listenOn := ctx.Config.ListenOn
+		if ctx.Config.ListenControl != "" {
+			listenOn = ctx.Config.ListenControl
+		}
 		config := &config.ClientConfig{
 			TunnelID: tunnel.ID,
 			Token:    tunnel.Token,
-			Server:   ctx.Config.Host + ctx.Config.ListenOn,
+			Server:   ctx.Config.Host + listenOn,
 		}
 		token, err := config.Encode()
 		if err != nil {
@@ -169,7 +760,92 @@ func ApiServer(ctx *svc.ServerCtx) {
 
 	api.GET("/server/info", func(c *gin.Context) {
 		server, err := ctx.ServerModel.GetServer()
-		response.Response(c, server, err)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		info := struct {
+			*model.Server
+			CertificateWarnings []svc.CertificateWarning `json:"certificate_warnings"` // 即将过期或已过期的证书
+		}{server, ctx.CertificateWarnings()}
+		response.Response(c, info, nil)
+	})
+
+	// 手动管理的 HTTPS 证书
+	api.GET("/certificates", func(c *gin.Context) {
+		certs, err := ctx.CertificateModel.GetCertificates()
+		for i := range certs {
+			certs[i].Key = ""
+		}
+		response.Response(c, certs, err)
+	})
+
+	api.POST("/certificates", func(c *gin.Context) {
+		var req certificateRequest
+		if err := c.BindJSON(&req); err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		cert := model.Certificate{
+			ID:        utils.GenerateID(),
+			Cert:      req.Cert,
+			Key:       req.Key,
+			Hostnames: req.Hostnames,
+		}
+		if _, err := svc.ParseCertificate(&cert); err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		err := ctx.CertificateModel.Insert(&cert)
+		if err == nil {
+			err = ctx.UpdateCertificates()
+		}
+		cert.Key = ""
+		response.Response(c, cert, err)
+	})
+
+	api.PUT("/certificates/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		cert, err := ctx.CertificateModel.GetCertificateByID(id)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		var req certificateRequest
+		if err := c.BindJSON(&req); err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		// 只更新关联域名时可以不传证书和私钥
+		if req.Cert != "" || req.Key != "" {
+			cert.Cert = req.Cert
+			cert.Key = req.Key
+		}
+		cert.Hostnames = req.Hostnames
+		if _, err := svc.ParseCertificate(cert); err != nil {
+			response.Response(c, nil, response.New(-1, err.Error()))
+			return
+		}
+		err = ctx.CertificateModel.Update(cert)
+		if err == nil {
+			err = ctx.UpdateCertificates()
+		}
+		cert.Key = ""
+		response.Response(c, cert, err)
+	})
+
+	api.DELETE("/certificates/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		cert, err := ctx.CertificateModel.GetCertificateByID(id)
+		if err != nil {
+			response.Response(c, nil, err)
+			return
+		}
+		err = ctx.CertificateModel.Delete(cert)
+		if err == nil {
+			err = ctx.UpdateCertificates()
+		}
+		response.Response(c, nil, err)
 	})
 
 	r.Use(static.Serve("/", static.EmbedFolder(staticFiles, "web/dist")))
@@ -181,6 +857,110 @@ func ApiServer(ctx *svc.ServerCtx) {
 	r.Run(ctx.Config.Api)
 }
 
+// certificateRequest is the body for uploading or replacing a certificate
+type certificateRequest struct {
+	Cert      string   `json:"cert"`      // 证书链 (PEM)
+	Key       string   `json:"key"`       // 私钥 (PEM)
+	Hostnames []string `json:"hostnames"` // 关联的路由域名
+}
+
+// hashRouteOptions replaces plain passwords in the route options with bcrypt hashes
+func hashRouteOptions(route *model.Route) error {
+	if route.Options.File == nil {
+		return nil
+	}
+	return hashBasicAuth(route.Options.File.BasicAuth)
+}
+
+// hashBasicAuth replaces the plain passwords of user:password accounts in place with bcrypt
+// hashes, accounts that already hold a hash are kept
+func hashBasicAuth(accounts []string) error {
+	for i, account := range accounts {
+		user, password, ok := strings.Cut(account, ":")
+		if !ok || user == "" {
+			return response.New(-1, "basic auth must be user:password")
+		}
+		if utils.IsPasswordHash(password) {
+			continue
+		}
+		hash, err := utils.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		accounts[i] = user + ":" + hash
+	}
+	return nil
+}
+
+// prepareRouteAccess validates the address rules and login settings of the route access
+// policy and hashes its passwords and tokens
+func prepareRouteAccess(route *model.Route) error {
+	access := &route.Access
+	for _, entry := range append(append([]string{}, access.Allow...), access.Deny...) {
+		if _, err := utils.ParseIPNet(entry); err != nil {
+			return response.New(-1, err.Error())
+		}
+	}
+	if err := hashBasicAuth(access.BasicAuth); err != nil {
+		return err
+	}
+	for i, token := range access.Tokens {
+		if token == "" {
+			return response.New(-1, "token must not be empty")
+		}
+		if !utils.IsTokenHash(token) {
+			access.Tokens[i] = utils.HashToken(token)
+		}
+	}
+	if oidc := access.Oidc; oidc != nil {
+		if route.Protocol.IsStream() {
+			return response.New(-1, "oidc login is only available for http routes")
+		}
+		if oidc.Issuer == "" || oidc.ClientID == "" {
+			return response.New(-1, "oidc requires issuer and client_id")
+		}
+		if u, err := url.Parse(oidc.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return response.New(-1, "oidc issuer must be an http(s) url")
+		}
+	}
+	return nil
+}
+
+// checkTunnelLimits validates the stream, bandwidth and quota settings of the tunnel
+func checkTunnelLimits(tunnel *model.Tunnel) error {
+	if tunnel.MaxStreams < 0 || tunnel.UploadRate < 0 || tunnel.DownloadRate < 0 || tunnel.QuotaBytes < 0 {
+		return response.New(-1, "limits must not be negative")
+	}
+	switch tunnel.QuotaPeriod {
+	case "", model.QuotaDaily, model.QuotaMonthly:
+		return nil
+	}
+	return response.New(-1, "quota_period must be daily or monthly")
+}
+
+// checkRouteLimits rejects negative rate and concurrency limits
+func checkRouteLimits(route *model.Route) error {
+	limits := route.Limits
+	if limits.Rate < 0 || limits.Burst < 0 || limits.RatePerIP < 0 || limits.BurstPerIP < 0 || limits.MaxConns < 0 {
+		return response.New(-1, "limits must not be negative")
+	}
+	return nil
+}
+
+// checkWebhook validates the URL and event filter of the webhook
+func checkWebhook(webhook *model.Webhook) error {
+	if u, err := url.Parse(webhook.Url); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return response.New(-1, "url must be an http(s) url")
+	}
+	for i, event := range webhook.Events {
+		webhook.Events[i] = strings.TrimSpace(event)
+		if webhook.Events[i] == "" {
+			return response.New(-1, "events must not be empty")
+		}
+	}
+	return nil
+}
+
 func AuthMiddleware(ctx *svc.ServerCtx) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// 从请求中获取 basic auth
@@ -191,13 +971,53 @@ func AuthMiddleware(ctx *svc.ServerCtx) gin.HandlerFunc {
 			return
 		}
 		// 验证 basic auth
-		if username != ctx.Config.User || password != ctx.Config.Password {
+		user, ok := ctx.Authenticate(username, password)
+		if !ok {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"message": "Unauthorized",
 			})
 			c.Abort()
 			return
 		}
+		c.Set(userKey, user)
 		c.Next()
 	}
 }
+
+// AdminMiddleware only lets admins through, it runs after AuthMiddleware
+func AdminMiddleware(c *gin.Context) {
+	if !currentUser(c).Admin {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "Forbidden",
+		})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// currentUser returns the user authenticated by AuthMiddleware
+func currentUser(c *gin.Context) *model.User {
+	return c.MustGet(userKey).(*model.User)
+}
+
+// setUserPassword hashes the new password of the user
+func setUserPassword(user *model.User, password string) error {
+	if len(password) < minPasswordLength {
+		return response.New(-1, fmt.Sprintf("password must be at least %d characters", minPasswordLength))
+	}
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	user.Password = hash
+	return nil
+}
+
+// checkUsername rejects names that can not be sent with basic auth
+func checkUsername(username string) error {
+	if username == "" || strings.ContainsAny(username, ": \t") {
+		return response.New(-1, "username must not be empty or contain colons or spaces")
+	}
+	return nil
+}
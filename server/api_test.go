@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/utils"
+)
+
+func TestHashBasicAuth(t *testing.T) {
+	accounts := []string{"alice:secret", "bob:pa:ss"}
+	if err := hashBasicAuth(accounts); err != nil {
+		t.Fatal(err)
+	}
+	for i, plain := range []string{"secret", "pa:ss"} {
+		user, hash, _ := strings.Cut(accounts[i], ":")
+		if user != []string{"alice", "bob"}[i] || !utils.IsPasswordHash(hash) || !utils.CheckPassword(hash, plain) {
+			t.Errorf("account %d = %q", i, accounts[i])
+		}
+	}
+
+	// 已经是哈希的密码保持不变
+	hashed := append([]string{}, accounts...)
+	if err := hashBasicAuth(hashed); err != nil {
+		t.Fatal(err)
+	}
+	if hashed[0] != accounts[0] || hashed[1] != accounts[1] {
+		t.Error("hashed passwords were hashed again")
+	}
+
+	for _, invalid := range []string{"nopassword", ":secret"} {
+		if err := hashBasicAuth([]string{invalid}); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+}
+
+func TestPrepareRouteAccess(t *testing.T) {
+	route := &model.Route{Protocol: model.TypeHttp, Access: model.AccessPolicy{
+		BasicAuth: []string{"alice:secret"},
+		Tokens:    []string{"token"},
+		Allow:     []string{"10.0.0.0/8", "192.168.1.1"},
+	}}
+	if err := prepareRouteAccess(route); err != nil {
+		t.Fatal(err)
+	}
+	if _, hash, _ := strings.Cut(route.Access.BasicAuth[0], ":"); !utils.IsPasswordHash(hash) {
+		t.Errorf("basic auth not hashed: %q", route.Access.BasicAuth[0])
+	}
+	if route.Access.Tokens[0] != utils.HashToken("token") {
+		t.Errorf("token not hashed: %q", route.Access.Tokens[0])
+	}
+
+	for name, access := range map[string]model.AccessPolicy{
+		"bad cidr":      {Deny: []string{"10.0.0.0/99"}},
+		"empty token":   {Tokens: []string{""}},
+		"bad account":   {BasicAuth: []string{"alice"}},
+		"oidc issuer":   {Oidc: &model.OidcPolicy{Issuer: "ftp://idp", ClientID: "c"}},
+		"oidc clientid": {Oidc: &model.OidcPolicy{Issuer: "https://idp"}},
+	} {
+		if err := prepareRouteAccess(&model.Route{Protocol: model.TypeHttp, Access: access}); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+	ssh := &model.Route{Protocol: model.TypeSsh, Access: model.AccessPolicy{Oidc: &model.OidcPolicy{Issuer: "https://idp", ClientID: "c"}}}
+	if err := prepareRouteAccess(ssh); err == nil {
+		t.Error("oidc accepted on a stream route")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+const eventPingInterval = 30 * time.Second // 保持连接的注释行间隔, 避免代理关闭空闲连接
+
+// routeEventData is the route summary sent with route events, access credentials and
+// target options are left out
+func routeEventData(route *model.Route) map[string]any {
+	return map[string]any{
+		"id":        route.ID,
+		"tunnel_id": route.TunnelID,
+		"hostname":  route.Hostname,
+		"protocol":  route.Protocol,
+	}
+}
+
+// tunnelEventData is the tunnel summary sent with tunnel events, the token is left out
+func tunnelEventData(tunnel *model.Tunnel) map[string]any {
+	return map[string]any{
+		"id":   tunnel.ID,
+		"name": tunnel.Name,
+	}
+}
+
+// streamEvents sends the server events to the client as Server-Sent Events until it
+// disconnects. The types query parameter filters the events by comma separated type
+// prefixes such as tunnel,route.deleted, and a reconnecting client receives the events
+// it missed after the Last-Event-ID it sends
+func streamEvents(ctx *svc.ServerCtx, c *gin.Context) {
+	var types []string
+	for _, t := range strings.Split(c.Query("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	after, _ := strconv.ParseInt(c.GetHeader("Last-Event-ID"), 10, 64)
+	events, cancel := ctx.Events.Subscribe(after)
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // 关闭 nginx 的响应缓冲
+	c.Status(http.StatusOK)
+	// 提示浏览器断线后的重连间隔
+	fmt.Fprint(c.Writer, "retry: 3000\n\n")
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(eventPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// 处理不及时被断开, 浏览器会带上 Last-Event-ID 重连
+				return
+			}
+			if !svc.MatchEventType(event.Type, types) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		case <-ticker.C:
+			fmt.Fprint(c.Writer, ": ping\n\n")
+		case <-c.Request.Context().Done():
+			return
+		}
+		c.Writer.Flush()
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/response"
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+// exportQuery selects the captures to export
+type exportQuery struct {
+	from    int64 // 开始时间 (unix 秒), 包含
+	to      int64 // 结束时间 (unix 秒), 不包含
+	routeID string
+}
+
+// parseExportQuery reads from, to (unix seconds) and route_id from the query string, by
+// default everything captured is exported
+func parseExportQuery(c *gin.Context) (*exportQuery, error) {
+	query := &exportQuery{from: 0, to: math.MaxInt64, routeID: c.Query("route_id")}
+	for name, value := range map[string]*int64{"from": &query.from, "to": &query.to} {
+		if v := c.Query(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return nil, response.New(-1, name+" must be a non-negative integer")
+			}
+			*value = n
+		}
+	}
+	if query.to <= query.from {
+		return nil, response.New(-1, "to must be after from")
+	}
+	return query, nil
+}
+
+// match reports whether a capture of the route started at t is selected
+func (q *exportQuery) match(route *model.Route, t time.Time) bool {
+	return (q.routeID == "" || q.routeID == route.ID) && t.Unix() >= q.from && t.Unix() < q.to
+}
+
+// HAR 1.2 格式, 见 http://www.softwareishard.com/blog/har-12-spec/
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	Url         string         `json:"url"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// buildHar converts the captured requests to a HAR log, oldest first
+func buildHar(captures []*svc.CapturedRequest, version string) *harFile {
+	sort.SliceStable(captures, func(i, j int) bool { return captures[i].Time.Before(captures[j].Time) })
+	har := &harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "tunnel", Version: version},
+		Entries: []harEntry{},
+	}}
+	for _, capture := range captures {
+		har.Log.Entries = append(har.Log.Entries, harEntryOf(capture))
+	}
+	return har
+}
+
+func harEntryOf(capture *svc.CapturedRequest) harEntry {
+	u := &url.URL{Scheme: capture.Scheme, Host: capture.Host}
+	if parsed, err := url.ParseRequestURI(capture.Path); err == nil {
+		u.Path, u.RawPath, u.RawQuery = parsed.Path, parsed.RawPath, parsed.RawQuery
+	}
+	entry := harEntry{
+		StartedDateTime: capture.Time.Format(time.RFC3339Nano),
+		Time:            capture.Duration,
+		Request: harRequest{
+			Method:      capture.Method,
+			Url:         u.String(),
+			HttpVersion: capture.Proto,
+			Cookies:     harCookies((&http.Request{Header: capture.RequestHeaders}).Cookies()),
+			Headers:     harHeaders(capture.RequestHeaders),
+			QueryString: harHeaders(http.Header(u.Query())),
+			HeadersSize: -1,
+			BodySize:    len(capture.RequestBody),
+		},
+		Response: harResponse{
+			Status:      capture.Status,
+			StatusText:  http.StatusText(capture.Status),
+			HttpVersion: capture.Proto,
+			Cookies:     harCookies((&http.Response{Header: capture.ResponseHeaders}).Cookies()),
+			Headers:     harHeaders(capture.ResponseHeaders),
+			Content: harContent{
+				Size:     len(capture.ResponseBody),
+				MimeType: capture.ResponseHeaders.Get("Content-Type"),
+			},
+			RedirectURL: capture.ResponseHeaders.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(capture.ResponseBody),
+		},
+		// 只记录了总时长
+		Timings: harTimings{Wait: capture.Duration},
+	}
+	if len(capture.RequestBody) > 0 {
+		text, encoding := harText(capture.RequestBody)
+		entry.Request.PostData = &harPostData{MimeType: capture.RequestHeaders.Get("Content-Type"), Text: text}
+		// postData 没有 encoding 字段, 在注释中说明
+		var comments []string
+		if encoding != "" {
+			comments = append(comments, "base64 encoded")
+		}
+		if capture.RequestTruncated {
+			comments = append(comments, "truncated")
+		}
+		entry.Request.PostData.Comment = strings.Join(comments, ", ")
+	}
+	if len(capture.ResponseBody) > 0 {
+		entry.Response.Content.Text, entry.Response.Content.Encoding = harText(capture.ResponseBody)
+	}
+	if capture.ResponseTruncated {
+		entry.Response.Content.Comment = "truncated"
+	}
+	if capture.ReplayOf != "" {
+		entry.Comment = "replay of " + capture.ReplayOf
+	}
+	return entry
+}
+
+// harText returns the body as text, bodies that are not valid UTF-8 are base64 encoded
+func harText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			headers = append(headers, harNameValue{Name: key, Value: value})
+		}
+	}
+	return headers
+}
+
+func harCookies(cookies []*http.Cookie) []harCookie {
+	result := []harCookie{}
+	for _, cookie := range cookies {
+		result = append(result, harCookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	return result
+}
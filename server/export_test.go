@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+func TestBuildHar(t *testing.T) {
+	start := time.Now()
+	binary := []byte{0xff, 0x00, 0xfe}
+	captures := []*svc.CapturedRequest{
+		{
+			ID:       "second",
+			Time:     start.Add(time.Second),
+			Duration: 12.5,
+			ReplayOf: "first",
+			Method:   http.MethodPost,
+			Scheme:   "https",
+			Host:     "app.example.com",
+			Path:     "/upload?name=a%20b&x=1",
+			Proto:    "HTTP/2.0",
+			RequestHeaders: http.Header{
+				"Content-Type": {"application/octet-stream"},
+				"Cookie":       {"session=abc; theme=dark"},
+			},
+			RequestBody:      binary,
+			RequestTruncated: true,
+			Status:           http.StatusFound,
+			ResponseHeaders: http.Header{
+				"Location":   {"/done"},
+				"Set-Cookie": {"session=def; Path=/"},
+			},
+		},
+		{
+			ID:              "first",
+			Time:            start,
+			Method:          http.MethodGet,
+			Scheme:          "http",
+			Host:            "app.example.com",
+			Path:            "/",
+			Proto:           "HTTP/1.1",
+			Status:          http.StatusOK,
+			ResponseHeaders: http.Header{"Content-Type": {"text/plain"}},
+			ResponseBody:    []byte("hello"),
+		},
+	}
+
+	har := buildHar(captures, "v1.0.0")
+	if har.Log.Version != "1.2" || har.Log.Creator.Version != "v1.0.0" || len(har.Log.Entries) != 2 {
+		t.Fatalf("log = %+v", har.Log)
+	}
+	// 按时间排序
+	first, second := har.Log.Entries[0], har.Log.Entries[1]
+	if first.Request.Url != "http://app.example.com/" || first.Response.Content.Text != "hello" || first.Response.Content.MimeType != "text/plain" {
+		t.Errorf("first entry = %+v", first)
+	}
+
+	req := second.Request
+	if req.Url != "https://app.example.com/upload?name=a%20b&x=1" || req.HttpVersion != "HTTP/2.0" {
+		t.Errorf("request url %s %s", req.Url, req.HttpVersion)
+	}
+	if len(req.QueryString) != 2 || req.QueryString[0] != (harNameValue{Name: "name", Value: "a b"}) {
+		t.Errorf("query string = %+v", req.QueryString)
+	}
+	if len(req.Cookies) != 2 || req.Cookies[1] != (harCookie{Name: "theme", Value: "dark"}) {
+		t.Errorf("request cookies = %+v", req.Cookies)
+	}
+	// 非 UTF-8 的请求体以 base64 保存
+	if req.PostData == nil || req.PostData.Text != base64.StdEncoding.EncodeToString(binary) || req.PostData.Comment != "base64 encoded, truncated" {
+		t.Errorf("post data = %+v", req.PostData)
+	}
+	resp := second.Response
+	if resp.Status != http.StatusFound || resp.StatusText != "Found" || resp.RedirectURL != "/done" {
+		t.Errorf("response = %+v", resp)
+	}
+	if len(resp.Cookies) != 1 || resp.Cookies[0].Value != "def" {
+		t.Errorf("response cookies = %+v", resp.Cookies)
+	}
+	if second.Comment != "replay of first" || second.Time != 12.5 || second.Timings.Wait != 12.5 {
+		t.Errorf("entry = %+v", second)
+	}
+}
+
+func TestExportQueryMatch(t *testing.T) {
+	query, err := parseExportQuery(statsContext("from=100&to=200&route_id=r1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := &model.Route{ID: "r1"}
+	for _, tc := range []struct {
+		route *model.Route
+		t     int64
+		want  bool
+	}{
+		{route, 100, true},
+		{route, 199, true},
+		{route, 200, false},
+		{route, 99, false},
+		{&model.Route{ID: "r2"}, 150, false},
+	} {
+		if got := query.match(tc.route, time.Unix(tc.t, 0)); got != tc.want {
+			t.Errorf("match(%s, %d) = %v", tc.route.ID, tc.t, got)
+		}
+	}
+	for _, invalid := range []string{"from=x", "to=-1", "from=5&to=5"} {
+		if _, err := parseExportQuery(statsContext(invalid)); err == nil {
+			t.Errorf("%s accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/obud-dev/tunnel/pkg/response"
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+// replayRequest lists the changes applied to a captured request before it is replayed,
+// empty fields keep the captured values
+type replayRequest struct {
+	Method  string            `json:"method"`  // 请求方法
+	Path    string            `json:"path"`    // 请求 URI, 如 /hook?debug=1
+	Headers map[string]string `json:"headers"` // 覆盖的请求头部, 值为空时删除该头部
+	Body    *string           `json:"body"`    // 替换请求体
+}
+
+// buildReplayRequest rebuilds the captured request with the changes of mod applied
+func buildReplayRequest(ctx context.Context, capture *svc.CapturedRequest, mod *replayRequest) (*http.Request, error) {
+	method, path, body := capture.Method, capture.Path, capture.RequestBody
+	if mod.Method != "" {
+		method = strings.ToUpper(mod.Method)
+	}
+	if mod.Path != "" {
+		if !strings.HasPrefix(mod.Path, "/") {
+			return nil, response.New(-1, "path must start with /")
+		}
+		path = mod.Path
+	}
+	if mod.Body != nil {
+		body = []byte(*mod.Body)
+	} else if capture.RequestTruncated {
+		return nil, response.New(-1, "the captured request body is truncated, provide the body to replay")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, capture.Scheme+"://"+capture.Host+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, response.New(-1, err.Error())
+	}
+	req.Header = capture.RequestHeaders.Clone()
+	for key, value := range mod.Headers {
+		if value == "" {
+			req.Header.Del(key)
+		} else {
+			req.Header.Set(key, value)
+		}
+	}
+	// 让目标服务区分重放的请求
+	req.Header.Set("X-Tunnel-Replay", capture.ID)
+	return req, nil
+}
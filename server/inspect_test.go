@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+func TestBuildReplayRequest(t *testing.T) {
+	capture := &svc.CapturedRequest{
+		ID:             "c1",
+		Method:         http.MethodPost,
+		Scheme:         "https",
+		Host:           "app.example.com",
+		Path:           "/hook?x=1",
+		RequestHeaders: http.Header{"Content-Type": {"application/json"}, "Authorization": {"Bearer t"}},
+		RequestBody:    []byte(`{"a":1}`),
+	}
+
+	req, err := buildReplayRequest(context.Background(), capture, &replayRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(req.Body)
+	if req.Method != http.MethodPost || req.URL.String() != "https://app.example.com/hook?x=1" || string(body) != `{"a":1}` {
+		t.Errorf("replay = %s %s %s", req.Method, req.URL, body)
+	}
+	if req.Header.Get("X-Tunnel-Replay") != "c1" || req.Header.Get("Authorization") != "Bearer t" {
+		t.Errorf("headers = %v", req.Header)
+	}
+
+	// 修改方法、路径、头部及请求体, 不影响记录的请求
+	replacement := "new body"
+	req, err = buildReplayRequest(context.Background(), capture, &replayRequest{
+		Method:  "put",
+		Path:    "/hook?debug=1",
+		Headers: map[string]string{"Authorization": "", "X-Debug": "1"},
+		Body:    &replacement,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(req.Body)
+	if req.Method != http.MethodPut || req.URL.RequestURI() != "/hook?debug=1" || string(body) != replacement {
+		t.Errorf("modified replay = %s %s %s", req.Method, req.URL, body)
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("X-Debug") != "1" {
+		t.Errorf("modified headers = %v", req.Header)
+	}
+	if capture.RequestHeaders.Get("Authorization") != "Bearer t" {
+		t.Error("captured headers modified")
+	}
+
+	if _, err := buildReplayRequest(context.Background(), capture, &replayRequest{Path: "hook"}); err == nil {
+		t.Error("relative path accepted")
+	}
+	// 截断的请求体必须替换后才能重放
+	capture.RequestTruncated = true
+	if _, err := buildReplayRequest(context.Background(), capture, &replayRequest{}); err == nil {
+		t.Error("truncated body replayed")
+	}
+	if _, err := buildReplayRequest(context.Background(), capture, &replayRequest{Body: &replacement}); err != nil {
+		t.Errorf("truncated body replaced: %v", err)
+	}
+}
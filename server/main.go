@@ -2,9 +2,15 @@ package main
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
 
 	"github.com/obud-dev/tunnel/pkg/config"
 	"github.com/obud-dev/tunnel/pkg/svc"
+	"github.com/obud-dev/tunnel/pkg/tracing"
 	"github.com/obud-dev/tunnel/pkg/transport"
 	"github.com/obud-dev/tunnel/pkg/utils"
 )
@@ -13,26 +19,78 @@ func main() {
 	host := os.Getenv("Host")
 	listenOn := os.Getenv("ListenOn")
 	api := os.Getenv("Api")
+	listenTls := os.Getenv("ListenTls")
+	listenControl := os.Getenv("ListenControl")
+	listenHttp := os.Getenv("ListenHttp")
+	var trustedProxies []string
+	if v := os.Getenv("TrustedProxies"); v != "" {
+		trustedProxies = strings.Split(v, ",")
+	}
 	user := os.Getenv("User")
 	password := os.Getenv("Password")
+	reconnectGrace, _ := time.ParseDuration(os.Getenv("ReconnectGrace"))
+	reconnectQueue, _ := strconv.Atoi(os.Getenv("ReconnectQueue"))
+	responseTimeout, _ := time.ParseDuration(os.Getenv("ResponseTimeout"))
+	maxStreams, _ := strconv.Atoi(os.Getenv("MaxStreams"))
+	publicMetrics, _ := strconv.ParseBool(os.Getenv("PublicMetrics"))
+	allowDefaultCredentials, _ := strconv.ParseBool(os.Getenv("AllowDefaultCredentials"))
+	accessLogMaxSize, _ := strconv.Atoi(os.Getenv("AccessLogMaxSize"))
+	accessLogMaxBackups, _ := strconv.Atoi(os.Getenv("AccessLogMaxBackups"))
 
 	utils.InitLogger()
 
 	var server svc.Server
 	svcCtx := svc.NewServerCtx(config.ServerConfig{
-		Host:     host,
-		ListenOn: listenOn,
-		Api:      api,
-		User:     user,
-		Password: password,
-	})
+		Host:      host,
+		ListenOn:  listenOn,
+		Api:       api,
+		ListenTls: listenTls,
+		User:      user,
+		Password:  password,
+
+		ListenControl:  listenControl,
+		ListenHttp:     listenHttp,
+		TrustedProxies: trustedProxies,
+		SessionSecret:  os.Getenv("SessionSecret"),
+		PublicMetrics:  publicMetrics,
+		TraceEndpoint:  os.Getenv("TraceEndpoint"),
+
+		AllowDefaultCredentials: allowDefaultCredentials,
 
-	// go utils.PrintMemoryUsage()
+		AccessLog:           os.Getenv("AccessLog"),
+		AccessLogFormat:     os.Getenv("AccessLogFormat"),
+		AccessLogMaxSize:    accessLogMaxSize,
+		AccessLogMaxBackups: accessLogMaxBackups,
+
+		ReconnectGrace:  reconnectGrace,
+		ReconnectQueue:  reconnectQueue,
+		ResponseTimeout: responseTimeout,
+		MaxStreams:      maxStreams,
+
+		AcmeEmail:     os.Getenv("AcmeEmail"),
+		AcmeDirectory: os.Getenv("AcmeDirectory"),
+		AcmeCA:        os.Getenv("AcmeCA"),
+	})
 
+	if _, err := tracing.Init("tunnel-server", svcCtx.Config.TraceEndpoint); err != nil {
+		log.Error().Err(err).Msg("Failed to set up tracing")
+	}
 	server = transport.NewTcpServer(svcCtx)
 
 	go server.Listen()
-	go ApiServer(svcCtx)
+	if svcCtx.Config.ListenTls != "" {
+		go server.ListenTls()
+	}
+	if svcCtx.Config.ListenControl != "" {
+		go server.ListenControl()
+	}
+	if svcCtx.Config.ListenHttp != "" {
+		go server.ListenHttp()
+	}
+	go svcCtx.Traffic.Run()
+	go svcCtx.Stats.Run()
+	go svcCtx.Webhooks.Run()
+	go ApiServer(svcCtx, server)
 
 	select {}
 }
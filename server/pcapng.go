@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+// 将 TCP 类路由记录的连接数据导出为 pcapng 文件。隧道只转发字节流, 文件中的 IPv4/TCP
+// 头部是按记录的数据合成的: 访客使用其 IP 和端口 (IPv6 访客换成 192.0.2.1),
+// 目标使用 198.51.100.1 及路由目标的端口
+
+const (
+	pcapngLinkTypeRaw = 101  // LINKTYPE_RAW, 数据包以 IP 头部开始
+	pcapngSegmentSize = 1460 // 合成的 TCP 段最大长度
+	pcapngClientSeq   = 1000 // 访客的初始序列号
+	pcapngServerSeq   = 5000 // 目标的初始序列号
+)
+
+var (
+	pcapngClientFallback = net.IPv4(192, 0, 2, 1).To4()
+	pcapngServerAddr     = net.IPv4(198, 51, 100, 1).To4()
+)
+
+const (
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpPsh = 0x08
+	tcpAck = 0x10
+)
+
+// pcapPacket is a synthesized IPv4 packet and its capture time
+type pcapPacket struct {
+	time time.Time
+	data []byte
+}
+
+// tcpFlow synthesizes the packets of one TCP connection
+type tcpFlow struct {
+	client, server         net.IP
+	clientPort, serverPort uint16
+	clientSeq, serverSeq   uint32
+	ipID                   uint16
+	packets                []pcapPacket
+}
+
+// send adds a segment from the client (out false) or the server (out true)
+func (f *tcpFlow) send(t time.Time, out bool, flags byte, payload []byte) {
+	src, dst, srcPort, dstPort := f.client, f.server, f.clientPort, f.serverPort
+	seq, ack := &f.clientSeq, f.serverSeq
+	if out {
+		src, dst, srcPort, dstPort = f.server, f.client, f.serverPort, f.clientPort
+		seq, ack = &f.serverSeq, f.clientSeq
+	}
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	if flags&tcpAck != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], ack)
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+	pseudo := make([]byte, 12, 12+len(tcp))
+	copy(pseudo[0:], src)
+	copy(pseudo[4:], dst)
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(append(pseudo, tcp...)))
+
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	f.ipID++
+	binary.BigEndian.PutUint16(ip[4:], f.ipID)
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // 不分片
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], src)
+	copy(ip[16:], dst)
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+
+	f.packets = append(f.packets, pcapPacket{time: t, data: append(ip, tcp...)})
+	*seq += uint32(len(payload))
+	if flags&(tcpSyn|tcpFin) != 0 {
+		*seq++
+	}
+}
+
+// checksum is the Internet checksum of data
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// streamPackets synthesizes the handshake, data and teardown of a captured stream
+func streamPackets(stream *svc.CapturedStream) []pcapPacket {
+	chunks, closedAt, _ := stream.Chunks()
+	flow := &tcpFlow{
+		client:     pcapngClientFallback,
+		server:     pcapngServerAddr,
+		serverPort: targetPort(stream.Target, stream.Protocol),
+		clientSeq:  pcapngClientSeq,
+		serverSeq:  pcapngServerSeq,
+	}
+	if host, port, err := net.SplitHostPort(stream.ClientAddr); err == nil {
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			flow.client = ip
+		}
+		n, _ := strconv.ParseUint(port, 10, 16)
+		flow.clientPort = uint16(n)
+	}
+
+	flow.send(stream.Time, false, tcpSyn, nil)
+	flow.send(stream.Time, true, tcpSyn|tcpAck, nil)
+	flow.send(stream.Time, false, tcpAck, nil)
+	for _, chunk := range chunks {
+		for data := chunk.Data; len(data) > 0; {
+			n := min(len(data), pcapngSegmentSize)
+			flow.send(chunk.Time, chunk.Out, tcpPsh|tcpAck, data[:n])
+			data = data[n:]
+		}
+	}
+	if !closedAt.IsZero() {
+		flow.send(closedAt, false, tcpFin|tcpAck, nil)
+		flow.send(closedAt, true, tcpFin|tcpAck, nil)
+		flow.send(closedAt, false, tcpAck, nil)
+	}
+	return flow.packets
+}
+
+// targetPort returns the port of a stream route target, using the default port of the
+// protocol when the target has none
+func targetPort(target, protocol string) uint16 {
+	if _, addr, ok := strings.Cut(target, "://"); ok {
+		target = addr
+	}
+	if _, port, err := net.SplitHostPort(strings.TrimSuffix(target, "/")); err == nil {
+		if n, err := strconv.ParseUint(port, 10, 16); err == nil {
+			return uint16(n)
+		}
+	}
+	if protocol == "ssh" {
+		return 22
+	}
+	return 443
+}
+
+// writePcapng writes the packets of the streams in time order as a pcapng file
+func writePcapng(w io.Writer, streams []*svc.CapturedStream) error {
+	var packets []pcapPacket
+	for _, stream := range streams {
+		packets = append(packets, streamPackets(stream)...)
+	}
+	sort.SliceStable(packets, func(i, j int) bool { return packets[i].time.Before(packets[j].time) })
+
+	// Section Header Block, 长度未知的 section
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], 0x1A2B3C4D)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint64(shb[8:], 0xFFFFFFFFFFFFFFFF)
+	if err := writePcapngBlock(w, 0x0A0D0D0A, shb); err != nil {
+		return err
+	}
+	// Interface Description Block, 时间戳精度为默认的微秒
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], pcapngLinkTypeRaw)
+	if err := writePcapngBlock(w, 1, idb); err != nil {
+		return err
+	}
+	// Enhanced Packet Blocks
+	for _, packet := range packets {
+		epb := make([]byte, 20, 20+len(packet.data)+3)
+		ts := uint64(packet.time.UnixMicro())
+		binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+		binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+		binary.LittleEndian.PutUint32(epb[12:], uint32(len(packet.data)))
+		binary.LittleEndian.PutUint32(epb[16:], uint32(len(packet.data)))
+		epb = append(epb, packet.data...)
+		if err := writePcapngBlock(w, 6, epb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePcapngBlock writes a block with the body padded to 32 bits
+func writePcapngBlock(w io.Writer, blockType uint32, body []byte) error {
+	padded := (len(body) + 3) &^ 3
+	length := uint32(12 + padded)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, blockType)
+	binary.Write(&buf, binary.LittleEndian, length)
+	buf.Write(body)
+	buf.Write(make([]byte, padded-len(body)))
+	binary.Write(&buf, binary.LittleEndian, length)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+// readPcapngBlocks splits a pcapng file into the type and body of its blocks
+func readPcapngBlocks(t *testing.T, data []byte) (types []uint32, bodies [][]byte) {
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block: %d bytes left", len(data))
+		}
+		length := binary.LittleEndian.Uint32(data[4:])
+		if length%4 != 0 || int(length) > len(data) || binary.LittleEndian.Uint32(data[length-4:]) != length {
+			t.Fatalf("invalid block length %d", length)
+		}
+		types = append(types, binary.LittleEndian.Uint32(data))
+		bodies = append(bodies, data[8:length-4])
+		data = data[length:]
+	}
+	return types, bodies
+}
+
+func TestWritePcapng(t *testing.T) {
+	stream := &svc.CapturedStream{
+		ID:         "s1",
+		Protocol:   "ssh",
+		Time:       time.Now(),
+		ClientAddr: "203.0.113.7:50000",
+		Target:     "127.0.0.1:2222",
+	}
+	stream.Record(true, []byte("SSH-2.0-server\r\n"))
+	stream.Record(false, bytes.Repeat([]byte("x"), pcapngSegmentSize+10))
+	stream.Close()
+
+	var buf bytes.Buffer
+	if err := writePcapng(&buf, []*svc.CapturedStream{stream}); err != nil {
+		t.Fatal(err)
+	}
+	types, bodies := readPcapngBlocks(t, buf.Bytes())
+	if types[0] != 0x0A0D0D0A || binary.LittleEndian.Uint32(bodies[0]) != 0x1A2B3C4D {
+		t.Fatal("missing section header block")
+	}
+	if types[1] != 1 || binary.LittleEndian.Uint16(bodies[1]) != pcapngLinkTypeRaw {
+		t.Fatal("missing interface description block")
+	}
+	// 握手 3 个包, 数据 1 + 2 个包 (超过段长度后拆分), 关闭 3 个包
+	packets := bodies[2:]
+	if len(packets) != 9 {
+		t.Fatalf("%d packets, want 9", len(packets))
+	}
+
+	var payloads []string
+	var last uint64
+	for i, epb := range packets {
+		if types[2+i] != 6 {
+			t.Fatalf("block %d has type %d", 2+i, types[2+i])
+		}
+		ts := uint64(binary.LittleEndian.Uint32(epb[4:]))<<32 | uint64(binary.LittleEndian.Uint32(epb[8:]))
+		if ts < last {
+			t.Errorf("packet %d is out of time order", i)
+		}
+		last = ts
+		packet := epb[20 : 20+binary.LittleEndian.Uint32(epb[12:])]
+		ip, tcp := packet[:20], packet[20:]
+		if checksum(ip) != 0 {
+			t.Errorf("packet %d has an invalid IP checksum", i)
+		}
+		pseudo := append([]byte{}, ip[12:20]...)
+		pseudo = append(pseudo, 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+		if checksum(append(pseudo, tcp...)) != 0 {
+			t.Errorf("packet %d has an invalid TCP checksum", i)
+		}
+		src, srcPort := ip[12:16], binary.BigEndian.Uint16(tcp[0:])
+		dstPort := binary.BigEndian.Uint16(tcp[2:])
+		fromClient := bytes.Equal(src, []byte{203, 0, 113, 7})
+		if fromClient && (srcPort != 50000 || dstPort != 2222) || !fromClient && (srcPort != 2222 || dstPort != 50000) {
+			t.Errorf("packet %d from %v:%d to port %d", i, src, srcPort, dstPort)
+		}
+		if payload := tcp[20:]; len(payload) > 0 {
+			payloads = append(payloads, string(payload))
+		}
+	}
+	if len(payloads) != 3 || payloads[0] != "SSH-2.0-server\r\n" || len(payloads[1]) != pcapngSegmentSize || len(payloads[2]) != 10 {
+		t.Errorf("got %d payloads, want the server banner and the client data in two segments", len(payloads))
+	}
+
+	// 最后一个包确认目标的 FIN: 序列号依次为 SYN 1 + 数据长度 + FIN 1
+	tcp := packets[8][40:]
+	if seq, ack := binary.BigEndian.Uint32(tcp[4:]), binary.BigEndian.Uint32(tcp[8:]); seq != pcapngClientSeq+1+pcapngSegmentSize+10+1 || ack != pcapngServerSeq+1+16+1 {
+		t.Errorf("final seq %d ack %d", seq, ack)
+	}
+}
+
+func TestTargetPort(t *testing.T) {
+	for _, tc := range []struct {
+		target, protocol string
+		want             uint16
+	}{
+		{"127.0.0.1:2222", "ssh", 2222},
+		{"tcp://[::1]:8443/", "tls", 8443},
+		{"example.com", "ssh", 22},
+		{"example.com", "tls", 443},
+	} {
+		if got := targetPort(tc.target, tc.protocol); got != tc.want {
+			t.Errorf("targetPort(%s, %s) = %d, want %d", tc.target, tc.protocol, got, tc.want)
+		}
+	}
+}
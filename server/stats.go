@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/obud-dev/tunnel/pkg/model"
+	"github.com/obud-dev/tunnel/pkg/response"
+	"github.com/obud-dev/tunnel/pkg/svc"
+)
+
+// statsQuery is the time range and resolution of a traffic statistics request
+type statsQuery struct {
+	from     int64
+	to       int64
+	interval int64
+	routeID  string
+}
+
+// parseStatsQuery reads from, to (unix seconds) and interval (seconds) from the query string,
+// by default the last 24 hours in one hour steps. The range is aligned to the interval
+func parseStatsQuery(c *gin.Context) (*statsQuery, error) {
+	bucket := int64(svc.StatsBucket.Seconds())
+	now := time.Now().Unix()
+	query := &statsQuery{to: now, from: now - 24*3600, interval: 3600, routeID: c.Query("route_id")}
+	for name, value := range map[string]*int64{"from": &query.from, "to": &query.to, "interval": &query.interval} {
+		if v := c.Query(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return nil, response.New(-1, name+" must be a non-negative integer")
+			}
+			*value = n
+		}
+	}
+	// 间隔按统计时间段取整
+	if query.interval < bucket {
+		query.interval = bucket
+	}
+	query.interval = query.interval / bucket * bucket
+	query.from = query.from / query.interval * query.interval
+	query.to = (query.to + query.interval - 1) / query.interval * query.interval
+	if query.to <= query.from {
+		return nil, response.New(-1, "to must be after from")
+	}
+	if (query.to-query.from)/query.interval > maxStatsPoints {
+		return nil, response.New(-1, fmt.Sprintf("too many points, use an interval of at least %ds", (query.to-query.from)/maxStatsPoints))
+	}
+	return query, nil
+}
+
+const maxStatsPoints = 2000 // 单次查询返回的最大时间点数
+
+// trafficPoint is the traffic of one interval
+type trafficPoint struct {
+	Time        int64 `json:"time,omitempty"`
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+	Requests    int64 `json:"requests"`
+	Connections int64 `json:"connections"`
+	Errors      int64 `json:"errors"`
+}
+
+// routeTraffic is the total traffic of a route over the requested range
+type routeTraffic struct {
+	RouteID  string `json:"route_id"`
+	Hostname string `json:"hostname"`
+	trafficPoint
+}
+
+// trafficSeries is the response of the tunnel statistics API
+type trafficSeries struct {
+	From     int64          `json:"from"`
+	To       int64          `json:"to"`
+	Interval int64          `json:"interval"`
+	Total    trafficPoint   `json:"total"`
+	Series   []trafficPoint `json:"series"` // 每个间隔一个点, 没有流量时为 0
+	Routes   []routeTraffic `json:"routes"` // 每个路由的合计
+}
+
+func (p *trafficPoint) add(stat *model.TrafficStat) {
+	p.BytesIn += stat.BytesIn
+	p.BytesOut += stat.BytesOut
+	p.Requests += stat.Requests
+	p.Connections += stat.Connections
+	p.Errors += stat.Errors
+}
+
+// buildTrafficSeries sums the statistic rows into the intervals of the query
+func buildTrafficSeries(query *statsQuery, routes []model.Route, stats []model.TrafficStat) *trafficSeries {
+	result := &trafficSeries{From: query.from, To: query.to, Interval: query.interval, Routes: []routeTraffic{}}
+	for t := query.from; t < query.to; t += query.interval {
+		result.Series = append(result.Series, trafficPoint{Time: t})
+	}
+	totals := map[string]*routeTraffic{}
+	for _, route := range routes {
+		if query.routeID != "" && route.ID != query.routeID {
+			continue
+		}
+		result.Routes = append(result.Routes, routeTraffic{RouteID: route.ID, Hostname: route.Hostname})
+	}
+	for i := range result.Routes {
+		totals[result.Routes[i].RouteID] = &result.Routes[i]
+	}
+	for i := range stats {
+		stat := &stats[i]
+		if query.routeID != "" && stat.RouteID != query.routeID {
+			continue
+		}
+		result.Series[(stat.Bucket-query.from)/query.interval].add(stat)
+		result.Total.add(stat)
+		// 已删除路由的流量只计入合计
+		if total, ok := totals[stat.RouteID]; ok {
+			total.add(stat)
+		}
+	}
+	return result
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/obud-dev/tunnel/pkg/model"
+)
+
+func statsContext(query string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/tunnels/t1/stats?"+query, nil)
+	return c
+}
+
+func TestParseStatsQuery(t *testing.T) {
+	for _, tc := range []struct {
+		query              string
+		from, to, interval int64
+	}{
+		// 范围按间隔对齐
+		{"from=3700&to=7300&interval=3600", 3600, 10800, 3600},
+		// 间隔至少为一个统计时间段, 并按时间段取整
+		{"from=0&to=600&interval=10", 0, 600, 300},
+		{"from=0&to=1200&interval=700", 0, 1200, 600},
+		{"from=100&to=200&route_id=r1", 0, 3600, 3600},
+	} {
+		query, err := parseStatsQuery(statsContext(tc.query))
+		if err != nil {
+			t.Errorf("%s: %v", tc.query, err)
+			continue
+		}
+		if query.from != tc.from || query.to != tc.to || query.interval != tc.interval {
+			t.Errorf("%s: got from %d to %d interval %d", tc.query, query.from, query.to, query.interval)
+		}
+	}
+	if query, err := parseStatsQuery(statsContext("route_id=r1")); err != nil || query.to-query.from < 24*3600 || query.routeID != "r1" {
+		t.Errorf("default query = %+v, %v", query, err)
+	}
+
+	for _, invalid := range []string{
+		"from=abc",
+		"interval=-1",
+		"from=7200&to=3600",
+		"from=0&to=86400000&interval=300",
+	} {
+		if _, err := parseStatsQuery(statsContext(invalid)); err == nil {
+			t.Errorf("%s accepted", invalid)
+		}
+	}
+}
+
+func TestBuildTrafficSeries(t *testing.T) {
+	query := &statsQuery{from: 0, to: 1800, interval: 600}
+	routes := []model.Route{{ID: "r1", Hostname: "a.example.com"}, {ID: "r2", Hostname: "b.example.com"}}
+	stats := []model.TrafficStat{
+		{RouteID: "r1", Bucket: 0, BytesIn: 10, Requests: 1},
+		{RouteID: "r1", Bucket: 300, BytesIn: 20, Requests: 2},
+		{RouteID: "r2", Bucket: 1200, BytesOut: 5, Connections: 1},
+		// 已删除的路由
+		{RouteID: "gone", Bucket: 1500, Errors: 3},
+	}
+
+	series := buildTrafficSeries(query, routes, stats)
+	if len(series.Series) != 3 {
+		t.Fatalf("%d points, want 3", len(series.Series))
+	}
+	want := []trafficPoint{
+		{Time: 0, BytesIn: 30, Requests: 3},
+		{Time: 600},
+		{Time: 1200, BytesOut: 5, Connections: 1, Errors: 3},
+	}
+	for i, p := range series.Series {
+		if p != want[i] {
+			t.Errorf("point %d = %+v, want %+v", i, p, want[i])
+		}
+	}
+	if total := (trafficPoint{BytesIn: 30, BytesOut: 5, Requests: 3, Connections: 1, Errors: 3}); series.Total != total {
+		t.Errorf("total = %+v", series.Total)
+	}
+	if len(series.Routes) != 2 || series.Routes[0].BytesIn != 30 || series.Routes[1].BytesOut != 5 {
+		t.Errorf("routes = %+v", series.Routes)
+	}
+
+	// 按路由过滤
+	query.routeID = "r2"
+	series = buildTrafficSeries(query, routes, stats)
+	if len(series.Routes) != 1 || series.Routes[0].RouteID != "r2" || series.Total.BytesIn != 0 || series.Total.BytesOut != 5 {
+		t.Errorf("filtered series = %+v", series)
+	}
+}
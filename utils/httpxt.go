@@ -44,7 +44,6 @@ func main() {
 	}
 
 	utils.InitLogger()
-	go utils.PrintMemoryUsage()
 
 	// 使用 WaitGroup 等待所有请求完成
 	var wg sync.WaitGroup